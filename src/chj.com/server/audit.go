@@ -0,0 +1,85 @@
+package main
+
+// 审计日志-记录需要事后追溯的操作(强制重置设备等), 每条记录写一行JSON
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// 内存中保留的最近记录数
+const auditRecentSize = 1000
+
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	DeviceName string    `json:"deviceName,omitempty"`
+	PlayerId   int       `json:"playerId,omitempty"`
+	Operator   string    `json:"operator,omitempty"`
+	Detail     string    `json:"detail,omitempty"`
+}
+
+type AuditLog struct {
+	clock Clock
+
+	lock sync.Mutex
+	// 写入目标, nil表示只保存在内存中
+	w io.Writer
+	// 最近的记录, 用于http接口查询
+	recent []*AuditEntry
+}
+
+func NewAuditLog(clock Clock, w io.Writer) *AuditLog {
+	this := new(AuditLog)
+	this.clock = clock
+	this.w = w
+	this.recent = make([]*AuditEntry, 0)
+	return this
+}
+
+// 追加写入到文件
+func NewFileAuditLog(clock Clock, path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewAuditLog(clock, f), nil
+}
+
+// 记录一条审计日志, 时间由日志填写
+func (this *AuditLog) Record(entry *AuditEntry) {
+	entry.Time = this.clock.Now()
+	line, _ := json.Marshal(entry)
+	log.Println("审计: ", string(line))
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.recent = append(this.recent, entry)
+	if len(this.recent) > auditRecentSize {
+		this.recent = this.recent[len(this.recent)-auditRecentSize:]
+	}
+
+	if this.w != nil {
+		if _, err := this.w.Write(append(line, '\n')); err != nil {
+			log.Println("写入审计日志失败: ", err)
+		}
+	}
+}
+
+// 最近的n条记录, 新的在后面
+func (this *AuditLog) Recent(n int) []*AuditEntry {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if n > len(this.recent) {
+		n = len(this.recent)
+	}
+	ret := make([]*AuditEntry, n)
+	copy(ret, this.recent[len(this.recent)-n:])
+	return ret
+}
@@ -0,0 +1,281 @@
+package main
+
+// 玩家token校验-登陆时校验token并得到玩家id, 校验方式在配置文件中选择
+// mysql: 与数据库中的session token比较(auth_mysql.go, 依赖数据库model包, 编译时加-tags mysql才包含)
+// http: 调用php服务器接口校验
+// hmac: 本地校验签名token, 格式: 玩家id:过期时间:签名
+// jwt: 本地校验HS256签名的JWT, sub为玩家id
+// static: 配置文件或测试中指定的固定token
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// token校验失败
+var ErrInvalidToken = errors.New("invalid token")
+
+// token校验器, 可以在多个player进程中并发调用
+type Authenticator interface {
+	// 校验玩家token, 返回玩家id
+	Authenticate(ctx context.Context, userToken string) (int, error)
+}
+
+// 根据配置创建校验器, params为配置文件auth节的内容
+type AuthenticatorFactory func(facade *Facade, params map[string]interface{}) (Authenticator, error)
+
+var authenticators = make(map[string]AuthenticatorFactory)
+
+// 注册校验方式
+func RegisterAuthenticator(name string, factory AuthenticatorFactory) {
+	authenticators[name] = factory
+}
+
+func init() {
+	RegisterAuthenticator("http", newHttpAuthenticator)
+	RegisterAuthenticator("hmac", newHmacAuthenticator)
+	RegisterAuthenticator("jwt", newJwtAuthenticator)
+	RegisterAuthenticator("static", newStaticAuthenticator)
+}
+
+// 按名称创建校验器
+func NewAuthenticator(facade *Facade, name string, params map[string]interface{}) (Authenticator, error) {
+	factory, ok := authenticators[name]
+	if !ok && name == "mysql" {
+		return nil, errors.New("mysql authenticator not compiled in, build with -tags mysql")
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown authenticator: %s", name)
+	}
+	return factory(facade, params)
+}
+
+// 从token中取出玩家id, 不校验签名, 只用于查找在线的玩家
+func tokenUserId(userToken string) int {
+	if parts := strings.Split(userToken, "."); len(parts) == 3 {
+		claims, err := jwtClaims(parts[1])
+		if err != nil {
+			return 0
+		}
+		return claims.userId()
+	}
+
+	userId, _ := strconv.Atoi(strings.Split(userToken, ":")[0])
+	return userId
+}
+
+//////////////////////////////////////////////////////////
+// php服务器校验, 接口参数为[token], 返回玩家id, 0表示无效
+
+type httpAuthenticator struct {
+	facade  *Facade
+	service string
+	method  string
+}
+
+func newHttpAuthenticator(facade *Facade, params map[string]interface{}) (Authenticator, error) {
+	this := &httpAuthenticator{facade: facade, service: "user", method: "checkToken"}
+	if service, ok := params["service"].(string); ok {
+		this.service = service
+	}
+	if method, ok := params["method"].(string); ok {
+		this.method = method
+	}
+	return this, nil
+}
+
+func (this *httpAuthenticator) Authenticate(ctx context.Context, userToken string) (int, error) {
+	data, err := this.facade.callApi(this.service, this.method, []interface{}{userToken})
+	if err != nil {
+		return 0, err
+	}
+	userId, _ := data.(float64)
+	if userId <= 0 {
+		return 0, ErrInvalidToken
+	}
+	return int(userId), nil
+}
+
+//////////////////////////////////////////////////////////
+// hmac签名token, 签名为hex(HMAC-SHA256(secret, "玩家id:过期时间")), 过期时间为unix秒
+
+type hmacAuthenticator struct {
+	clock  Clock
+	secret []byte
+}
+
+func newHmacAuthenticator(facade *Facade, params map[string]interface{}) (Authenticator, error) {
+	secret, _ := params["secret"].(string)
+	if secret == "" {
+		return nil, errors.New("hmac authenticator: secret required")
+	}
+	return &hmacAuthenticator{facade.clock, []byte(secret)}, nil
+}
+
+// 生成签名token, 用于测试和php服务器对照实现
+func SignHmacToken(secret string, userId int, expires time.Time) string {
+	payload := fmt.Sprintf("%d:%d", userId, expires.Unix())
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return payload + ":" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (this *hmacAuthenticator) Authenticate(ctx context.Context, userToken string) (int, error) {
+	parts := strings.Split(userToken, ":")
+	if len(parts) != 3 {
+		return 0, ErrInvalidToken
+	}
+	userId, err := strconv.Atoi(parts[0])
+	if err != nil || userId <= 0 {
+		return 0, ErrInvalidToken
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || this.clock.Now().Unix() >= expires {
+		return 0, ErrInvalidToken
+	}
+
+	signature, err := hex.DecodeString(parts[2])
+	mac := hmac.New(sha256.New, this.secret)
+	mac.Write([]byte(parts[0] + ":" + parts[1]))
+	if err != nil || !hmac.Equal(signature, mac.Sum(nil)) {
+		return 0, ErrInvalidToken
+	}
+	return userId, nil
+}
+
+//////////////////////////////////////////////////////////
+// JWT, 只支持HS256, 校验exp和nbf
+
+type jwtAuthenticator struct {
+	clock  Clock
+	secret []byte
+	issuer string
+}
+
+type jwtClaimSet struct {
+	Sub interface{} `json:"sub"`
+	Iss string      `json:"iss"`
+	Exp float64     `json:"exp"`
+	Nbf float64     `json:"nbf"`
+}
+
+// sub可以是数字或字符串
+func (this *jwtClaimSet) userId() int {
+	switch sub := this.Sub.(type) {
+	case float64:
+		return int(sub)
+	case string:
+		userId, _ := strconv.Atoi(sub)
+		return userId
+	}
+	return 0
+}
+
+func jwtClaims(segment string) (*jwtClaimSet, error) {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return nil, err
+	}
+	claims := new(jwtClaimSet)
+	if err := json.Unmarshal(data, claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func newJwtAuthenticator(facade *Facade, params map[string]interface{}) (Authenticator, error) {
+	secret, _ := params["secret"].(string)
+	if secret == "" {
+		return nil, errors.New("jwt authenticator: secret required")
+	}
+	issuer, _ := params["issuer"].(string)
+	return &jwtAuthenticator{facade.clock, []byte(secret), issuer}, nil
+}
+
+func (this *jwtAuthenticator) Authenticate(ctx context.Context, userToken string) (int, error) {
+	parts := strings.Split(userToken, ".")
+	if len(parts) != 3 {
+		return 0, ErrInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(data, &header) != nil || header.Alg != "HS256" {
+		return 0, ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	mac := hmac.New(sha256.New, this.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if err != nil || !hmac.Equal(signature, mac.Sum(nil)) {
+		return 0, ErrInvalidToken
+	}
+
+	claims, err := jwtClaims(parts[1])
+	if err != nil {
+		return 0, ErrInvalidToken
+	}
+	now := float64(this.clock.Now().Unix())
+	if claims.Exp != 0 && now >= claims.Exp || claims.Nbf != 0 && now < claims.Nbf {
+		return 0, ErrInvalidToken
+	}
+	if this.issuer != "" && claims.Iss != this.issuer {
+		return 0, ErrInvalidToken
+	}
+	userId := claims.userId()
+	if userId <= 0 {
+		return 0, ErrInvalidToken
+	}
+	return userId, nil
+}
+
+//////////////////////////////////////////////////////////
+// 固定token, 用于测试和本地调试, 配置格式: {"type": "static", "tokens": {"7:abc": 7}}
+
+type StaticAuthenticator struct {
+	lock   sync.RWMutex
+	tokens map[string]int
+}
+
+func NewStaticAuthenticator() *StaticAuthenticator {
+	return &StaticAuthenticator{tokens: make(map[string]int)}
+}
+
+func newStaticAuthenticator(facade *Facade, params map[string]interface{}) (Authenticator, error) {
+	this := NewStaticAuthenticator()
+	tokens, _ := params["tokens"].(map[string]interface{})
+	for token, userId := range tokens {
+		id, _ := userId.(float64)
+		this.Add(token, int(id))
+	}
+	return this, nil
+}
+
+func (this *StaticAuthenticator) Add(userToken string, userId int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.tokens[userToken] = userId
+}
+
+func (this *StaticAuthenticator) Authenticate(ctx context.Context, userToken string) (int, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	userId, ok := this.tokens[userToken]
+	if !ok || userId <= 0 {
+		return 0, ErrInvalidToken
+	}
+	return userId, nil
+}
@@ -0,0 +1,42 @@
+//go:build mysql
+// +build mysql
+
+package main
+
+// 数据库校验-与数据库中保存的玩家session token比较, token格式: 玩家id:随机串
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"chj.com/zwwserver/model"
+)
+
+func init() {
+	RegisterAuthenticator("mysql", newMysqlAuthenticator)
+}
+
+type mysqlAuthenticator struct{}
+
+// 数据库配置写到model中
+func newMysqlAuthenticator(facade *Facade, params map[string]interface{}) (Authenticator, error) {
+	model.Config_userCountPerDB = int32(facade.config.userCountPerDB)
+	for key, value := range facade.config.mysqlConfig {
+		model.Config_mysqlConfig[key] = value
+	}
+	return mysqlAuthenticator{}, nil
+}
+
+func (this mysqlAuthenticator) Authenticate(ctx context.Context, userToken string) (int, error) {
+	userId, err := strconv.Atoi(strings.Split(userToken, ":")[0])
+	if err != nil || userId <= 0 {
+		return 0, ErrInvalidToken
+	}
+
+	sessionModel := model.NewSessionModel(int32(userId))
+	if sessionModel.GetToken() != userToken {
+		return 0, ErrInvalidToken
+	}
+	return userId, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAuthenticator(t *testing.T, facade *Facade, name string, params map[string]interface{}) Authenticator {
+	auth, err := NewAuthenticator(facade, name, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auth
+}
+
+func signJwt(secret string, header string, claims string) string {
+	encode := base64.RawURLEncoding.EncodeToString
+	payload := encode([]byte(header)) + "." + encode([]byte(claims))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return payload + "." + encode(mac.Sum(nil))
+}
+
+func TestHmacAuthenticator(t *testing.T) {
+	clock := NewFakeClock()
+	auth := newTestAuthenticator(t, &Facade{clock: clock}, "hmac", map[string]interface{}{"secret": "s3cret"})
+
+	token := SignHmacToken("s3cret", 7, clock.Now().Add(time.Hour))
+	if userId, err := auth.Authenticate(context.Background(), token); err != nil || userId != 7 {
+		t.Fatalf("authenticate = %d, %v", userId, err)
+	}
+	if tokenUserId(token) != 7 {
+		t.Fatalf("tokenUserId = %d", tokenUserId(token))
+	}
+
+	// 签名不对, 篡改玩家id和过期的token
+	for _, token := range []string{
+		SignHmacToken("other", 7, clock.Now().Add(time.Hour)),
+		"8" + token[1:],
+		SignHmacToken("s3cret", 7, clock.Now()),
+		"7:token",
+	} {
+		if _, err := auth.Authenticate(context.Background(), token); err != ErrInvalidToken {
+			t.Fatalf("authenticate %s: %v", token, err)
+		}
+	}
+	if _, err := NewAuthenticator(&Facade{clock: clock}, "hmac", nil); err == nil {
+		t.Fatal("hmac without secret accepted")
+	}
+}
+
+func TestJwtAuthenticator(t *testing.T) {
+	clock := NewFakeClock()
+	auth := newTestAuthenticator(t, &Facade{clock: clock}, "jwt", map[string]interface{}{"secret": "s3cret", "issuer": "php"})
+	header := `{"alg":"HS256","typ":"JWT"}`
+	exp := clock.Now().Add(time.Hour).Unix()
+
+	token := signJwt("s3cret", header, fmt.Sprintf(`{"sub":"7","iss":"php","exp":%d}`, exp))
+	if userId, err := auth.Authenticate(context.Background(), token); err != nil || userId != 7 {
+		t.Fatalf("authenticate = %d, %v", userId, err)
+	}
+	if tokenUserId(token) != 7 {
+		t.Fatalf("tokenUserId = %d", tokenUserId(token))
+	}
+
+	for name, token := range map[string]string{
+		"secret":  signJwt("other", header, fmt.Sprintf(`{"sub":7,"iss":"php","exp":%d}`, exp)),
+		"alg":     signJwt("s3cret", `{"alg":"none"}`, fmt.Sprintf(`{"sub":7,"iss":"php","exp":%d}`, exp)),
+		"expired": signJwt("s3cret", header, fmt.Sprintf(`{"sub":7,"iss":"php","exp":%d}`, clock.Now().Unix())),
+		"issuer":  signJwt("s3cret", header, fmt.Sprintf(`{"sub":7,"iss":"other","exp":%d}`, exp)),
+		"sub":     signJwt("s3cret", header, fmt.Sprintf(`{"iss":"php","exp":%d}`, exp)),
+	} {
+		if _, err := auth.Authenticate(context.Background(), token); err != ErrInvalidToken {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestHttpAuthenticator(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/user/checkToken" {
+			fmt.Fprint(w, `{"error": "unknown method"}`)
+			return
+		}
+		var params []string
+		json.NewDecoder(r.Body).Decode(&params)
+		if len(params) == 1 && params[0] == "good" {
+			fmt.Fprint(w, `{"data": 7}`)
+			return
+		}
+		fmt.Fprint(w, `{"data": 0}`)
+	}))
+	defer api.Close()
+
+	auth := newTestAuthenticator(t, &Facade{config: &Config{apiRoot: api.URL}}, "http", nil)
+	if userId, err := auth.Authenticate(context.Background(), "good"); err != nil || userId != 7 {
+		t.Fatalf("authenticate = %d, %v", userId, err)
+	}
+	if _, err := auth.Authenticate(context.Background(), "bad"); err != ErrInvalidToken {
+		t.Fatalf("authenticate bad token: %v", err)
+	}
+}
+
+// 缺省使用不依赖数据库的校验方式, 没有编译mysql时给出明确的错误
+func TestAuthenticatorDefault(t *testing.T) {
+	if config := NewConfig(""); config.authType != "http" {
+		t.Fatalf("default authType = %s", config.authType)
+	}
+	if _, ok := authenticators["mysql"]; ok {
+		t.Skip("built with mysql")
+	}
+	if _, err := NewAuthenticator(nil, "mysql", nil); err == nil || !strings.Contains(err.Error(), "-tags mysql") {
+		t.Fatalf("mysql err = %v", err)
+	}
+}
+
+func TestPlayerLoginAuth(t *testing.T) {
+	h := NewHarness(t)
+	rh, conn := h.NewPlayer()
+
+	h.PlayerSend(rh, "login", "7:wrong")
+	if login := conn.Last("login").(map[string]interface{}); login["code"].(float64) != 1 {
+		t.Fatalf("login = %v", login)
+	}
+	if h.facade.registry.Lookup(KindPlayer, 7) != nil {
+		t.Fatal("player registered with invalid token")
+	}
+
+	player, conn := h.NewLoggedInPlayer(7)
+	if login := conn.Last("login").(map[string]interface{}); login["code"].(float64) != 0 {
+		t.Fatalf("login = %v", login)
+	}
+	if h.facade.registry.Lookup(KindPlayer, 7) != player.rh {
+		t.Fatal("player not registered")
+	}
+}
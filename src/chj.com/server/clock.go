@@ -0,0 +1,35 @@
+package main
+
+// 时钟-进程内所有计时都通过Clock获取, 测试时可以替换为虚拟时钟
+
+import (
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+	// d时间后向返回的channel发送当前时间
+	After(d time.Duration) <-chan time.Time
+	// d时间后在另外的goroutine中调用f
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// 定时器, Stop在定时器触发前停止时返回true
+type Timer interface {
+	Stop() bool
+}
+
+// 系统时钟
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
@@ -5,8 +5,8 @@ package main
 import (
 	"encoding/json"
 	"io/ioutil"
-
-	"chj.com/zwwserver/model"
+	"log"
+	"time"
 )
 
 type Config struct {
@@ -14,6 +14,8 @@ type Config struct {
 	apiRoot string
 	// 与服务器通信的密钥
 	apiSecret string
+	// 管理接口签名密钥, 空表示关闭管理接口
+	adminSecret string
 
 	// socket监听地址
 	socketHost string
@@ -23,10 +25,83 @@ type Config struct {
 	// 数据库配置
 	userCountPerDB int
 	mysqlConfig    map[string]string
+
+	// 玩家token校验方式: http/hmac/jwt/static/mysql(编译时加-tags mysql), 参数为配置文件auth节的内容
+	authType   string
+	authParams map[string]interface{}
+
+	// 各类进程的邮箱配置
+	mailbox map[string]*MailboxConfig
+
+	// 调用链追踪导出方式: 空(关闭)/stdout/file
+	tracingExporter string
+	tracingPath     string
+
+	// 审计日志文件, 空表示只保存在内存中
+	auditPath string
+
+	// 结算记录文件, 空表示只保存在内存中
+	outboxPath string
+	// 结算记录最多投递次数, 超过后转入死信列表
+	outboxMaxAttempts int
+
+	// 中奖策略, 设备名(default表示所有设备) -> 规则名 -> 参数, 为空表示由php服务器决定
+	payoutPolicies map[string]map[string]float64
+	// 中奖决定记录文件
+	payoutPath string
+
+	// 奖品库存文件, 空表示只保存在内存中
+	inventoryPath string
+
+	// 游戏回合记录文件, 空表示只保存在内存中
+	roundsPath string
+
+	// 设备注册表文件, 空表示只保存在内存中
+	devicesPath string
+	// 没有登记的设备用 "设备名:密钥" 登陆时自动登记, 只在升级时打开
+	devicesEnroll bool
+
+	// 玩家断线后保留进程等待重连的时间, 0表示断线立即登出
+	playerResumeGrace time.Duration
+	// 断线期间缓存的消息数, 超过时丢弃最早的消息
+	playerResumeBuffer int
+
+	// 玩家消息限流
+	flood *FloodConfig
+
+	// 聊天审核
+	chat *ChatConfig
+
+	// 排队玩家被邀请后确认开始游戏的时间
+	playConfirmTimeout time.Duration
+	// 每局游戏时间, 到时自动下爪
+	playRoundTime time.Duration
+	// 下爪后等待设备返回结果的时间, 超时强制重置设备
+	playResultGrace time.Duration
+	// 没抓中后为当前玩家保留设备的重试时间
+	playRetryWindow time.Duration
+	// 重试是否收费, 收费时只能通过startPlay接口重试, 否则玩家可以直接发送retry指令
+	playRetryCharged bool
 }
 
 func NewConfig(path string) *Config {
 	this := new(Config)
+	this.initMailboxDefault()
+	this.mysqlConfig = make(map[string]string)
+	this.authType = "http"
+	this.authParams = make(map[string]interface{})
+	this.initPlayDefault()
+	this.outboxPath = "outbox.log"
+	this.outboxMaxAttempts = 10
+	this.payoutPolicies = make(map[string]map[string]float64)
+	this.payoutPath = "payout.log"
+	this.inventoryPath = "inventory.json"
+	this.roundsPath = "rounds.log"
+	this.devicesPath = "devices.json"
+	this.playerResumeGrace = 30 * time.Second
+	this.playerResumeBuffer = 256
+	this.flood = defaultFloodConfig()
+	this.chat = defaultChatConfig()
 
 	// 读取配置文件
 	jsonstr, err := ioutil.ReadFile(path)
@@ -54,16 +129,277 @@ func NewConfig(path string) *Config {
 	this.socketHost = cfgobj["socketHost"].(string)
 	this.httpHost = cfgobj["httpHost"].(string)
 
-	// 数据库配置,直接写到model中
-	model.Config_userCountPerDB = int32(cfgobj["userCountPerDB"].(float64))
-	mysqlConfig := cfgobj["mysqlConfig"].(map[string]interface{})
+	// 数据库配置, 使用mysql校验token时写到model中
+	if userCountPerDB, ok := cfgobj["userCountPerDB"].(float64); ok {
+		this.userCountPerDB = int(userCountPerDB)
+	}
+	mysqlConfig, _ := cfgobj["mysqlConfig"].(map[string]interface{})
 	for key, value := range mysqlConfig {
-		model.Config_mysqlConfig[key] = value.(string)
+		this.mysqlConfig[key], _ = value.(string)
+	}
+
+	// 管理接口配置, 可选, 格式: {"secret": "..."}, 没有配置时不能调用管理接口
+	if adminConfig, ok := cfgobj["admin"].(map[string]interface{}); ok {
+		this.adminSecret, _ = adminConfig["secret"].(string)
+	}
+
+	// token校验配置, 可选, 缺省调用php服务器接口校验
+	// 格式: {"type": "jwt", "secret": "...", "issuer": "..."}, {"type": "http", "service": "user", "method": "checkToken"}
+	if authConfig, ok := cfgobj["auth"].(map[string]interface{}); ok {
+		if authType, ok := authConfig["type"].(string); ok {
+			this.authType = authType
+		}
+		this.authParams = authConfig
+	}
+
+	// 邮箱配置, 可选
+	if mailboxConfig, ok := cfgobj["mailbox"].(map[string]interface{}); ok {
+		this.parseMailboxConfig(mailboxConfig)
+	}
+
+	// 调用链追踪配置, 可选, 格式: {"exporter": "file", "path": "trace.json"}
+	if tracingConfig, ok := cfgobj["tracing"].(map[string]interface{}); ok {
+		this.tracingExporter, _ = tracingConfig["exporter"].(string)
+		this.tracingPath, _ = tracingConfig["path"].(string)
+	}
+
+	// 审计日志配置, 可选, 格式: {"path": "audit.log"}
+	if auditConfig, ok := cfgobj["audit"].(map[string]interface{}); ok {
+		this.auditPath, _ = auditConfig["path"].(string)
+	}
+
+	// 结算投递配置, 可选, 格式: {"path": "outbox.log", "maxAttempts": 10}
+	if outboxConfig, ok := cfgobj["outbox"].(map[string]interface{}); ok {
+		if path, ok := outboxConfig["path"].(string); ok {
+			this.outboxPath = path
+		}
+		if maxAttempts, ok := outboxConfig["maxAttempts"].(float64); ok {
+			this.outboxMaxAttempts = int(maxAttempts)
+		}
+	}
+
+	// 中奖策略配置, 可选, 格式: {"path": "payout.log", "policies": {"default": {"ratio": 0.05}, "dev1": {"guaranteeAfter": 50, "dailyCap": 10}}}
+	// dailyCap小于1时忽略, 不限制每日中奖次数
+	if payoutConfig, ok := cfgobj["payout"].(map[string]interface{}); ok {
+		this.parsePayoutConfig(payoutConfig)
+	}
+
+	// 奖品库存配置, 可选, 格式: {"path": "inventory.json"}
+	if inventoryConfig, ok := cfgobj["inventory"].(map[string]interface{}); ok {
+		if path, ok := inventoryConfig["path"].(string); ok {
+			this.inventoryPath = path
+		}
+	}
+
+	// 游戏回合记录配置, 可选, 格式: {"path": "rounds.log"}
+	if roundsConfig, ok := cfgobj["rounds"].(map[string]interface{}); ok {
+		if path, ok := roundsConfig["path"].(string); ok {
+			this.roundsPath = path
+		}
+	}
+
+	// 设备注册表配置, 可选, 格式: {"path": "devices.json", "enroll": false}
+	if devicesConfig, ok := cfgobj["devices"].(map[string]interface{}); ok {
+		if path, ok := devicesConfig["path"].(string); ok {
+			this.devicesPath = path
+		}
+		this.devicesEnroll, _ = devicesConfig["enroll"].(bool)
+	}
+
+	// 玩家断线重连配置, 可选, 格式: {"resumeGrace": 30000, "resumeBuffer": 256}, 时间单位为毫秒
+	if playerConfig, ok := cfgobj["player"].(map[string]interface{}); ok {
+		if resumeGrace, ok := playerConfig["resumeGrace"].(float64); ok {
+			this.playerResumeGrace = time.Duration(resumeGrace) * time.Millisecond
+		}
+		if resumeBuffer, ok := playerConfig["resumeBuffer"].(float64); ok {
+			this.playerResumeBuffer = int(resumeBuffer)
+		}
+	}
+
+	// 玩家消息限流配置, 可选, 时间单位为毫秒, 覆盖缺省配置中的同名项
+	// 格式: {"limits": {"broadcastMessage": {"rate": 1, "burst": 3}, "default": {"rate": 10, "burst": 20}},
+	//        "warnAfter": 3, "muteAfter": 10, "disconnectAfter": 30, "muteTime": 30000, "window": 10000,
+	//        "muteTypes": ["broadcastMessage"], "throttleTypes": ["controlGame"]}
+	if floodConfig, ok := cfgobj["rateLimit"].(map[string]interface{}); ok {
+		this.parseFloodConfig(floodConfig)
+	}
+
+	// 聊天审核配置, 可选, 时间单位为毫秒
+	// 格式: {"maxLength": 100, "bannedWords": ["..."], "mask": "*", "stripLinks": true, "slowMode": {"default": 0, "dev1": 3000}, "path": "chatmutes.json"}
+	if chatConfig, ok := cfgobj["chat"].(map[string]interface{}); ok {
+		this.parseChatConfig(chatConfig)
+	}
+
+	// 游戏流程配置, 可选, 时间单位为毫秒
+	// 格式: {"confirmTimeout": 10000, "roundTime": 30000, "resultGrace": 10000, "retryWindow": 10000, "retryCharged": true}
+	if playConfig, ok := cfgobj["play"].(map[string]interface{}); ok {
+		this.parsePlayConfig(playConfig)
 	}
 
 	return this
 }
 
+func (this *Config) parsePayoutConfig(cfgobj map[string]interface{}) {
+	if path, ok := cfgobj["path"].(string); ok {
+		this.payoutPath = path
+	}
+	policies, _ := cfgobj["policies"].(map[string]interface{})
+	for deviceName, value := range policies {
+		params := make(map[string]float64)
+		items, _ := value.(map[string]interface{})
+		for name, param := range items {
+			params[name], _ = param.(float64)
+		}
+		// 每日上限为0会让设备永远不中奖, 按不限制处理
+		if limit, ok := params["dailyCap"]; ok && limit < 1 {
+			log.Println("中奖策略配置错误: ", deviceName, "dailyCap需要大于0, 忽略每日上限")
+			delete(params, "dailyCap")
+		}
+		this.payoutPolicies[deviceName] = params
+	}
+}
+
+func (this *Config) parseFloodConfig(cfgobj map[string]interface{}) {
+	limits, _ := cfgobj["limits"].(map[string]interface{})
+	for msgType, value := range limits {
+		item, _ := value.(map[string]interface{})
+		limit := new(RateLimit)
+		limit.Rate, _ = item["rate"].(float64)
+		limit.Burst, _ = item["burst"].(float64)
+		if limit.Burst < 1 {
+			limit.Burst = 1
+		}
+		this.flood.Limits[msgType] = limit
+	}
+	if warnAfter, ok := cfgobj["warnAfter"].(float64); ok {
+		this.flood.WarnAfter = int(warnAfter)
+	}
+	if muteAfter, ok := cfgobj["muteAfter"].(float64); ok {
+		this.flood.MuteAfter = int(muteAfter)
+	}
+	if disconnectAfter, ok := cfgobj["disconnectAfter"].(float64); ok {
+		this.flood.DisconnectAfter = int(disconnectAfter)
+	}
+	if muteTime, ok := cfgobj["muteTime"].(float64); ok {
+		this.flood.MuteTime = time.Duration(muteTime) * time.Millisecond
+	}
+	if window, ok := cfgobj["window"].(float64); ok {
+		this.flood.Window = time.Duration(window) * time.Millisecond
+	}
+	if muteTypes, ok := cfgobj["muteTypes"].([]interface{}); ok {
+		this.flood.MuteTypes = parseStringSet(muteTypes)
+	}
+	if throttleTypes, ok := cfgobj["throttleTypes"].([]interface{}); ok {
+		this.flood.ThrottleTypes = parseStringSet(throttleTypes)
+	}
+}
+
+func parseStringSet(values []interface{}) map[string]bool {
+	ret := make(map[string]bool)
+	for _, value := range values {
+		if value, ok := value.(string); ok {
+			ret[value] = true
+		}
+	}
+	return ret
+}
+
+func (this *Config) parseChatConfig(cfgobj map[string]interface{}) {
+	if maxLength, ok := cfgobj["maxLength"].(float64); ok {
+		this.chat.MaxLength = int(maxLength)
+	}
+	bannedWords, _ := cfgobj["bannedWords"].([]interface{})
+	for _, word := range bannedWords {
+		if word, ok := word.(string); ok {
+			this.chat.BannedWords = append(this.chat.BannedWords, word)
+		}
+	}
+	if mask, ok := cfgobj["mask"].(string); ok && mask != "" {
+		this.chat.Mask = mask
+	}
+	if stripLinks, ok := cfgobj["stripLinks"].(bool); ok {
+		this.chat.StripLinks = stripLinks
+	}
+	slowMode, _ := cfgobj["slowMode"].(map[string]interface{})
+	for deviceName, value := range slowMode {
+		interval, _ := value.(float64)
+		this.chat.SlowMode[deviceName] = time.Duration(interval) * time.Millisecond
+	}
+	if path, ok := cfgobj["path"].(string); ok {
+		this.chat.Path = path
+	}
+}
+
+// 缺省游戏流程配置
+func (this *Config) initPlayDefault() {
+	this.playConfirmTimeout = 10 * time.Second
+	this.playRoundTime = 30 * time.Second
+	this.playResultGrace = 10 * time.Second
+	this.playRetryWindow = 10 * time.Second
+	this.playRetryCharged = true
+}
+
+func (this *Config) parsePlayConfig(cfgobj map[string]interface{}) {
+	if confirmTimeout, ok := cfgobj["confirmTimeout"].(float64); ok {
+		this.playConfirmTimeout = time.Duration(confirmTimeout) * time.Millisecond
+	}
+	if roundTime, ok := cfgobj["roundTime"].(float64); ok {
+		this.playRoundTime = time.Duration(roundTime) * time.Millisecond
+	}
+	if resultGrace, ok := cfgobj["resultGrace"].(float64); ok {
+		this.playResultGrace = time.Duration(resultGrace) * time.Millisecond
+	}
+	if retryWindow, ok := cfgobj["retryWindow"].(float64); ok {
+		this.playRetryWindow = time.Duration(retryWindow) * time.Millisecond
+	}
+	if retryCharged, ok := cfgobj["retryCharged"].(bool); ok {
+		this.playRetryCharged = retryCharged
+	}
+}
+
+// 缺省邮箱配置, 玩家连接消息堆积时直接断开, 避免拖慢game的广播
+func (this *Config) initMailboxDefault() {
+	this.mailbox = make(map[string]*MailboxConfig)
+	this.mailbox["session"] = &MailboxConfig{Size: 512, Policy: OverflowBlock, BlockTimeout: 500 * time.Millisecond}
+	this.mailbox["game"] = &MailboxConfig{Size: 512, Policy: OverflowBlock, BlockTimeout: 500 * time.Millisecond}
+	this.mailbox["player"] = &MailboxConfig{Size: 256, Policy: OverflowDisconnect}
+}
+
+// 读取邮箱配置, 格式: {"player": {"size": 256, "policy": "disconnect", "blockTimeout": 500}}
+func (this *Config) parseMailboxConfig(cfgobj map[string]interface{}) {
+	for kind, value := range cfgobj {
+		item := value.(map[string]interface{})
+		mailbox := *defaultMailboxConfig
+		if existing, ok := this.mailbox[kind]; ok {
+			mailbox = *existing
+		}
+
+		if size, ok := item["size"].(float64); ok {
+			mailbox.Size = int(size)
+		}
+		if name, ok := item["policy"].(string); ok {
+			policy, err := ParseOverflowPolicy(name)
+			if err != nil {
+				log.Println("邮箱配置错误: ", kind, err)
+			} else {
+				mailbox.Policy = policy
+			}
+		}
+		if blockTimeout, ok := item["blockTimeout"].(float64); ok {
+			mailbox.BlockTimeout = time.Duration(blockTimeout) * time.Millisecond
+		}
+		this.mailbox[kind] = &mailbox
+	}
+}
+
+// 获取指定类型进程的邮箱配置
+func (this *Config) mailboxConfig(kind string) *MailboxConfig {
+	if mailbox, ok := this.mailbox[kind]; ok {
+		return mailbox
+	}
+	return defaultMailboxConfig
+}
+
 // 初始化为缺省值
 func (this *Config) initWithDefault() {
 	this.apiRoot = "http://192.168.55.101:30083/api/1.1.0"
@@ -0,0 +1,80 @@
+package main
+
+// 客户端连接-玩家和game的消息收发通道
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"golang.org/x/net/websocket"
+)
+
+type Conn interface {
+	// 发送一条文本消息
+	Send(message string) error
+	Close() error
+}
+
+// websocket连接
+type wsConn struct {
+	ws *websocket.Conn
+}
+
+func NewWsConn(ws *websocket.Conn) Conn {
+	return &wsConn{ws}
+}
+
+func (this *wsConn) Send(message string) error {
+	return websocket.Message.Send(this.ws, message)
+}
+
+func (this *wsConn) Close() error {
+	return this.ws.Close()
+}
+
+// 客户端和设备发来的消息, 格式: {"type": "消息类型", "data": 数据}
+type clientMessage struct {
+	Type string
+	Data interface{}
+}
+
+// 解析消息, 格式错误时返回ErrBadParams, 不能让客户端的数据导致进程崩溃
+func parseClientMessage(message string) (*clientMessage, error) {
+	var msgObj map[string]interface{}
+	if err := json.Unmarshal([]byte(message), &msgObj); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadParams, err)
+	}
+	msgType, ok := msgObj["type"].(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: message type %T", ErrBadParams, msgObj["type"])
+	}
+	return &clientMessage{msgType, msgObj["data"]}, nil
+}
+
+func (this *clientMessage) String() (string, error) {
+	data, ok := this.Data.(string)
+	if !ok {
+		return "", this.badData()
+	}
+	return data, nil
+}
+
+func (this *clientMessage) Object() (map[string]interface{}, error) {
+	data, ok := this.Data.(map[string]interface{})
+	if !ok {
+		return nil, this.badData()
+	}
+	return data, nil
+}
+
+func (this *clientMessage) List() ([]interface{}, error) {
+	data, ok := this.Data.([]interface{})
+	if !ok {
+		return nil, this.badData()
+	}
+	return data, nil
+}
+
+func (this *clientMessage) badData() error {
+	return fmt.Errorf("%w: %s data %T", ErrBadParams, this.Type, this.Data)
+}
@@ -0,0 +1,64 @@
+package main
+
+// 请求上下文-在进程调用链中传递请求id, 玩家id, 设备名, 收到请求的时间
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+type ctxKey int
+
+const (
+	ctxKeyRequestId ctxKey = iota
+	ctxKeyUserId
+	ctxKeyDeviceName
+	ctxKeyReceiveTime
+)
+
+var requestSeq int64
+
+// 生成新的请求id
+func newRequestId() string {
+	return fmt.Sprintf("%x-%d", time.Now().Unix(), atomic.AddInt64(&requestSeq, 1))
+}
+
+func WithRequestId(ctx context.Context, requestId string) context.Context {
+	return context.WithValue(ctx, ctxKeyRequestId, requestId)
+}
+
+func RequestIdFrom(ctx context.Context) string {
+	requestId, _ := ctx.Value(ctxKeyRequestId).(string)
+	return requestId
+}
+
+func WithUserId(ctx context.Context, userId int) context.Context {
+	return context.WithValue(ctx, ctxKeyUserId, userId)
+}
+
+func UserIdFrom(ctx context.Context) int {
+	userId, _ := ctx.Value(ctxKeyUserId).(int)
+	return userId
+}
+
+func WithDeviceName(ctx context.Context, deviceName string) context.Context {
+	return context.WithValue(ctx, ctxKeyDeviceName, deviceName)
+}
+
+func DeviceNameFrom(ctx context.Context) string {
+	deviceName, _ := ctx.Value(ctxKeyDeviceName).(string)
+	return deviceName
+}
+
+// 服务器从连接收到消息的时间, 用于记录指令在进程间的延迟
+func WithReceiveTime(ctx context.Context, receiveTime time.Time) context.Context {
+	return context.WithValue(ctx, ctxKeyReceiveTime, receiveTime)
+}
+
+// 收到消息的时间, 没有时返回零值
+func ReceiveTimeFrom(ctx context.Context) time.Time {
+	receiveTime, _ := ctx.Value(ctxKeyReceiveTime).(time.Time)
+	return receiveTime
+}
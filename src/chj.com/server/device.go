@@ -0,0 +1,168 @@
+package main
+
+// 设备注册表-记录每台设备的登陆密钥和是否启用, 每次变化重写注册表文件
+// 设备登陆方式:
+// 密钥: 发送 "设备名:密钥"
+// 挑战应答: 发送 "设备名", 服务器返回随机串nonce, 设备再发送 "设备名:nonce:签名", 签名为hex(HMAC-SHA256(密钥, "设备名:nonce"))
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+var (
+	ErrDeviceUnknown   = errors.New("unknown device")
+	ErrDeviceDisabled  = errors.New("device disabled")
+	ErrDeviceSecret    = errors.New("invalid device secret")
+	ErrDeviceSignature = errors.New("invalid device signature")
+)
+
+// 设备登记信息
+type DeviceRecord struct {
+	Secret  string `json:"secret"`
+	Enabled bool   `json:"enabled"`
+}
+
+type DeviceRegistry struct {
+	lock sync.Mutex
+	// 注册表文件, 空表示只保存在内存中
+	path string
+	// 设备名 -> 登记信息, 没有登记的设备不能登陆
+	devices map[string]*DeviceRecord
+}
+
+// 打开注册表文件, 文件不存在时为空注册表
+func OpenDeviceRegistry(path string) (*DeviceRegistry, error) {
+	this := new(DeviceRegistry)
+	this.path = path
+	this.devices = make(map[string]*DeviceRecord)
+	if path == "" {
+		return this, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return this, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &this.devices); err != nil {
+		return nil, err
+	}
+	return this, nil
+}
+
+// 设备登记信息副本, 没有登记时返回nil
+func (this *DeviceRegistry) Get(deviceName string) *DeviceRecord {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	record := this.devices[deviceName]
+	if record == nil {
+		return nil
+	}
+	copied := *record
+	return &copied
+}
+
+// 登记设备, record为nil时删除设备
+func (this *DeviceRegistry) Set(deviceName string, record *DeviceRecord) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if record == nil {
+		delete(this.devices, deviceName)
+	} else {
+		copied := *record
+		this.devices[deviceName] = &copied
+	}
+	return this.save()
+}
+
+// 校验设备密钥
+func (this *DeviceRegistry) CheckSecret(deviceName string, secret string) error {
+	record, err := this.enabled(deviceName)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(record.Secret)) != 1 {
+		return ErrDeviceSecret
+	}
+	return nil
+}
+
+// 首次登陆时登记设备, 用于从不校验设备的旧版本升级, 已登记的设备按密钥校验
+// 返回是否新登记
+func (this *DeviceRegistry) Enroll(deviceName string, secret string) (bool, error) {
+	if secret == "" {
+		return false, ErrDeviceSecret
+	}
+
+	this.lock.Lock()
+	if _, ok := this.devices[deviceName]; !ok {
+		this.devices[deviceName] = &DeviceRecord{Secret: secret, Enabled: true}
+		err := this.save()
+		this.lock.Unlock()
+		return true, err
+	}
+	this.lock.Unlock()
+	return false, this.CheckSecret(deviceName, secret)
+}
+
+// 校验挑战应答的签名, nonce由调用者保证是自己发出且只使用一次
+func (this *DeviceRegistry) CheckChallenge(deviceName string, nonce string, signature string) error {
+	record, err := this.enabled(deviceName)
+	if err != nil {
+		return err
+	}
+	expected := SignDeviceChallenge(record.Secret, deviceName, nonce)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return ErrDeviceSignature
+	}
+	return nil
+}
+
+// 检查设备是否登记并启用
+func (this *DeviceRegistry) CheckEnabled(deviceName string) error {
+	_, err := this.enabled(deviceName)
+	return err
+}
+
+func (this *DeviceRegistry) enabled(deviceName string) (*DeviceRecord, error) {
+	record := this.Get(deviceName)
+	if record == nil {
+		return nil, ErrDeviceUnknown
+	}
+	if !record.Enabled || record.Secret == "" {
+		return nil, ErrDeviceDisabled
+	}
+	return record, nil
+}
+
+// 挑战应答的签名, 设备端使用相同的算法
+func SignDeviceChallenge(secret string, deviceName string, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(deviceName + ":" + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// 重写注册表文件, 需要持有锁, 文件中有密钥, 只允许自己读写
+func (this *DeviceRegistry) save() error {
+	if this.path == "" {
+		return nil
+	}
+	data, _ := json.Marshal(this.devices)
+	tmpPath := this.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, this.path)
+}
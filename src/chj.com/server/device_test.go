@@ -0,0 +1,41 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestDeviceRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.json")
+	devices, err := OpenDeviceRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := devices.CheckSecret("dev1", "secret"); err != ErrDeviceUnknown {
+		t.Fatalf("unknown device err = %v", err)
+	}
+	devices.Set("dev1", &DeviceRecord{Secret: "secret", Enabled: true})
+	if err := devices.CheckSecret("dev1", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := devices.CheckSecret("dev1", "wrong"); err != ErrDeviceSecret {
+		t.Fatalf("wrong secret err = %v", err)
+	}
+	if err := devices.CheckChallenge("dev1", "n1", SignDeviceChallenge("secret", "dev1", "n1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := devices.CheckChallenge("dev1", "n1", SignDeviceChallenge("secret", "dev2", "n1")); err != ErrDeviceSignature {
+		t.Fatalf("wrong signature err = %v", err)
+	}
+
+	// 重启后从文件恢复
+	devices.Set("dev1", &DeviceRecord{Secret: "secret", Enabled: false})
+	devices, err = OpenDeviceRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := devices.CheckSecret("dev1", "secret"); err != ErrDeviceDisabled {
+		t.Fatalf("disabled device err = %v", err)
+	}
+}
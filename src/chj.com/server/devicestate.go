@@ -0,0 +1,147 @@
+package main
+
+// 设备状态机-game的状态只能按允许的路径变化, 每次变化产生一个状态变化事件
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// 非法的状态变化
+var ErrIllegalTransition = errors.New("illegal state transition")
+
+type DeviceState int
+
+const (
+	StateOffline     DeviceState = iota // 设备未连接
+	StateReady                          // 空闲
+	StateReserved                       // 为排队或重试的玩家保留, 等待确认
+	StatePlaying                        // 游戏中
+	StateCatching                       // 已下爪, 等待结果
+	StateSettling                       // 已返回结果, 结算中
+	StateMaintenance                    // 维护中
+	StateError                          // 故障
+	StateOutOfStock                     // 奖品已抓完, 补货后恢复
+	deviceStateCount
+)
+
+var deviceStateNames = [deviceStateCount]string{
+	"offline", "ready", "reserved", "playing", "catching", "settling", "maintenance", "error", "outOfStock",
+}
+
+func (this DeviceState) String() string {
+	if this >= 0 && this < deviceStateCount {
+		return deviceStateNames[this]
+	}
+	return fmt.Sprintf("state(%d)", int(this))
+}
+
+// 是否广播给所有玩家, 回合内的状态只发送给当前玩家
+func (this DeviceState) Public() bool {
+	return this != StateCatching && this != StateSettling
+}
+
+func ParseDeviceState(name string) (DeviceState, error) {
+	for i, stateName := range deviceStateNames {
+		if stateName == name {
+			return DeviceState(i), nil
+		}
+	}
+	return StateOffline, fmt.Errorf("unknown device state: %s", name)
+}
+
+// 允许的状态变化, 任何状态都可以变为故障或离线
+var deviceTransitions = map[DeviceState][]DeviceState{
+	StateOffline:     {StateReady, StateMaintenance},
+	StateReady:       {StateReserved, StatePlaying, StateMaintenance, StateOutOfStock},
+	StateReserved:    {StateReady, StatePlaying, StateMaintenance, StateOutOfStock},
+	StatePlaying:     {StateCatching, StateSettling, StateReady},
+	StateCatching:    {StateSettling, StateReady},
+	StateSettling:    {StatePlaying, StateReserved, StateReady},
+	StateMaintenance: {StateReady},
+	StateError:       {StateReady, StateMaintenance},
+	StateOutOfStock:  {StateReady, StateMaintenance},
+}
+
+func canTransition(from DeviceState, to DeviceState) bool {
+	if to == StateError || to == StateOffline {
+		return true
+	}
+	for _, state := range deviceTransitions[from] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
+// 状态变化事件
+type StateChangeEvent struct {
+	DeviceName string
+	From       DeviceState
+	To         DeviceState
+	// 变化后的当前玩家
+	PlayerId int
+	// 变化原因, 用于日志
+	Reason string
+	Time   time.Time
+}
+
+// 状态变化监听者, 在game进程中同步调用
+type StateListener func(ctx context.Context, event *StateChangeEvent)
+
+// 设备状态机, 只在所属的game进程中访问
+type DeviceStateMachine struct {
+	deviceName string
+	clock      Clock
+	state      DeviceState
+	listeners  []StateListener
+}
+
+func NewDeviceStateMachine(clock Clock) *DeviceStateMachine {
+	this := new(DeviceStateMachine)
+	this.clock = clock
+	this.state = StateOffline
+	this.listeners = make([]StateListener, 0)
+	return this
+}
+
+func (this *DeviceStateMachine) State() DeviceState {
+	return this.state
+}
+
+func (this *DeviceStateMachine) setDeviceName(deviceName string) {
+	this.deviceName = deviceName
+}
+
+// 订阅状态变化事件
+func (this *DeviceStateMachine) Subscribe(listener StateListener) {
+	this.listeners = append(this.listeners, listener)
+}
+
+// 变化到新状态并通知监听者, 状态相同时什么也不做, 不允许的变化返回ErrIllegalTransition
+func (this *DeviceStateMachine) Transition(ctx context.Context, to DeviceState, playerId int, reason string) error {
+	from := this.state
+	if from == to {
+		return nil
+	}
+	if !canTransition(from, to) {
+		return fmt.Errorf("%w: %s -> %s (%s)", ErrIllegalTransition, from, to, reason)
+	}
+
+	this.state = to
+	event := &StateChangeEvent{
+		DeviceName: this.deviceName,
+		From:       from,
+		To:         to,
+		PlayerId:   playerId,
+		Reason:     reason,
+		Time:       this.clock.Now(),
+	}
+	for _, listener := range this.listeners {
+		listener(ctx, event)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestDeviceStateMachine(t *testing.T) {
+	sm := NewDeviceStateMachine(NewFakeClock())
+	events := make([]*StateChangeEvent, 0)
+	sm.Subscribe(func(ctx context.Context, event *StateChangeEvent) {
+		events = append(events, event)
+	})
+
+	steps := []struct {
+		to    DeviceState
+		legal bool
+	}{
+		{StatePlaying, false},
+		{StateReady, true},
+		{StateReady, true},
+		{StateCatching, false},
+		{StatePlaying, true},
+		{StateCatching, true},
+		{StateSettling, true},
+		{StatePlaying, true},
+		{StateMaintenance, false},
+		{StateError, true},
+		{StateOffline, true},
+	}
+	for _, step := range steps {
+		err := sm.Transition(context.Background(), step.to, 7, "test")
+		if step.legal && err != nil {
+			t.Fatalf("%s: %v", step.to, err)
+		}
+		if !step.legal && !errors.Is(err, ErrIllegalTransition) {
+			t.Fatalf("%s: err = %v, want ErrIllegalTransition", step.to, err)
+		}
+	}
+
+	// 相同状态不产生事件
+	if len(events) != 7 {
+		t.Fatalf("events = %d", len(events))
+	}
+	if events[0].From != StateOffline || events[0].To != StateReady || events[0].PlayerId != 7 {
+		t.Fatalf("event = %+v", events[0])
+	}
+}
+
+func TestParseDeviceState(t *testing.T) {
+	for state := StateOffline; state < deviceStateCount; state++ {
+		parsed, err := ParseDeviceState(state.String())
+		if err != nil || parsed != state {
+			t.Fatalf("%s: %v, %v", state, parsed, err)
+		}
+	}
+	if _, err := ParseDeviceState("flying"); err == nil {
+		t.Fatal("unknown state parsed")
+	}
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"strings"
+	"time"
 )
 
 // 全局唯一单例
@@ -19,46 +21,241 @@ type Facade struct {
 
 	// 会话管理器
 	sessionRH *RoutineHandle
+
+	// 进程注册表
+	registry *Registry
+
+	// 时钟
+	clock Clock
+
+	// 审计日志
+	audit *AuditLog
+
+	// 结算记录和投递进程
+	settlements *SettlementStore
+	outboxRH    *RoutineHandle
+
+	// 中奖策略
+	payout *PayoutEngine
+
+	// 奖品库存
+	inventory *PrizeInventory
+
+	// 玩家token校验
+	auth Authenticator
+
+	// 设备注册表
+	devices *DeviceRegistry
+
+	// 聊天审核
+	chat *ChatModerator
+
+	// 游戏回合记录
+	rounds *RoundStore
+
+	// 进程监督者
+	rootSup    *Supervisor
+	sessionSup *Supervisor
+	gameSup    *Supervisor
+	playerSup  *Supervisor
 }
 
 func NewFacade() *Facade {
+	this := newFacade(NewConfig("config.json"), realClock{}, false)
+
+	// 启动服务器
+	NewServer(this)
+
+	return this
+}
+
+// 创建全局对象和会话管理器, manual为true时所有进程以手动模式运行(测试用)
+func newFacade(config *Config, clock Clock, manual bool) *Facade {
 	this := new(Facade)
 
+	// 时钟
+	this.clock = clock
+
 	// 协议调用器
-	this.protocol = NewProtocol()
+	this.protocol = NewProtocol(clock)
 
 	// 全局配置文件
-	this.config = NewConfig("config.json")
+	this.config = config
+
+	// 进程监督者
+	this.rootSup = NewSupervisor("RootSup", nil, 3, time.Minute, 0)
+	this.sessionSup = NewSupervisor("SessionSup", this.rootSup, 5, time.Minute, time.Second*3)
+	this.gameSup = NewSupervisor("GameSup", this.rootSup, 20, time.Minute, time.Second*3)
+	this.playerSup = NewSupervisor("PlayerSup", this.rootSup, 50, time.Minute, time.Second*3)
+	for _, sup := range []*Supervisor{this.rootSup, this.sessionSup, this.gameSup, this.playerSup} {
+		sup.manual = manual
+		sup.clock = clock
+	}
+
+	// 调用链追踪
+	this.initTracer()
+
+	// 审计日志
+	this.initAudit()
+
+	// 进程注册表
+	this.registry = NewRegistry()
 
 	// 会话管理器
 	this.sessionRH = NewSession(this)
 
-	// 启动服务器
-	NewServer(this)
+	// 结算投递
+	this.initOutbox()
+
+	// 中奖策略
+	this.initPayout()
+
+	// 奖品库存
+	this.initInventory()
+
+	// 游戏回合记录
+	this.initRounds()
+
+	// 玩家token校验
+	this.initAuth()
+
+	// 设备注册表
+	this.initDevices()
+
+	// 聊天审核
+	this.initChat()
 
 	return this
 }
 
-// 调用api接口
-func (this *Facade) callApi(service string, method string, params interface{}) interface{} {
+// 打开结算记录并启动投递进程, 文件打开失败时只保存在内存中
+func (this *Facade) initOutbox() {
+	settlements, err := OpenSettlementStore(this.clock, this.config.outboxPath)
+	if err != nil {
+		log.Println("打开结算记录文件失败: ", err)
+		settlements, _ = OpenSettlementStore(this.clock, "")
+	}
+	this.settlements = settlements
+	this.outboxRH = NewOutbox(this)
+}
+
+// 根据配置开启调用链追踪
+func (this *Facade) initTracer() {
+	var exporter SpanExporter
+	switch this.config.tracingExporter {
+	case "":
+		return
+	case "stdout":
+		exporter = NewStdoutExporter()
+	case "file":
+		var err error
+		if exporter, err = NewFileExporter(this.config.tracingPath); err != nil {
+			log.Println("创建追踪文件失败: ", err)
+			return
+		}
+	default:
+		log.Println("未知的追踪导出方式: ", this.config.tracingExporter)
+		return
+	}
+	SetTracer(NewTracer(exporter))
+}
+
+// 根据配置创建审计日志, 文件打开失败时只保存在内存中
+func (this *Facade) initAudit() {
+	if this.config.auditPath != "" {
+		audit, err := NewFileAuditLog(this.clock, this.config.auditPath)
+		if err == nil {
+			this.audit = audit
+			return
+		}
+		log.Println("创建审计日志文件失败: ", err)
+	}
+	this.audit = NewAuditLog(this.clock, nil)
+}
+
+// 根据配置创建中奖策略, 配置错误时关闭服务器决定, 由php服务器决定是否抓中
+func (this *Facade) initPayout() {
+	payout, err := NewPayoutEngine(this.clock, this.config.payoutPolicies, this.config.payoutPath)
+	if err != nil {
+		log.Println("创建中奖策略失败: ", err)
+		payout, _ = NewPayoutEngine(this.clock, nil, "")
+	}
+	this.payout = payout
+}
+
+// 打开奖品库存, 文件读取失败时只保存在内存中
+func (this *Facade) initInventory() {
+	inventory, err := OpenPrizeInventory(this.config.inventoryPath)
+	if err != nil {
+		log.Println("打开奖品库存文件失败: ", err)
+		inventory, _ = OpenPrizeInventory("")
+	}
+	this.inventory = inventory
+}
+
+// 打开游戏回合记录, 文件打开失败时只保存在内存中
+func (this *Facade) initRounds() {
+	rounds, err := OpenRoundStore(this.config.roundsPath)
+	if err != nil {
+		log.Println("打开游戏回合记录文件失败: ", err)
+		rounds, _ = OpenRoundStore("")
+	}
+	this.rounds = rounds
+}
+
+// 按配置创建token校验器, 创建失败时无法登陆, 直接退出
+func (this *Facade) initAuth() {
+	auth, err := NewAuthenticator(this, this.config.authType, this.config.authParams)
+	if err != nil {
+		log.Fatalln("创建token校验失败: ", err)
+	}
+	this.auth = auth
+}
+
+// 打开设备注册表, 文件读取失败时为空注册表, 所有设备都不能登陆
+func (this *Facade) initDevices() {
+	devices, err := OpenDeviceRegistry(this.config.devicesPath)
+	if err != nil {
+		log.Println("打开设备注册表文件失败: ", err)
+		devices, _ = OpenDeviceRegistry("")
+	}
+	this.devices = devices
+}
+
+// 创建聊天审核, 禁言记录文件读取失败时只保存在内存中
+func (this *Facade) initChat() {
+	chat, err := NewChatModerator(this.config.chat)
+	if err != nil {
+		log.Println("打开禁言记录文件失败: ", err)
+		config := *this.config.chat
+		config.Path = ""
+		chat, _ = NewChatModerator(&config)
+	}
+	this.chat = chat
+}
+
+// 调用api接口的http客户端, 避免php服务器无响应时一直等待
+var apiClient = &http.Client{Timeout: 10 * time.Second}
+
+// 调用api接口, 返回data字段, 网络错误或php服务器返回error时返回错误
+func (this *Facade) callApi(service string, method string, params interface{}) (interface{}, error) {
 	url := this.config.apiRoot + "/" + service + "/" + method
 	paramjson0, _ := json.Marshal(params)
 	paramjson := string(paramjson0)
 
 	log.Println("callApi-request: ", service, ".", method, "(", paramjson, ")")
 
-	r, err := http.Post(url, "application/json", strings.NewReader(string(paramjson)))
-	defer r.Body.Close()
+	r, err := apiClient.Post(url, "application/json", strings.NewReader(string(paramjson)))
 	if err != nil {
 		log.Println("callApi error: ", err)
-		return nil
+		return nil, err
 	}
+	defer r.Body.Close()
 
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		log.Println("callApi error: ", err)
-		return nil
-
+		return nil, err
 	}
 
 	log.Println("callApi-response: ", string(body))
@@ -67,14 +264,14 @@ func (this *Facade) callApi(service string, method string, params interface{}) i
 	err = json.Unmarshal(body, &robj)
 	if err != nil {
 		log.Println("callApi error: ", err)
-		return nil
+		return nil, err
 	}
 
-	if err, ok := robj["error"]; ok {
-		log.Println("callApi error: ", err)
-		return nil
+	if apiErr, ok := robj["error"]; ok {
+		log.Println("callApi error: ", apiErr)
+		return nil, fmt.Errorf("%s.%s: %v", service, method, apiErr)
 	}
 
 	data, _ := robj["data"]
-	return data
+	return data, nil
 }
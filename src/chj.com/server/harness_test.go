@@ -0,0 +1,331 @@
+package main
+
+// 测试工具-虚拟时钟, 假连接和手动推进的进程环境
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+//////////////////////////////////////////////////////////
+// 虚拟时钟, 只有调用Advance时才前进
+
+type fakeTimer struct {
+	clock *FakeClock
+	at    time.Time
+	c     chan time.Time
+	f     func()
+}
+
+func (this *fakeTimer) Stop() bool {
+	this.clock.lock.Lock()
+	defer this.clock.lock.Unlock()
+	for i, timer := range this.clock.timers {
+		if timer == this {
+			this.clock.timers = append(this.clock.timers[:i], this.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type FakeClock struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []*fakeTimer
+}
+
+func NewFakeClock() *FakeClock {
+	this := new(FakeClock)
+	this.cond = sync.NewCond(&this.lock)
+	this.now = time.Date(2018, 1, 1, 0, 0, 0, 0, time.Local)
+	return this
+}
+
+func (this *FakeClock) Now() time.Time {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.now
+}
+
+func (this *FakeClock) After(d time.Duration) <-chan time.Time {
+	timer := this.addTimer(d, nil)
+	return timer.c
+}
+
+// 定时器在Advance中同步触发, 测试不需要等待其他goroutine
+func (this *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	return this.addTimer(d, f)
+}
+
+func (this *FakeClock) addTimer(d time.Duration, f func()) *fakeTimer {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	timer := &fakeTimer{clock: this, at: this.now.Add(d), c: make(chan time.Time, 1), f: f}
+	if d <= 0 && f == nil {
+		timer.c <- this.now
+		return timer
+	}
+	this.timers = append(this.timers, timer)
+	this.cond.Broadcast()
+	return timer
+}
+
+// 时钟前进d, 按到期顺序触发所有到期的定时器
+func (this *FakeClock) Advance(d time.Duration) {
+	this.lock.Lock()
+	this.now = this.now.Add(d)
+	now := this.now
+
+	sort.SliceStable(this.timers, func(i, j int) bool {
+		return this.timers[i].at.Before(this.timers[j].at)
+	})
+	fired := make([]*fakeTimer, 0)
+	timers := make([]*fakeTimer, 0, len(this.timers))
+	for _, timer := range this.timers {
+		if timer.at.After(now) {
+			timers = append(timers, timer)
+		} else {
+			fired = append(fired, timer)
+		}
+	}
+	this.timers = timers
+	this.lock.Unlock()
+
+	for _, timer := range fired {
+		if timer.f != nil {
+			timer.f()
+		} else {
+			timer.c <- now
+		}
+	}
+}
+
+// 等待至少有n个未触发的定时器, 用于和其他goroutine同步
+func (this *FakeClock) BlockUntil(n int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for len(this.timers) < n {
+		this.cond.Wait()
+	}
+}
+
+//////////////////////////////////////////////////////////
+// 假连接, 记录发送给客户端的消息
+
+type FakeConn struct {
+	lock     sync.Mutex
+	messages []string
+	closed   bool
+}
+
+func (this *FakeConn) Send(message string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.messages = append(this.messages, message)
+	return nil
+}
+
+func (this *FakeConn) Close() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.closed = true
+	return nil
+}
+
+func (this *FakeConn) Closed() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.closed
+}
+
+// 按类型过滤已发送的消息, 返回各消息的data字段
+func (this *FakeConn) Messages(msgType string) []interface{} {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	ret := make([]interface{}, 0)
+	for _, message := range this.messages {
+		var msgObj map[string]interface{}
+		if err := json.Unmarshal([]byte(message), &msgObj); err != nil {
+			continue
+		}
+		if msgObj["type"] == msgType {
+			ret = append(ret, msgObj["data"])
+		}
+	}
+	return ret
+}
+
+// 指定类型的最后一条消息的data字段, 没有时返回nil
+func (this *FakeConn) Last(msgType string) interface{} {
+	messages := this.Messages(msgType)
+	if len(messages) == 0 {
+		return nil
+	}
+	return messages[len(messages)-1]
+}
+
+//////////////////////////////////////////////////////////
+// 测试环境, 所有进程以手动模式运行, 异步消息由Step/Settle推进
+
+type Harness struct {
+	t      *testing.T
+	clock  *FakeClock
+	facade *Facade
+
+	// 模拟php服务器的api接口, 记录调用的方法名, apiFail为true时返回错误
+	api      *httptest.Server
+	apiLock  sync.Mutex
+	apiCalls []string
+	apiFail  bool
+
+	handles []*RoutineHandle
+}
+
+func NewHarness(t *testing.T) *Harness {
+	this := new(Harness)
+	this.t = t
+	this.clock = NewFakeClock()
+	this.api = httptest.NewServer(http.HandlerFunc(this.serveApi))
+	t.Cleanup(this.api.Close)
+
+	// 没有配置文件, 使用缺省配置
+	config := NewConfig("")
+	config.apiRoot = this.api.URL
+	config.outboxPath = ""
+	config.payoutPath = ""
+	config.inventoryPath = ""
+	config.roundsPath = ""
+	config.devicesPath = ""
+	config.chat.Path = ""
+	config.authType = "static"
+	this.facade = newFacade(config, this.clock, true)
+	// 测试设备用 "dev1:token" 登陆
+	this.facade.devices.Set("dev1", &DeviceRecord{Secret: "token", Enabled: true})
+	this.handles = append(this.handles, this.facade.sessionRH, this.facade.outboxRH)
+	return this
+}
+
+// 创建一个game进程, 返回进程handle和设备连接
+func (this *Harness) NewGame() (*RoutineHandle, *FakeConn) {
+	conn := new(FakeConn)
+	rh := NewGame(this.facade, conn)
+	this.handles = append(this.handles, rh)
+	return rh, conn
+}
+
+// 创建一个player进程, 返回进程handle和客户端连接
+func (this *Harness) NewPlayer() (*RoutineHandle, *FakeConn) {
+	conn := new(FakeConn)
+	rh := NewPlayer(this.facade, conn)
+	this.handles = append(this.handles, rh)
+	return rh, conn
+}
+
+// 创建一个player进程并用token "玩家id:token"登陆
+func (this *Harness) NewLoggedInPlayer(userId int) (*Player, *FakeConn) {
+	conn := new(FakeConn)
+	player := newPlayer(this.facade, conn)
+	this.handles = append(this.handles, player.rh)
+
+	token := fmt.Sprintf("%d:token", userId)
+	this.facade.auth.(*StaticAuthenticator).Add(token, userId)
+	this.PlayerSend(player.rh, "login", token)
+	return player, conn
+}
+
+// 登记玩家进程, 模拟玩家登陆成功
+func (this *Harness) LoginPlayer(rh *RoutineHandle, userId int) {
+	this.facade.registry.Register(KindPlayer, userId, rh)
+}
+
+func (this *Harness) serveApi(w http.ResponseWriter, r *http.Request) {
+	this.apiLock.Lock()
+	defer this.apiLock.Unlock()
+	this.apiCalls = append(this.apiCalls, r.URL.Path)
+	if this.apiFail {
+		fmt.Fprint(w, `{"error": "api failed"}`)
+		return
+	}
+	fmt.Fprint(w, `{"data": "ok"}`)
+}
+
+// 设置api接口是否返回错误
+func (this *Harness) SetApiFail(fail bool) {
+	this.apiLock.Lock()
+	defer this.apiLock.Unlock()
+	this.apiFail = fail
+}
+
+// 已调用的api方法, 格式: /service/method
+func (this *Harness) ApiCalls() []string {
+	this.apiLock.Lock()
+	defer this.apiLock.Unlock()
+	return append([]string(nil), this.apiCalls...)
+}
+
+// 模拟设备发送消息
+func (this *Harness) DeviceSend(rh *RoutineHandle, msgType string, data interface{}) {
+	this.send(rh, Game_RecvMessage, msgType, data)
+}
+
+// 模拟玩家客户端发送消息
+func (this *Harness) PlayerSend(rh *RoutineHandle, msgType string, data interface{}) {
+	this.send(rh, Player_RecvMessage, msgType, data)
+}
+
+func (this *Harness) send(rh *RoutineHandle, cmd int16, msgType string, data interface{}) {
+	message, err := json.Marshal(map[string]interface{}{"type": msgType, "data": data})
+	if err != nil {
+		this.t.Fatal(err)
+	}
+	if err := this.facade.protocol.cast(rh, cmd, string(message)); err != nil {
+		this.t.Fatal(err)
+	}
+	this.Settle()
+}
+
+// 同步调用进程, 并处理完调用产生的异步消息
+func (this *Harness) Call(rh *RoutineHandle, cmd int16, params interface{}) interface{} {
+	ret, err := this.facade.protocol.call(rh, cmd, params)
+	if err != nil {
+		this.t.Fatal(err)
+	}
+	this.Settle()
+	return ret
+}
+
+// 每个进程各处理一条异步消息, 没有进程处理消息时返回false
+func (this *Harness) Step() bool {
+	stepped := false
+	for _, rh := range this.handles {
+		if rh.step() {
+			stepped = true
+		}
+	}
+	return stepped
+}
+
+// 处理完所有进程中的异步消息
+func (this *Harness) Settle() {
+	for i := 0; this.Step(); i++ {
+		if i > 10000 {
+			this.t.Fatal("进程消息无法处理完")
+		}
+	}
+}
+
+// 时钟前进d并处理定时器触发的消息
+func (this *Harness) Advance(d time.Duration) {
+	this.clock.Advance(d)
+	this.Settle()
+}
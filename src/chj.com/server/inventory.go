@@ -0,0 +1,103 @@
+package main
+
+// 奖品库存-记录每台设备装的奖品和剩余数量, 抓中时扣减, 每次变化重写库存文件
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// 设备装的奖品, Stock为剩余数量
+type Prize struct {
+	Sku   string `json:"sku"`
+	Name  string `json:"name"`
+	Image string `json:"image,omitempty"`
+	Stock int    `json:"stock"`
+}
+
+type PrizeInventory struct {
+	lock sync.Mutex
+	// 库存文件, 空表示只保存在内存中
+	path string
+	// 设备名 -> 奖品, 没有记录的设备不跟踪库存
+	prizes map[string]*Prize
+}
+
+// 打开库存文件, 文件不存在时为空库存
+func OpenPrizeInventory(path string) (*PrizeInventory, error) {
+	this := new(PrizeInventory)
+	this.path = path
+	this.prizes = make(map[string]*Prize)
+	if path == "" {
+		return this, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return this, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &this.prizes); err != nil {
+		return nil, err
+	}
+	return this, nil
+}
+
+// 设备的奖品副本, 不跟踪库存的设备返回nil
+func (this *PrizeInventory) Get(deviceName string) *Prize {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	prize := this.prizes[deviceName]
+	if prize == nil {
+		return nil
+	}
+	copied := *prize
+	return &copied
+}
+
+// 设置设备的奖品和数量, prize为nil时不再跟踪该设备的库存
+func (this *PrizeInventory) Set(deviceName string, prize *Prize) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if prize == nil {
+		delete(this.prizes, deviceName)
+	} else {
+		copied := *prize
+		this.prizes[deviceName] = &copied
+	}
+	return this.save()
+}
+
+// 抓中后扣减一个奖品, 返回剩余数量, 不跟踪库存的设备返回-1
+func (this *PrizeInventory) Take(deviceName string) (int, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	prize := this.prizes[deviceName]
+	if prize == nil {
+		return -1, nil
+	}
+	if prize.Stock > 0 {
+		prize.Stock--
+	}
+	return prize.Stock, this.save()
+}
+
+// 重写库存文件, 需要持有锁
+func (this *PrizeInventory) save() error {
+	if this.path == "" {
+		return nil
+	}
+	data, _ := json.Marshal(this.prizes)
+	tmpPath := this.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, this.path)
+}
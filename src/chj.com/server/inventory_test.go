@@ -0,0 +1,40 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestPrizeInventory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inventory.json")
+	inventory, err := OpenPrizeInventory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 不跟踪库存的设备
+	if stock, _ := inventory.Take("dev2"); stock != -1 || inventory.Get("dev2") != nil {
+		t.Fatalf("untracked stock = %d", stock)
+	}
+
+	inventory.Set("dev1", &Prize{Sku: "bear", Name: "Bear", Stock: 1})
+	if stock, _ := inventory.Take("dev1"); stock != 0 {
+		t.Fatalf("stock = %d", stock)
+	}
+	if stock, _ := inventory.Take("dev1"); stock != 0 {
+		t.Fatalf("stock after empty = %d", stock)
+	}
+
+	// 重启后从文件恢复
+	inventory, err = OpenPrizeInventory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prize := inventory.Get("dev1"); prize == nil || prize.Sku != "bear" || prize.Stock != 0 {
+		t.Fatalf("prize after reload = %+v", prize)
+	}
+	inventory.Set("dev1", nil)
+	if inventory.Get("dev1") != nil {
+		t.Fatal("prize not removed")
+	}
+}
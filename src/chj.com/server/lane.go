@@ -0,0 +1,91 @@
+package main
+
+// 邮箱优先级通道-游戏控制指令优先于聊天, 进出房间等普通消息处理
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// 优先级通道, 数值越小优先级越高
+type Lane int
+
+const (
+	LaneControl Lane = iota // 游戏控制指令和设备消息
+	LaneNormal              // 普通消息
+	laneCount
+)
+
+var laneNames = [laneCount]string{"control", "normal"}
+
+func (this Lane) String() string {
+	if this >= 0 && this < laneCount {
+		return laneNames[this]
+	}
+	return fmt.Sprintf("lane(%d)", int(this))
+}
+
+// 单个优先级通道的邮箱
+type mailboxLane struct {
+	callC chan *Envelope // 用于同步调用进程的channel
+	castC chan *Envelope // 用于异步调用进程的channel
+}
+
+func newMailboxLane(size int) *mailboxLane {
+	this := new(mailboxLane)
+	this.callC = make(chan *Envelope)
+	this.castC = make(chan *Envelope, size)
+	return this
+}
+
+// 通道延迟统计
+type laneStat struct {
+	count     int64
+	totalWait time.Duration // 消息在邮箱中的等待时间
+	maxWait   time.Duration
+	totalCost time.Duration // 消息处理时间
+}
+
+// 延迟统计, 按进程类型和通道汇总
+var laneStats = struct {
+	sync.Mutex
+	stats map[string]*laneStat
+}{stats: make(map[string]*laneStat)}
+
+// 记录一条消息的等待和处理时间
+func recordLaneLatency(name string, lane Lane, wait time.Duration, cost time.Duration) {
+	key := name + "." + lane.String()
+
+	laneStats.Lock()
+	defer laneStats.Unlock()
+
+	stat, ok := laneStats.stats[key]
+	if !ok {
+		stat = new(laneStat)
+		laneStats.stats[key] = stat
+	}
+	stat.count++
+	stat.totalWait += wait
+	stat.totalCost += cost
+	if wait > stat.maxWait {
+		stat.maxWait = wait
+	}
+}
+
+// 获取通道延迟统计, 用于监控, 时间单位为毫秒
+func LaneStats() map[string]interface{} {
+	laneStats.Lock()
+	defer laneStats.Unlock()
+
+	stats := make(map[string]interface{})
+	for key, stat := range laneStats.stats {
+		stats[key] = map[string]interface{}{
+			"count":     stat.count,
+			"avgWaitMs": float64(stat.totalWait) / float64(stat.count) / float64(time.Millisecond),
+			"maxWaitMs": float64(stat.maxWait) / float64(time.Millisecond),
+			"avgCostMs": float64(stat.totalCost) / float64(stat.count) / float64(time.Millisecond),
+		}
+	}
+	return stats
+}
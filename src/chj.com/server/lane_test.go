@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+const testCmd_Control int16 = 9101
+
+func init() {
+	RegisterCommand(testCmd_Control, "testCmd_Control", "")
+	SetCommandLane(testCmd_Control, LaneControl)
+}
+
+// 创建记录处理顺序的测试进程, 普通通道容量为2
+func newLaneRoutine(name string) (*RoutineHandle, chan string) {
+	received := make(chan string, 8)
+	rh := NewRoutineHandle(name, &MailboxConfig{Size: 2, Policy: OverflowDropNewest})
+	record := func(ctx context.Context, params interface{}) (interface{}, error) {
+		received <- params.(string)
+		return nil, nil
+	}
+	rh.handle(testCmd_Echo, record)
+	rh.handle(testCmd_Control, record)
+	return rh, received
+}
+
+// 读取已处理的消息
+func receivedOrder(received chan string, n int) string {
+	order := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		order = append(order, <-received)
+	}
+	return fmt.Sprint(order)
+}
+
+func TestLaneControlFirstManual(t *testing.T) {
+	h := NewHarness(t)
+	rh, received := newLaneRoutine("TestLaneManual")
+	h.facade.rootSup.Start(&ChildSpec{Name: "TestLaneManual", Restart: Transient, Run: rh.loop, Handle: rh})
+	protocol := h.facade.protocol
+
+	// 普通通道已满时控制指令仍然可以投递, 并且先于普通消息处理
+	protocol.cast(rh, testCmd_Echo, "a")
+	protocol.cast(rh, testCmd_Echo, "b")
+	if err := protocol.cast(rh, testCmd_Echo, "c"); err == nil {
+		t.Fatal("normal lane not full")
+	}
+	if err := protocol.cast(rh, testCmd_Control, "ctl"); err != nil {
+		t.Fatalf("control cast: %v", err)
+	}
+
+	for rh.step() {
+	}
+	if order := receivedOrder(received, 3); order != "[ctl a b]" {
+		t.Fatalf("order = %s", order)
+	}
+}
+
+func TestLaneControlFirstLoop(t *testing.T) {
+	rh, received := newLaneRoutine("TestLaneLoop")
+	started := make(chan struct{})
+	release := make(chan struct{})
+	rh.handle(testCmd_Block, func(ctx context.Context, params interface{}) (interface{}, error) {
+		close(started)
+		<-release
+		return nil, nil
+	})
+	NewSupervisor("TestSup", nil, 10, time.Minute, 0).Start(&ChildSpec{Name: "TestLaneLoop", Restart: Transient, Run: rh.loop, Handle: rh})
+	defer rh.Stop()
+	protocol := NewProtocol(NewFakeClock())
+
+	// 进程忙时填满普通通道, 再投递控制指令
+	protocol.cast(rh, testCmd_Block, nil)
+	<-started
+	protocol.cast(rh, testCmd_Echo, "a")
+	protocol.cast(rh, testCmd_Echo, "b")
+	protocol.cast(rh, testCmd_Control, "ctl")
+	close(release)
+
+	if order := receivedOrder(received, 3); order != "[ctl a b]" {
+		t.Fatalf("order = %s", order)
+	}
+}
+
+// 通过getLaneStats接口获取通道延迟统计
+func apiLaneStats(server *Server) map[string]interface{} {
+	stats, _ := postApi(server, `{"type": "getLaneStats", "data": []}`, "", 0)["data"].(map[string]interface{})
+	return stats
+}
+
+// 获取通道统计中的消息数
+func laneMessages(stats map[string]interface{}, key string) float64 {
+	stat, _ := stats[key].(map[string]interface{})
+	count, _ := stat["count"].(float64)
+	return count
+}
+
+func TestApiLaneStats(t *testing.T) {
+	h := NewHarness(t)
+	rh, received := newLaneRoutine("TestLaneStats")
+	h.facade.rootSup.Start(&ChildSpec{Name: "TestLaneStats", Restart: Transient, Run: rh.loop, Handle: rh})
+	protocol := h.facade.protocol
+	server := newServer(h.facade)
+	before := apiLaneStats(server)
+
+	// 普通消息在邮箱中等待2秒, 控制指令投递后立即处理, 时间由协议调用器的时钟计算
+	protocol.cast(rh, testCmd_Echo, "a")
+	h.clock.Advance(2 * time.Second)
+	protocol.cast(rh, testCmd_Control, "ctl")
+	protocol.cast(rh, testCmd_Control, "ctl")
+	for rh.step() {
+	}
+	receivedOrder(received, 3)
+
+	// 按进程类型和通道分别统计
+	stats := apiLaneStats(server)
+	for key, count := range map[string]float64{"TestLaneStats.control": 2, "TestLaneStats.normal": 1} {
+		if laneMessages(stats, key)-laneMessages(before, key) != count {
+			t.Fatalf("%s = %v, before %v", key, stats[key], before[key])
+		}
+	}
+	for key, wait := range map[string]float64{"TestLaneStats.control": 0, "TestLaneStats.normal": 2000} {
+		stat := stats[key].(map[string]interface{})
+		if stat["maxWaitMs"] != wait || stat["avgCostMs"] != float64(0) {
+			t.Fatalf("%s = %v", key, stat)
+		}
+	}
+}
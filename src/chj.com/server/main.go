@@ -9,7 +9,7 @@ import (
 func main() {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Println("主进程崩溃: %v", r)
+			log.Printf("主进程崩溃: %v", r)
 			debug.PrintStack()
 		}
 		log.Println("----------服务器停止----------")
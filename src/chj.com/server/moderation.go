@@ -0,0 +1,244 @@
+package main
+
+// 聊天审核-房间内广播前检查禁言和慢速模式, 过滤超长消息, 屏蔽词和链接
+// 禁言记录写入文件, 重启后恢复; 慢速模式只保存在内存中, 重启后恢复为配置文件中的值
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	ErrChatMuted   = errors.New("muted")
+	ErrChatTooLong = errors.New("message too long")
+	ErrChatEmpty   = errors.New("empty message")
+)
+
+// 链接: 带协议或www开头的地址, 常见后缀的域名
+var chatLinkPattern = regexp.MustCompile(`(?i)(https?://\S+|www\.\S+|\b[a-z0-9-]+(\.[a-z0-9-]+)*\.(com|net|org|cn|io|me|cc|top|xyz|info)\b\S*)`)
+
+// 聊天审核配置
+type ChatConfig struct {
+	// 消息最大字符数, 0表示不限制
+	MaxLength int
+	// 屏蔽词, 不区分大小写, 每个字符替换为Mask
+	BannedWords []string
+	Mask        string
+	// 是否去掉消息中的链接
+	StripLinks bool
+	// 慢速模式, 设备名(default表示所有设备) -> 同一玩家两次发言的最短间隔
+	SlowMode map[string]time.Duration
+	// 禁言记录文件, 空表示只保存在内存中
+	Path string
+}
+
+func defaultChatConfig() *ChatConfig {
+	return &ChatConfig{
+		MaxLength:   100,
+		BannedWords: make([]string, 0),
+		Mask:        "*",
+		StripLinks:  true,
+		SlowMode:    make(map[string]time.Duration),
+		Path:        "chatmutes.json",
+	}
+}
+
+// 禁言记录, Until为零值表示永久禁言
+type ChatMute struct {
+	DeviceName string    `json:"deviceName,omitempty"`
+	PlayerId   int       `json:"playerId"`
+	Until      time.Time `json:"until"`
+	Operator   string    `json:"operator,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+type ChatModerator struct {
+	config      *ChatConfig
+	bannedWords *regexp.Regexp
+
+	lock sync.Mutex
+	// 设备名:玩家id -> 禁言记录, 设备名为空表示所有房间
+	mutes map[string]*ChatMute
+	// 设备名 -> 慢速模式间隔
+	slowMode map[string]time.Duration
+}
+
+// 创建聊天审核, 从禁言记录文件恢复, 文件不存在时没有禁言
+func NewChatModerator(config *ChatConfig) (*ChatModerator, error) {
+	this := new(ChatModerator)
+	this.config = config
+	this.mutes = make(map[string]*ChatMute)
+	this.slowMode = make(map[string]time.Duration)
+	for deviceName, interval := range config.SlowMode {
+		this.slowMode[deviceName] = interval
+	}
+
+	words := make([]string, 0, len(config.BannedWords))
+	for _, word := range config.BannedWords {
+		if word != "" {
+			words = append(words, regexp.QuoteMeta(word))
+		}
+	}
+	if len(words) > 0 {
+		this.bannedWords = regexp.MustCompile("(?i)" + strings.Join(words, "|"))
+	}
+
+	if config.Path == "" {
+		return this, nil
+	}
+	data, err := ioutil.ReadFile(config.Path)
+	if os.IsNotExist(err) {
+		return this, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &this.mutes); err != nil {
+		return nil, err
+	}
+	return this, nil
+}
+
+// 过滤消息, 返回替换后的消息和是否有改动, 超长或过滤后为空时返回错误
+func (this *ChatModerator) Filter(message string) (string, bool, error) {
+	if this.config.MaxLength > 0 && utf8.RuneCountInString(message) > this.config.MaxLength {
+		return "", false, ErrChatTooLong
+	}
+
+	filtered := message
+	if this.config.StripLinks {
+		filtered = chatLinkPattern.ReplaceAllString(filtered, "")
+	}
+	if this.bannedWords != nil {
+		filtered = this.bannedWords.ReplaceAllStringFunc(filtered, func(word string) string {
+			return strings.Repeat(this.config.Mask, utf8.RuneCountInString(word))
+		})
+	}
+	if strings.TrimSpace(filtered) == "" {
+		return "", false, ErrChatEmpty
+	}
+	return filtered, filtered != message, nil
+}
+
+// 禁言玩家, deviceName为空表示所有房间, until为零值表示永久禁言
+func (this *ChatModerator) Mute(mute *ChatMute) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	copied := *mute
+	this.mutes[chatMuteKey(mute.DeviceName, mute.PlayerId)] = &copied
+	return this.save()
+}
+
+// 解除禁言, 不影响其他范围的禁言
+func (this *ChatModerator) Unmute(deviceName string, playerId int) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	delete(this.mutes, chatMuteKey(deviceName, playerId))
+	return this.save()
+}
+
+// 玩家在房间内是否被禁言, 房间禁言和全局禁言都有效, 顺便删除已过期的禁言
+func (this *ChatModerator) Muted(now time.Time, deviceName string, playerId int) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	muted := false
+	expired := false
+	for _, key := range []string{chatMuteKey(deviceName, playerId), chatMuteKey("", playerId)} {
+		mute, ok := this.mutes[key]
+		if !ok {
+			continue
+		}
+		if mute.expired(now) {
+			delete(this.mutes, key)
+			expired = true
+			continue
+		}
+		muted = true
+	}
+	if expired {
+		this.saveLogged()
+	}
+	return muted
+}
+
+// 当前有效的禁言记录, 删除已过期的禁言
+func (this *ChatModerator) Mutes(now time.Time) []*ChatMute {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	ret := make([]*ChatMute, 0, len(this.mutes))
+	expired := false
+	for key, mute := range this.mutes {
+		if mute.expired(now) {
+			delete(this.mutes, key)
+			expired = true
+			continue
+		}
+		copied := *mute
+		ret = append(ret, &copied)
+	}
+	if expired {
+		this.saveLogged()
+	}
+	return ret
+}
+
+// 禁言是否已到期, 永久禁言不会到期
+func (this *ChatMute) expired(now time.Time) bool {
+	return !this.Until.IsZero() && !now.Before(this.Until)
+}
+
+// 设置房间的慢速模式, interval为0表示关闭
+func (this *ChatModerator) SetSlowMode(deviceName string, interval time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.slowMode[deviceName] = interval
+}
+
+// 房间的慢速模式间隔, 没有单独设置时使用default
+func (this *ChatModerator) SlowMode(deviceName string) time.Duration {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if interval, ok := this.slowMode[deviceName]; ok {
+		return interval
+	}
+	return this.slowMode["default"]
+}
+
+func chatMuteKey(deviceName string, playerId int) string {
+	return deviceName + ":" + strconv.Itoa(playerId)
+}
+
+// 删除过期禁言后重写文件, 失败只记录日志, 下次修改时再写入
+func (this *ChatModerator) saveLogged() {
+	if err := this.save(); err != nil {
+		log.Println("写入禁言记录失败: ", err)
+	}
+}
+
+// 重写禁言记录文件, 需要持有锁
+func (this *ChatModerator) save() error {
+	if this.config.Path == "" {
+		return nil
+	}
+	data, _ := json.Marshal(this.mutes)
+	tmpPath := this.config.Path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, this.config.Path)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestChatFilter(t *testing.T) {
+	config := defaultChatConfig()
+	config.Path = ""
+	config.MaxLength = 10
+	config.BannedWords = []string{"bad", "坏蛋"}
+	chat, err := NewChatModerator(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		message  string
+		expected string
+		err      error
+	}{
+		{"hello", "hello", nil},
+		{"BAD 坏蛋!", "*** **!", nil},
+		{"看 x.com/a", "看 ", nil},
+		{"www.x.cn", "", ErrChatEmpty},
+		{"01234567890", "", ErrChatTooLong},
+	}
+	for _, c := range cases {
+		message, filtered, err := chat.Filter(c.message)
+		if err != c.err || message != c.expected || filtered != (err == nil && message != c.message) {
+			t.Errorf("Filter(%q) = %q, %v, %v", c.message, message, filtered, err)
+		}
+	}
+}
+
+func TestChatMutes(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.Local)
+	config := defaultChatConfig()
+	config.Path = filepath.Join(t.TempDir(), "chatmutes.json")
+	config.SlowMode["default"] = time.Second
+	chat, err := NewChatModerator(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chat.Mute(&ChatMute{DeviceName: "dev1", PlayerId: 7, Until: now.Add(time.Minute)})
+	chat.Mute(&ChatMute{PlayerId: 8})
+	if !chat.Muted(now, "dev1", 7) || chat.Muted(now, "dev2", 7) {
+		t.Fatal("room mute")
+	}
+	if !chat.Muted(now.Add(time.Hour), "dev2", 8) {
+		t.Fatal("global ban")
+	}
+
+	// 重启后从文件恢复
+	chat, err = NewChatModerator(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !chat.Muted(now, "dev1", 7) || len(chat.Mutes(now)) != 2 {
+		t.Fatal("mutes not reloaded")
+	}
+	chat.Unmute("", 8)
+	if chat.Muted(now, "dev1", 8) {
+		t.Fatal("unmute")
+	}
+
+	// 慢速模式缺省值和房间设置
+	chat.SetSlowMode("dev1", 0)
+	if chat.SlowMode("dev1") != 0 || chat.SlowMode("dev2") != time.Second {
+		t.Fatal("slow mode")
+	}
+}
+
+// 过期的禁言从记录和文件中删除
+func TestChatMuteExpire(t *testing.T) {
+	clock := NewFakeClock()
+	config := defaultChatConfig()
+	config.Path = filepath.Join(t.TempDir(), "chatmutes.json")
+	chat, err := NewChatModerator(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chat.Mute(&ChatMute{DeviceName: "dev1", PlayerId: 7, Until: clock.Now().Add(time.Minute)})
+	chat.Mute(&ChatMute{DeviceName: "dev2", PlayerId: 7, Until: clock.Now().Add(time.Minute)})
+	chat.Mute(&ChatMute{PlayerId: 8})
+	clock.Advance(time.Minute)
+
+	// 查询时删除到期的房间禁言, 永久禁言保留
+	if chat.Muted(clock.Now(), "dev1", 7) {
+		t.Fatal("expired mute still active")
+	}
+	if _, ok := chat.mutes[chatMuteKey("dev1", 7)]; ok {
+		t.Fatal("expired mute not pruned")
+	}
+	if mutes := chat.Mutes(clock.Now()); len(mutes) != 1 || mutes[0].PlayerId != 8 || len(chat.mutes) != 1 {
+		t.Fatalf("mutes = %+v", mutes)
+	}
+
+	// 文件中也已删除, 重启后不会恢复
+	chat, err = NewChatModerator(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chat.mutes) != 1 || !chat.Muted(clock.Now(), "dev3", 8) {
+		t.Fatalf("reloaded mutes = %v", chat.mutes)
+	}
+}
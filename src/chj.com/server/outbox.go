@@ -0,0 +1,162 @@
+package main
+
+// 结算投递进程-把结算记录投递给php服务器, 失败时按退避时间重试, 多次失败后转入死信列表等待人工重新投递
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+)
+
+// 与Outbox进程通信协议
+const (
+	Outbox_Init           int16 = 401 + iota // 初始化
+	Outbox_Deliver                           // 投递到期的记录
+	Outbox_GetDeadLetters                    // 获取死信列表
+	Outbox_Replay                            // 重新投递死信
+)
+
+func init() {
+	RegisterCommand(Outbox_Init, "Outbox_Init", (*Facade)(nil))
+	RegisterCommand(Outbox_Deliver, "Outbox_Deliver", nil)
+	RegisterCommand(Outbox_GetDeadLetters, "Outbox_GetDeadLetters", nil)
+	RegisterCommand(Outbox_Replay, "Outbox_Replay", "")
+}
+
+type Outbox struct {
+	facade   *Facade
+	protocol *Protocol
+	registry *Registry
+	clock    Clock
+	store    *SettlementStore
+
+	// 进程通信Handle
+	rh *RoutineHandle
+
+	// 下次投递的定时器
+	timer Timer
+}
+
+func NewOutbox(facade *Facade) *RoutineHandle {
+	this := new(Outbox)
+	this.rh = NewRoutineHandle("Outbox", facade.config.mailboxConfig("outbox"))
+	this.registerHandlers()
+	facade.rootSup.Start(&ChildSpec{
+		Name:    "Outbox",
+		Restart: Permanent,
+		Run:     this.run,
+		Handle:  this.rh,
+	})
+	facade.protocol.call(this.rh, Outbox_Init, facade)
+	return this.rh
+}
+
+// 注册命令处理函数
+func (this *Outbox) registerHandlers() {
+	this.rh.handle(Outbox_Init, this.onInit)
+	this.rh.handle(Outbox_Deliver, this.onDeliver)
+	this.rh.handle(Outbox_GetDeadLetters, this.onGetDeadLetters)
+	this.rh.handle(Outbox_Replay, this.onReplay)
+}
+
+func (this *Outbox) run() {
+	this.rh.loop()
+}
+
+func (this *Outbox) onInit(ctx context.Context, params interface{}) (interface{}, error) {
+	this.facade = params.(*Facade)
+	this.protocol = this.facade.protocol
+	this.registry = this.facade.registry
+	this.clock = this.facade.clock
+	this.store = this.facade.settlements
+
+	// 投递上次退出前没有投递的记录
+	this.protocol.cast(this.rh, Outbox_Deliver, nil)
+	return nil, nil
+}
+
+// 投递所有到期的记录, 然后按最早的下次投递时间设置定时器
+func (this *Outbox) onDeliver(ctx context.Context, params interface{}) (interface{}, error) {
+	if this.timer != nil {
+		this.timer.Stop()
+		this.timer = nil
+	}
+
+	for _, entry := range this.store.Due(this.clock.Now()) {
+		this.deliver(entry)
+	}
+
+	if next, ok := this.store.NextAttempt(); ok {
+		this.timer = this.protocol.castAfter(this.rh, next.Sub(this.clock.Now()), Outbox_Deliver, nil)
+	}
+	return nil, nil
+}
+
+func (this *Outbox) deliver(entry *Settlement) {
+	config := this.facade.config
+	_, err := this.facade.callApi("play", "GetResult",
+		[]interface{}{config.apiSecret, entry.DeviceName, entry.PlayerId, entry.PlayResult, entry.Key})
+	if err == nil {
+		if err := this.store.MarkDelivered(entry.Key); err != nil {
+			log.Println("Outbox.deliver: 写入结算记录失败: ", entry.Key, err)
+		}
+		this.notifyPlayer(entry, SettlementDelivered)
+		return
+	}
+
+	log.Println("Outbox.deliver: 投递失败: ", entry.Key, err)
+	failed, storeErr := this.store.MarkFailed(entry.Key, err.Error(), config.outboxMaxAttempts)
+	if storeErr != nil {
+		log.Println("Outbox.deliver: 写入结算记录失败: ", entry.Key, storeErr)
+	}
+	if failed != nil && failed.Status == SettlementDead {
+		log.Println("Outbox.deliver: 投递失败次数过多, 转入死信列表: ", entry.Key)
+		this.facade.audit.Record(&AuditEntry{
+			Action:     "settlementDead",
+			DeviceName: entry.DeviceName,
+			PlayerId:   entry.PlayerId,
+			Detail:     entry.Key + ": " + err.Error(),
+		})
+	}
+}
+
+// 通知在线的玩家结算状态
+func (this *Outbox) notifyPlayer(entry *Settlement, status string) {
+	playerRH := this.registry.Lookup(KindPlayer, entry.PlayerId)
+	if playerRH == nil {
+		return
+	}
+	this.protocol.cast(playerRH, Player_SendMessage, settlementMessage(entry, status))
+}
+
+func (this *Outbox) onGetDeadLetters(ctx context.Context, params interface{}) (interface{}, error) {
+	return this.store.DeadLetters(), nil
+}
+
+func (this *Outbox) onReplay(ctx context.Context, params interface{}) (interface{}, error) {
+	key := params.(string)
+	count, err := this.store.Replay(key)
+	if err != nil {
+		log.Println("Outbox.onReplay: 写入结算记录失败: ", err)
+	}
+	if count > 0 {
+		this.facade.audit.Record(&AuditEntry{Action: "settlementReplay", Detail: key})
+		this.protocol.cast(this.rh, Outbox_Deliver, nil)
+	}
+	return count, nil
+}
+
+// 结算状态消息
+func settlementMessage(entry *Settlement, status string) string {
+	data := make(map[string]interface{})
+	data["key"] = entry.Key
+	data["deviceName"] = entry.DeviceName
+	data["playResult"] = entry.PlayResult
+	data["status"] = status
+
+	msgObj := make(map[string]interface{})
+	msgObj["type"] = "settlement"
+	msgObj["data"] = data
+	message, _ := json.Marshal(msgObj)
+	return string(message)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestOutboxDeliver(t *testing.T) {
+	h := NewHarness(t)
+	_, _, conns := startLosingRound(h, 7)
+
+	// 先通知玩家等待结算, 投递成功后通知已结算
+	settlements := conns[7].Messages("settlement")
+	if len(settlements) != 2 {
+		t.Fatalf("settlement messages = %v", settlements)
+	}
+	if settlements[0].(map[string]interface{})["status"] != SettlementPending ||
+		settlements[1].(map[string]interface{})["status"] != SettlementDelivered {
+		t.Fatalf("settlement messages = %v", settlements)
+	}
+	if _, ok := h.facade.settlements.NextAttempt(); ok {
+		t.Fatal("settlement not delivered")
+	}
+}
+
+func TestOutboxDeadLetter(t *testing.T) {
+	h := NewHarness(t)
+	h.SetApiFail(true)
+	h.facade.config.outboxMaxAttempts = 3
+	startLosingRound(h, 7)
+
+	// 按退避时间重试, 超过次数后转入死信列表
+	h.Advance(settlementBackoff(1))
+	h.Advance(settlementBackoff(2))
+	if calls := len(h.ApiCalls()); calls != 3 {
+		t.Fatalf("api calls = %d", calls)
+	}
+	deadLetters := h.Call(h.facade.outboxRH, Outbox_GetDeadLetters, nil).([]*Settlement)
+	if len(deadLetters) != 1 || deadLetters[0].Attempts != 3 || deadLetters[0].PlayResult != "0" {
+		t.Fatalf("dead letters = %+v", deadLetters)
+	}
+	h.Advance(settlementBackoff(10))
+	if calls := len(h.ApiCalls()); calls != 3 {
+		t.Fatalf("dead letter retried, api calls = %d", calls)
+	}
+
+	// 人工重新投递
+	h.SetApiFail(false)
+	if count := h.Call(h.facade.outboxRH, Outbox_Replay, ""); count != 1 {
+		t.Fatalf("replay count = %v", count)
+	}
+	if deadLetters := h.facade.settlements.DeadLetters(); len(deadLetters) != 0 {
+		t.Fatalf("dead letters = %+v", deadLetters)
+	}
+	if calls := len(h.ApiCalls()); calls != 4 {
+		t.Fatalf("api calls = %d", calls)
+	}
+	if actions := h.facade.audit.Recent(2); actions[0].Action != "settlementDead" || actions[1].Action != "settlementReplay" {
+		t.Fatalf("audit = %+v", actions)
+	}
+}
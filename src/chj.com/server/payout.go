@@ -0,0 +1,376 @@
+package main
+
+// 中奖策略-服务器决定每局是否抓中, 每台设备按配置组合多个规则, 每次决定都写入日志便于核查概率
+// 规则按优先级依次判断, 第一个做出决定的规则生效: 每日上限 > 保底 > 玩家补偿 > 固定概率
+// 决定记录达到payoutCompactSize条或启动时压缩为一行快照, 启动时读取快照再回放之后的决定
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// 设备的中奖状态, 由决定记录回放得到
+type PayoutState struct {
+	// 设备连续未中奖次数
+	DevicePlays int `json:"devicePlays"`
+	// 玩家在该设备上的连续未中奖次数
+	PlayerLosses map[int]int `json:"playerLosses"`
+	// 当天日期和中奖次数
+	Day       string `json:"day"`
+	DailyWins int    `json:"dailyWins"`
+}
+
+func newPayoutState() *PayoutState {
+	this := new(PayoutState)
+	this.PlayerLosses = make(map[int]int)
+	return this
+}
+
+// 跨天时重置当天中奖次数
+func (this *PayoutState) rollover(now time.Time) {
+	day := now.Format("2006-01-02")
+	if this.Day != day {
+		this.Day = day
+		this.DailyWins = 0
+	}
+}
+
+func (this *PayoutState) apply(decision *PayoutDecision) {
+	this.rollover(decision.Time)
+	if decision.Win {
+		this.DevicePlays = 0
+		delete(this.PlayerLosses, decision.PlayerId)
+		this.DailyWins++
+	} else {
+		this.DevicePlays++
+		this.PlayerLosses[decision.PlayerId]++
+	}
+}
+
+// 一次中奖决定
+type PayoutDecision struct {
+	Time       time.Time `json:"time"`
+	DeviceName string    `json:"deviceName"`
+	PlayerId   int       `json:"playerId"`
+	Win        bool      `json:"win"`
+	// 做出决定的规则
+	Rule string `json:"rule"`
+	// 决定前的状态
+	DevicePlays  int `json:"devicePlays"`
+	PlayerLosses int `json:"playerLosses"`
+	DailyWins    int `json:"dailyWins"`
+}
+
+// 决定记录文件中的快照行, 记录压缩时各设备的中奖状态
+type payoutSnapshot struct {
+	Snapshot map[string]*PayoutState `json:"snapshot"`
+}
+
+// 决定记录压缩的条数
+const payoutCompactSize = 10000
+
+//////////////////////////////////////////////////////////
+// 规则
+
+// 中奖规则, ok为false表示该规则不做决定, 交给下一个规则
+type PayoutRule interface {
+	Decide(state *PayoutState, playerId int, random float64) (win bool, ok bool)
+}
+
+// 根据配置参数创建规则
+type PayoutRuleFactory func(param float64) PayoutRule
+
+type payoutRuleSpec struct {
+	name    string
+	factory PayoutRuleFactory
+}
+
+// 已注册的规则, 按优先级排列
+var payoutRules = make([]*payoutRuleSpec, 0)
+
+// 注册规则, 先注册的优先级高
+func RegisterPayoutRule(name string, factory PayoutRuleFactory) {
+	payoutRules = append(payoutRules, &payoutRuleSpec{name, factory})
+}
+
+func init() {
+	RegisterPayoutRule("dailyCap", func(param float64) PayoutRule { return dailyCapRule(param) })
+	RegisterPayoutRule("guaranteeAfter", func(param float64) PayoutRule { return guaranteeRule(param) })
+	RegisterPayoutRule("pityAfter", func(param float64) PayoutRule { return pityRule(param) })
+	RegisterPayoutRule("ratio", func(param float64) PayoutRule { return ratioRule(param) })
+}
+
+// 每日中奖上限, 达到后当天不再中奖
+type dailyCapRule int
+
+func (this dailyCapRule) Decide(state *PayoutState, playerId int, random float64) (bool, bool) {
+	return false, state.DailyWins >= int(this)
+}
+
+// 保底, 设备连续N次没中奖后第N次必中
+type guaranteeRule int
+
+func (this guaranteeRule) Decide(state *PayoutState, playerId int, random float64) (bool, bool) {
+	return true, state.DevicePlays+1 >= int(this)
+}
+
+// 玩家补偿, 玩家连续N次没中奖后下一次必中
+type pityRule int
+
+func (this pityRule) Decide(state *PayoutState, playerId int, random float64) (bool, bool) {
+	return true, state.PlayerLosses[playerId] >= int(this)
+}
+
+// 固定概率
+type ratioRule float64
+
+func (this ratioRule) Decide(state *PayoutState, playerId int, random float64) (bool, bool) {
+	return random < float64(this), true
+}
+
+//////////////////////////////////////////////////////////
+// 决定引擎
+
+// 设备配置的规则
+type payoutPolicy struct {
+	names []string
+	rules []PayoutRule
+}
+
+type PayoutEngine struct {
+	clock Clock
+
+	lock sync.Mutex
+	// 设备名 -> 策略, 没有单独配置的设备使用default
+	policies map[string]*payoutPolicy
+	states   map[string]*PayoutState
+	random   func() float64
+
+	// 决定记录文件, nil表示只保存在内存中
+	path string
+	file *os.File
+	// 上次压缩后写入的决定数
+	appended int
+	// 最近的决定, 用于http接口查询
+	recent []*PayoutDecision
+}
+
+// 创建中奖策略引擎, config为设备名(default表示所有设备) -> 规则名 -> 参数, path为决定记录文件
+func NewPayoutEngine(clock Clock, config map[string]map[string]float64, path string) (*PayoutEngine, error) {
+	this := new(PayoutEngine)
+	this.clock = clock
+	this.policies = make(map[string]*payoutPolicy)
+	this.states = make(map[string]*PayoutState)
+	this.random = rand.New(rand.NewSource(clock.Now().UnixNano())).Float64
+	this.recent = make([]*PayoutDecision, 0)
+
+	for deviceName, params := range config {
+		policy := &payoutPolicy{}
+		for name := range params {
+			if !payoutRuleExists(name) {
+				return nil, fmt.Errorf("unknown payout rule: %s", name)
+			}
+		}
+		for _, spec := range payoutRules {
+			if param, ok := params[spec.name]; ok {
+				policy.names = append(policy.names, spec.name)
+				policy.rules = append(policy.rules, spec.factory(param))
+			}
+		}
+		this.policies[deviceName] = policy
+	}
+
+	if path != "" {
+		this.path = path
+		if err := this.load(path); err != nil {
+			return nil, err
+		}
+		if err := this.compact(); err != nil {
+			return nil, err
+		}
+	}
+	return this, nil
+}
+
+func payoutRuleExists(name string) bool {
+	for _, spec := range payoutRules {
+		if spec.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// 回放决定记录, 恢复各设备的中奖状态
+func (this *PayoutEngine) load(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		snapshot := new(payoutSnapshot)
+		if err := json.Unmarshal(scanner.Bytes(), snapshot); err == nil && snapshot.Snapshot != nil {
+			for deviceName, state := range snapshot.Snapshot {
+				if state.PlayerLosses == nil {
+					state.PlayerLosses = make(map[int]int)
+				}
+				this.states[deviceName] = state
+			}
+			continue
+		}
+
+		decision := new(PayoutDecision)
+		if err := json.Unmarshal(scanner.Bytes(), decision); err != nil {
+			log.Println("中奖记录解析失败: ", err)
+			continue
+		}
+		this.state(decision.DeviceName).apply(decision)
+	}
+	return scanner.Err()
+}
+
+// 把当前状态写成快照替换决定记录文件, 需要持有lock或在启动时调用
+func (this *PayoutEngine) compact() error {
+	line, err := json.Marshal(&payoutSnapshot{this.states})
+	if err != nil {
+		return err
+	}
+
+	// 先写临时文件再替换, 压缩中途退出不会丢失记录
+	tmpPath := this.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(append(line, '\n')); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, this.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if this.file != nil {
+		this.file.Close()
+	}
+	f, err := os.OpenFile(this.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		this.file = nil
+		return err
+	}
+	this.file = f
+	this.appended = 0
+	return nil
+}
+
+func (this *PayoutEngine) state(deviceName string) *PayoutState {
+	state, ok := this.states[deviceName]
+	if !ok {
+		state = newPayoutState()
+		this.states[deviceName] = state
+	}
+	return state
+}
+
+func (this *PayoutEngine) policy(deviceName string) *payoutPolicy {
+	if policy, ok := this.policies[deviceName]; ok {
+		return policy
+	}
+	return this.policies["default"]
+}
+
+// 决定本局是否抓中并记录, 设备没有配置策略时返回nil, 由php服务器决定
+func (this *PayoutEngine) Decide(deviceName string, playerId int) *PayoutDecision {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	policy := this.policy(deviceName)
+	if policy == nil || len(policy.rules) == 0 {
+		return nil
+	}
+
+	now := this.clock.Now()
+	state := this.state(deviceName)
+	state.rollover(now)
+
+	decision := &PayoutDecision{
+		Time:         now,
+		DeviceName:   deviceName,
+		PlayerId:     playerId,
+		Rule:         "default",
+		DevicePlays:  state.DevicePlays,
+		PlayerLosses: state.PlayerLosses[playerId],
+		DailyWins:    state.DailyWins,
+	}
+	random := this.random()
+	for i, rule := range policy.rules {
+		if win, ok := rule.Decide(state, playerId, random); ok {
+			decision.Win = win
+			decision.Rule = policy.names[i]
+			break
+		}
+	}
+	state.apply(decision)
+
+	this.recent = append(this.recent, decision)
+	if len(this.recent) > auditRecentSize {
+		this.recent = this.recent[len(this.recent)-auditRecentSize:]
+	}
+	if this.file != nil {
+		line, _ := json.Marshal(decision)
+		if _, err := this.file.Write(append(line, '\n')); err != nil {
+			log.Println("写入中奖记录失败: ", err)
+		}
+		this.appended++
+		if this.appended >= payoutCompactSize {
+			this.appended = 0
+			if err := this.compact(); err != nil {
+				log.Println("压缩中奖记录失败: ", err)
+			}
+		}
+	}
+	return decision
+}
+
+// 设备最近的决定(新的在前面)和当前状态, deviceName为空时返回所有设备的决定
+func (this *PayoutEngine) Recent(deviceName string, n int) ([]*PayoutDecision, *PayoutState) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	ret := make([]*PayoutDecision, 0, n)
+	for i := len(this.recent) - 1; i >= 0 && len(ret) < n; i-- {
+		if deviceName == "" || this.recent[i].DeviceName == deviceName {
+			ret = append(ret, this.recent[i])
+		}
+	}
+
+	var state *PayoutState
+	if current, ok := this.states[deviceName]; ok {
+		copied := *current
+		copied.PlayerLosses = make(map[int]int)
+		for playerId, losses := range current.PlayerLosses {
+			copied.PlayerLosses[playerId] = losses
+		}
+		state = &copied
+	}
+	return ret, state
+}
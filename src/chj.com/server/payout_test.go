@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 按顺序返回给定随机数的中奖策略
+func newTestPayoutEngine(t *testing.T, clock Clock, config map[string]map[string]float64, path string, randoms ...float64) *PayoutEngine {
+	engine, err := NewPayoutEngine(clock, config, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine.random = func() float64 {
+		if len(randoms) == 0 {
+			return 0.99
+		}
+		random := randoms[0]
+		randoms = randoms[1:]
+		return random
+	}
+	return engine
+}
+
+func decideWins(engine *PayoutEngine, deviceName string, playerId int, n int) []bool {
+	wins := make([]bool, 0, n)
+	for i := 0; i < n; i++ {
+		wins = append(wins, engine.Decide(deviceName, playerId).Win)
+	}
+	return wins
+}
+
+func TestPayoutRules(t *testing.T) {
+	clock := NewFakeClock()
+	engine := newTestPayoutEngine(t, clock, map[string]map[string]float64{
+		"default": {"ratio": 0.1},
+		"dev1":    {"guaranteeAfter": 3, "ratio": 0.1},
+		"dev2":    {"pityAfter": 2, "ratio": 0.1},
+		"dev3":    {"dailyCap": 1, "ratio": 0.5},
+	}, "")
+
+	// 没有配置的设备使用default
+	if decision := engine.Decide("dev0", 7); decision == nil || decision.Win || decision.Rule != "ratio" {
+		t.Fatalf("default decision = %+v", decision)
+	}
+
+	// 第3次保底中奖
+	if wins := decideWins(engine, "dev1", 7, 6); wins[2] != true || wins[5] != true || wins[0] || wins[3] {
+		t.Fatalf("guarantee wins = %v", wins)
+	}
+
+	// 玩家连续2次没中, 第3次补偿中奖, 补偿按玩家计算
+	decideWins(engine, "dev2", 7, 2)
+	if decision := engine.Decide("dev2", 8); decision.Win {
+		t.Fatalf("pity for other player = %+v", decision)
+	}
+	if decision := engine.Decide("dev2", 7); !decision.Win || decision.Rule != "pityAfter" || decision.PlayerLosses != 2 {
+		t.Fatalf("pity decision = %+v", decision)
+	}
+
+	// 达到每日上限后当天不再中奖, 第二天重新计算
+	engine.random = func() float64 { return 0 }
+	if wins := decideWins(engine, "dev3", 7, 2); !wins[0] || wins[1] {
+		t.Fatalf("daily cap wins = %v", wins)
+	}
+	clock.Advance(24 * time.Hour)
+	if decision := engine.Decide("dev3", 7); !decision.Win || decision.DailyWins != 0 {
+		t.Fatalf("next day decision = %+v", decision)
+	}
+}
+
+func TestPayoutDisabled(t *testing.T) {
+	engine := newTestPayoutEngine(t, NewFakeClock(), map[string]map[string]float64{"dev1": {"ratio": 1}}, "")
+	if decision := engine.Decide("dev2", 7); decision != nil {
+		t.Fatalf("decision = %+v", decision)
+	}
+	if _, err := NewPayoutEngine(NewFakeClock(), map[string]map[string]float64{"dev1": {"luck": 1}}, ""); err == nil {
+		t.Fatal("unknown rule accepted")
+	}
+}
+
+func TestPayoutReload(t *testing.T) {
+	clock := NewFakeClock()
+	path := filepath.Join(t.TempDir(), "payout.log")
+	config := map[string]map[string]float64{"dev1": {"guaranteeAfter": 4, "ratio": 0}}
+
+	engine := newTestPayoutEngine(t, clock, config, path)
+	decideWins(engine, "dev1", 7, 2)
+
+	// 重启后从记录恢复状态, 保底次数继续计算
+	engine = newTestPayoutEngine(t, clock, config, path)
+	if wins := decideWins(engine, "dev1", 7, 2); wins[0] || !wins[1] {
+		t.Fatalf("wins after reload = %v", wins)
+	}
+	decisions, state := engine.Recent("dev1", 10)
+	if len(decisions) != 2 || state.DevicePlays != 0 {
+		t.Fatalf("recent = %+v, state = %+v", decisions, state)
+	}
+}
+
+// 启动时和记录达到压缩条数时写成快照, 快照和之后的决定一起恢复状态
+func TestPayoutCompact(t *testing.T) {
+	clock := NewFakeClock()
+	path := filepath.Join(t.TempDir(), "payout.log")
+	config := map[string]map[string]float64{"dev1": {"guaranteeAfter": 4, "pityAfter": 3, "dailyCap": 100, "ratio": 0}}
+
+	engine := newTestPayoutEngine(t, clock, config, path)
+	decideWins(engine, "dev1", 7, payoutCompactSize+2)
+	engine.Decide("dev1", 8)
+	_, want := engine.Recent("dev1", 0)
+
+	// 压缩后文件只有快照和之后的决定
+	if lines := countLines(t, path); lines != 4 {
+		t.Fatalf("lines after compact = %d", lines)
+	}
+	engine = newTestPayoutEngine(t, clock, config, path)
+	if _, state := engine.Recent("dev1", 0); fmt.Sprint(state) != fmt.Sprint(want) {
+		t.Fatalf("state after reload = %+v, want %+v", state, want)
+	}
+	if lines := countLines(t, path); lines != 1 {
+		t.Fatalf("lines after reload = %d", lines)
+	}
+}
+
+func countLines(t *testing.T, path string) int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(data), "\n")
+}
+
+// 每日上限为0时忽略, 不能让设备永远不中奖
+func TestPayoutConfigDailyCap(t *testing.T) {
+	config := new(Config)
+	config.payoutPolicies = make(map[string]map[string]float64)
+	config.parsePayoutConfig(map[string]interface{}{"policies": map[string]interface{}{
+		"dev1": map[string]interface{}{"dailyCap": float64(0), "ratio": float64(1)},
+		"dev2": map[string]interface{}{"dailyCap": float64(2)},
+	}})
+	if _, ok := config.payoutPolicies["dev1"]["dailyCap"]; ok {
+		t.Fatalf("dev1 policy = %v", config.payoutPolicies["dev1"])
+	}
+	if config.payoutPolicies["dev2"]["dailyCap"] != 2 {
+		t.Fatalf("dev2 policy = %v", config.payoutPolicies["dev2"])
+	}
+
+	engine := newTestPayoutEngine(t, NewFakeClock(), config.payoutPolicies, "")
+	if decision := engine.Decide("dev1", 7); !decision.Win {
+		t.Fatalf("decision = %+v", decision)
+	}
+}
+
+func TestGamePayoutDecision(t *testing.T) {
+	h := NewHarness(t)
+	h.facade.payout = newTestPayoutEngine(t, h.clock, map[string]map[string]float64{"dev1": {"guaranteeAfter": 1}}, "")
+
+	gameRH, conn := h.NewGame()
+	h.DeviceSend(gameRH, "login", "dev1:token")
+	h.DeviceSend(gameRH, "status", map[string]interface{}{"deviceStatus": "ready", "curPlayer": 0})
+	playerRH, _ := h.NewPlayer()
+	h.Call(gameRH, Game_Join, &GameJoinReq{7, playerRH})
+
+	// php服务器传入的结果被服务器的决定替换
+	h.Call(gameRH, Game_Control, &GameControlReq{"start", 7, 0})
+	control := conn.Last("control").(map[string]interface{})
+	if control["controlType"] != "start" || control["result"].(float64) != 1 {
+		t.Fatalf("control = %v", control)
+	}
+}
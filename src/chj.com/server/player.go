@@ -3,38 +3,71 @@ package main
 // 客户端对象-处理客户端请求
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
-	"runtime/debug"
-	"strconv"
-	"strings"
+	"sync"
 	"time"
-
-	"chj.com/zwwserver/model"
-
-	"golang.org/x/net/websocket"
 )
 
 // 与Player进程通信协议
 const (
-	Player_Init        int16 = 301 + iota // 初始化
-	Player_Logout                         // 登出
-	Player_Kickout                        // 踢下线
-	Player_GetToken                       // 获取token
-	Player_RecvMessage                    // 接收客户端消息
-	Player_SendMessage                    // 给客户端发消息
+	Player_Init          int16 = 301 + iota // 初始化
+	Player_Logout                           // 登出
+	Player_Kickout                          // 踢下线
+	Player_GetToken                         // 获取token
+	Player_RecvMessage                      // 接收客户端消息
+	Player_SendMessage                      // 给客户端发消息
+	Player_Disconnect                       // 客户端连接断开
+	Player_Resume                           // 断线重连
+	Player_ResumeTimeout                    // 等待重连超时
 )
 
+// 重连token无效或进程已经登出
+var ErrResumeRejected = errors.New("resume rejected")
+
+// Player_Init 参数
+type PlayerInitReq struct {
+	Facade *Facade
+	Ws     Conn
+}
+
+// Player_Disconnect 参数, 断开的连接
+type PlayerDisconnectReq struct {
+	Ws Conn
+}
+
+// Player_Resume 参数
+type PlayerResumeReq struct {
+	Token string
+	Ws    Conn
+}
+
+func init() {
+	RegisterCommand(Player_Init, "Player_Init", (*PlayerInitReq)(nil))
+	RegisterCommand(Player_Logout, "Player_Logout", nil)
+	RegisterCommand(Player_Kickout, "Player_Kickout", nil)
+	RegisterCommand(Player_GetToken, "Player_GetToken", nil)
+	RegisterCommand(Player_RecvMessage, "Player_RecvMessage", "")
+	RegisterCommand(Player_SendMessage, "Player_SendMessage", "")
+	RegisterCommand(Player_Disconnect, "Player_Disconnect", (*PlayerDisconnectReq)(nil))
+	RegisterCommand(Player_Resume, "Player_Resume", (*PlayerResumeReq)(nil))
+	RegisterCommand(Player_ResumeTimeout, "Player_ResumeTimeout", 0)
+}
+
 type Player struct {
 	facade    *Facade
 	protocol  *Protocol
 	sessionRH *RoutineHandle
+	registry  *Registry
 
 	// 进程通信Handle
 	rh *RoutineHandle
 
-	// 客户端连接
-	ws *websocket.Conn
+	// 客户端连接, 断线等待重连时为nil, 修改时持有wsLock
+	ws     Conn
+	wsLock sync.Mutex
 
 	// 当前所在game房间的通信Handle
 	GameRH *RoutineHandle
@@ -49,110 +82,186 @@ type Player struct {
 	// 是否被踢下线
 	isKickout bool
 
-	retryTime int
+	// 消息限流, 因持续超限被断开时不能重连
+	flood     *FloodGuard
+	isFlooded bool
+
+	// 断线重连token, 登陆成功后发给客户端
+	resumeToken string
+	// 等待重连的序号, 用于忽略已重连后的超时消息
+	resumeSeq int
+	// 断线期间缓存的消息和丢弃的消息数
+	resumeBuffer  []string
+	resumeDropped int
 }
 
-func NewPlayer(facade *Facade, ws *websocket.Conn) *RoutineHandle {
-	this := new(Player)
-	this.rh = NewRoutineHandle()
-	go this.run()
-	facade.protocol.call(this.rh, Player_Init, []interface{}{facade, ws})
-	return this.rh
+func NewPlayer(facade *Facade, ws Conn) *RoutineHandle {
+	return newPlayer(facade, ws).rh
 }
 
-func (this *Player) run() {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Println("Player进程崩溃, 3秒后重启: ", r)
-			log.Printf("%s", debug.Stack())
+func newPlayer(facade *Facade, ws Conn) *Player {
+	this := new(Player)
+	this.rh = NewRoutineHandle("Player", facade.config.mailboxConfig("player"))
+	// 消息堆积时断开当前连接, 由Server处理断线
+	this.rh.setOnOverflow(func() {
+		if ws := this.currentWs(); ws != nil {
+			ws.Close()
+		}
+	})
+	this.registerHandlers()
+	facade.playerSup.Start(&ChildSpec{
+		Name:     "Player",
+		Restart:  Transient,
+		Run:      this.run,
+		Handle:   this.rh,
+		OnGiveUp: this.onGiveUp,
+	})
+	facade.protocol.call(this.rh, Player_Init, &PlayerInitReq{facade, ws})
+	return this
+}
 
-			this.retryTime++
+// 注册命令处理函数
+func (this *Player) registerHandlers() {
+	this.rh.handle(Player_Init, this.onInit)
+	this.rh.handle(Player_Logout, this.onLogout)
+	this.rh.handle(Player_Kickout, this.onKickout)
+	this.rh.handle(Player_GetToken, this.onGetToken)
+	this.rh.handle(Player_RecvMessage, this.onRecvMessage)
+	this.rh.handle(Player_SendMessage, this.onSendMessage)
+	this.rh.handle(Player_Disconnect, this.onDisconnect)
+	this.rh.handle(Player_Resume, this.onResume)
+	this.rh.handle(Player_ResumeTimeout, this.onResumeTimeout)
+}
 
-			if this.retryTime > 5 {
-				log.Println("Player进程崩超过5次, 不再重试!")
-			}
+func (this *Player) run() {
+	this.rh.loop()
+}
 
-			// 休眠一下再重启...
-			time.Sleep(time.Second * 3)
-			log.Println("Player进程重启!")
-			go this.run()
-		}
-	}()
-
-	for {
-		select {
-		case recv := <-this.rh.callC:
-			cmd, _ := recv.([]interface{})
-			switch cmd[0] {
-			case Player_Init:
-				this.onInit(cmd[1].([]interface{}))
-			case Player_Logout:
-				this.onLogout()
-			case Player_Kickout:
-				this.onKickout()
-			case Player_GetToken:
-				this.onGetToken()
-			default:
-				log.Println("Player 未处理的命令: ", cmd[0])
-				this.rh.callC <- nil
-			}
-		case recv := <-this.rh.castC:
-			cmd, _ := recv.([]interface{})
-			switch cmd[0] {
-			case Player_RecvMessage:
-				this.onRecvMessage(cmd[1].(string))
-			case Player_SendMessage:
-				this.onSendMessage(cmd[1])
-			default:
-				log.Println("Player 未处理的命令: ", cmd[0])
-			}
-		}
+// 进程不再重启, 退出房间并清理会话, 断开客户端连接
+func (this *Player) onGiveUp(reason interface{}) {
+	ws := this.currentWs()
+	this.onLogout(context.Background(), nil)
+	if ws != nil {
+		ws.Close()
 	}
 }
 
-func (this *Player) onInit(params []interface{}) {
-	defer func() {
-		this.rh.callC <- nil
-	}()
-
-	this.facade = params[0].(*Facade)
+func (this *Player) onInit(ctx context.Context, params interface{}) (interface{}, error) {
+	req := params.(*PlayerInitReq)
+	this.facade = req.Facade
 	this.protocol = this.facade.protocol
 	this.sessionRH = this.facade.sessionRH
-	this.ws = params[1].(*websocket.Conn)
+	this.registry = this.facade.registry
+	this.setWs(req.Ws)
 
 	this.watchGames = make([]string, 0)
+	this.resumeBuffer = make([]string, 0)
+	this.flood = NewFloodGuard(this.facade.config.flood)
+	return nil, nil
 }
 
 // 接收客户端的消息
-func (this *Player) onRecvMessage(message string) {
-	// 解析json请求,然后路由处理
-	var msgObj map[string]interface{}
-	if err := json.Unmarshal([]byte(message), &msgObj); err != nil {
+func (this *Player) onRecvMessage(ctx context.Context, params interface{}) (interface{}, error) {
+	message := params.(string)
+
+	// 解析json请求,然后路由处理, 格式错误的消息返回错误, 不处理
+	msg, err := parseClientMessage(message)
+	if err != nil {
 		log.Println("解析客户端消息出错: ", err, message)
-		return
+		return nil, err
 	}
 
-	msgType := msgObj["type"].(string)
+	if this.userId > 0 {
+		ctx = WithUserId(ctx, this.userId)
+	}
+
+	msgType := msg.Type
+
+	// 超限的消息不处理, 避免刷屏或控制指令挤占game进程
+	if !this.checkFlood(ctx, msgType) {
+		return nil, nil
+	}
+
+	var data string
+	var object map[string]interface{}
+	var list []interface{}
 	switch msgType {
 	case "heartBeat": // 心跳包
-		this.onHeartBeat(msgObj["data"].(string))
+		if data, err = msg.String(); err == nil {
+			this.onHeartBeat(data)
+		}
 	case "login": // 登陆
-		this.onLogin(msgObj["data"].(string))
+		if data, err = msg.String(); err == nil {
+			this.onLogin(ctx, data)
+		}
 	case "joinGameRoom": // 加入game房间
-		this.onJoinGameRoom(msgObj["data"].(string))
+		if data, err = msg.String(); err == nil {
+			this.onJoinGameRoom(ctx, data)
+		}
 	case "leaveGameRoom": // 离开game房间
-		this.onLeaveGameRoom(msgObj["data"].(string))
+		if data, err = msg.String(); err == nil {
+			this.onLeaveGameRoom(ctx, data)
+		}
 	case "controlGame": // 控制game
-		this.onControlGame(msgObj["data"].(map[string]interface{}))
+		if object, err = msg.Object(); err == nil {
+			this.onControlGame(ctx, object)
+		}
 	case "watchGameRooms": // 从列表观察game状态
-		this.onWatchGameRooms(msgObj["data"].([]interface{}))
+		if list, err = msg.List(); err == nil {
+			this.onWatchGameRooms(ctx, list)
+		}
 	case "unwatchGameRooms": // 取消列表观察game状态
-		this.onUnwatchGameRooms(msgObj["data"].([]interface{}))
+		if list, err = msg.List(); err == nil {
+			this.onUnwatchGameRooms(ctx, list)
+		}
 	case "broadcastMessage": // 给房间内的其他玩家广播消息
-		this.onBroadcastMessage(msgObj["data"].(string))
+		if data, err = msg.String(); err == nil {
+			this.onBroadcastMessage(ctx, data)
+		}
+	case "resume": // 重连失败时由新连接的进程收到
+		this.resumeResponse(1, "resume failed")
 	default:
 		log.Println("Player未处理的消息类型: ", msgType)
 	}
+	return nil, err
+}
+
+// 限流检查, 消息可以处理时返回true, 超限时按次数警告, 禁言或断开连接
+func (this *Player) checkFlood(ctx context.Context, msgType string) bool {
+	action := this.flood.Check(receiveTime(ctx, this.facade.clock.Now()), msgType)
+	switch action {
+	case FloodAllow:
+		return true
+	case FloodWarn:
+		this.rateLimitedMessage(msgType, "warn", 0)
+	case FloodMute:
+		log.Println("Player.checkFlood: 禁言", this.userId, msgType)
+		this.rateLimitedMessage(msgType, "mute", this.facade.config.flood.MuteTime)
+	case FloodDisconnect:
+		log.Println("Player.checkFlood: 断开连接", this.userId, msgType)
+		this.facade.audit.Record(&AuditEntry{
+			Action:   "playerFlood",
+			PlayerId: this.userId,
+			Detail:   msgType,
+		})
+		this.rateLimitedMessage(msgType, "disconnect", 0)
+		this.isFlooded = true
+		if ws := this.currentWs(); ws != nil {
+			ws.Close()
+		}
+	}
+	return false
+}
+
+// 通知客户端消息被限流, muteTime为禁言时长
+func (this *Player) rateLimitedMessage(msgType string, action string, muteTime time.Duration) {
+	message := make(map[string]interface{})
+	message["type"] = msgType
+	message["action"] = action
+	if muteTime > 0 {
+		message["muteTime"] = int64(muteTime / time.Millisecond)
+	}
+	this.sendMessage("rateLimited", message)
 }
 
 // 心跳包
@@ -164,46 +273,41 @@ func (this *Player) onHeartBeat(data string) {
 }
 
 // 登陆
-func (this *Player) onLogin(userToken string) {
+func (this *Player) onLogin(ctx context.Context, userToken string) {
 	log.Println("Player.onLogin: ", userToken)
 	if userToken == "" {
 		this.loginResponse(1, "invalid token1")
 		return
 	}
 
-	tokenArr := strings.Split(userToken, ":")
-	var userId int
-	var err error
-	if userId, err = strconv.Atoi(tokenArr[0]); err != nil {
+	// 按配置的方式校验token
+	userId, err := this.facade.auth.Authenticate(ctx, userToken)
+	if err != nil {
+		log.Println("Player.onLogin: ", err)
 		this.loginResponse(1, "invalid token2")
 		return
 	}
 
-	if userId == 0 {
-		this.loginResponse(1, "invalid token3")
-		return
-	}
-
-	// 使用token进行登录, 从数据库取出token进行校验
-	sessionModel := model.NewSessionModel(int32(userId))
-	if sessionModel.GetToken() != userToken {
-		this.loginResponse(1, "invalid token4")
-		return
-	}
+	this.loginOk(ctx, userId, userToken)
+}
 
+// 登陆校验通过
+func (this *Player) loginOk(ctx context.Context, userId int, userToken string) {
 	this.userToken = userToken
 	this.userId = userId
+	ctx = WithUserId(ctx, userId)
 
-	// 登陆成功, 把自己记录到Session中
-	response := this.protocol.call(this.sessionRH, Session_GetPlayer, this.userId)
-	if response != nil {
+	// 登陆成功, 把自己登记到注册表中
+	playerRH := this.registry.Register(KindPlayer, this.userId, this.rh)
+	if playerRH != nil && !playerRH.Destroyed() {
 		// 已经在别处登陆了,踢下线
-		playerRH := response.(*RoutineHandle)
-		if playerRH != nil && !playerRH.destroyed {
-			this.protocol.call(playerRH, Player_Kickout, nil)
-		}
+		this.protocol.CallCtx(ctx, playerRH, Player_Kickout, nil)
+	}
+
+	// 允许断线重连时发放重连token
+	if this.facade.config.playerResumeGrace > 0 {
+		this.newResumeToken()
 	}
-	this.protocol.call(this.sessionRH, Session_AddPlayer, []interface{}{this.userId, this.rh})
 
 	// 发送登陆成功消息
 	this.loginResponse(0, "ok")
@@ -213,70 +317,68 @@ func (this *Player) loginResponse(code int, message string) {
 	response := make(map[string]interface{})
 	response["code"] = code
 	response["message"] = message
+	if code == 0 && this.resumeToken != "" {
+		response["resumeToken"] = this.resumeToken
+	}
 	this.sendMessage("login", response)
 }
 
-func (this *Player) onLogout() {
+func (this *Player) onLogout(ctx context.Context, params interface{}) (interface{}, error) {
 	log.Println("Player.onLogout", this.userId)
-	defer func() {
-		this.rh.callC <- nil
-	}()
 
 	if this.userId > 0 {
 		// 从当前game房间退出
-		if this.GameRH != nil && !this.GameRH.destroyed {
-			this.protocol.call(this.GameRH, Game_Leave, this.userId)
+		if this.GameRH != nil && !this.GameRH.Destroyed() {
+			this.protocol.CallCtx(ctx, this.GameRH, Game_Leave, this.userId)
 			this.GameRH = nil
 		}
 
-		// 清除自己的所有订阅消息
-		this.protocol.call(this.sessionRH, Session_ClearGameSubs, this.userId)
-
-		// 从会话管理器删除自己
-		if !this.isKickout {
-			this.protocol.call(this.sessionRH, Session_RemovePlayer, this.userId)
-		}
 	}
 
-	// 清理资源
-	this.rh.destroy()
+	// 清理资源, 进程退出后自动从注册表删除并清除所有订阅消息
+	this.rh.Stop()
+	return nil, nil
 }
 
-func (this *Player) onKickout() {
+func (this *Player) onKickout(ctx context.Context, params interface{}) (interface{}, error) {
 	log.Println("Player.onKickout: ", this.userId)
-	defer func() {
-		this.rh.callC <- nil
-	}()
-
-	// 从会话管理器删除自己
-	this.protocol.call(this.sessionRH, Session_RemovePlayer, this.userId)
 
+	// 新登陆的进程已经替换了注册表中的自己
 	this.isKickout = true
-	this.ws.Write([]byte{'k', 'i', 'c', 'k', 'o', 'u', 't'})
+
+	// 断线等待重连时直接登出
+	if this.ws == nil {
+		return this.onLogout(ctx, nil)
+	}
+	this.ws.Send("kickout")
 	this.ws.Close()
+	return nil, nil
 }
 
-func (this *Player) onGetToken() {
+func (this *Player) onGetToken(ctx context.Context, params interface{}) (interface{}, error) {
 	log.Println("Player.onGetToken: ", this.userToken)
 
-	this.rh.callC <- this.userToken
+	return this.userToken, nil
 }
 
-func (this *Player) onControlGame(params map[string]interface{}) {
-	controlType := params["controlType"].(string)
+func (this *Player) onControlGame(ctx context.Context, params map[string]interface{}) {
+	controlType, _ := params["controlType"].(string)
 	log.Println("Player.onControlGame: ", controlType)
+	if controlType == "" {
+		return
+	}
 
 	// 给game发送指令
-	if this.GameRH == nil || this.GameRH.destroyed {
+	if this.GameRH == nil || this.GameRH.Destroyed() {
 		log.Println("Player.onControlGame: not in Game's room!")
 		return
 	}
 
-	this.protocol.call(this.GameRH, Game_Control, []interface{}{controlType, this.userId})
+	this.protocol.CallCtx(ctx, this.GameRH, Game_Control, &GameControlReq{ControlType: controlType, PlayerId: this.userId})
 }
 
 // 加入game房间
-func (this *Player) onJoinGameRoom(deviceName string) {
+func (this *Player) onJoinGameRoom(ctx context.Context, deviceName string) {
 	log.Println("Player.onJoinGameRoom: ", deviceName)
 
 	this.GameRH = this.getGameRH(deviceName)
@@ -285,23 +387,23 @@ func (this *Player) onJoinGameRoom(deviceName string) {
 	}
 
 	// 加入房间
-	this.protocol.call(this.GameRH, Game_Join, []interface{}{this.userId, this.rh})
+	this.protocol.CallCtx(ctx, this.GameRH, Game_Join, &GameJoinReq{this.userId, this.rh})
 }
 
 // 离开game房间
-func (this *Player) onLeaveGameRoom(deviceName string) {
+func (this *Player) onLeaveGameRoom(ctx context.Context, deviceName string) {
 	log.Println("Player.onLeaveGameRoom: ", deviceName)
 
-	if this.GameRH == nil || this.GameRH.destroyed {
+	if this.GameRH == nil || this.GameRH.Destroyed() {
 		log.Println("leave but not in room ", deviceName)
 		return
 	}
 
 	// 离开房间
-	this.protocol.call(this.GameRH, Game_Leave, this.userId)
+	this.protocol.CallCtx(ctx, this.GameRH, Game_Leave, this.userId)
 }
 
-func (this *Player) onWatchGameRooms(deviceNames []interface{}) {
+func (this *Player) onWatchGameRooms(ctx context.Context, deviceNames []interface{}) {
 	//log.Println("Player.onWatchGameRooms: ", deviceNames)
 
 	// 计算出真正的新增列表,之前不在已有列表中的才算
@@ -326,16 +428,16 @@ func (this *Player) onWatchGameRooms(deviceNames []interface{}) {
 	this.watchGames = append(this.watchGames, newSubList...)
 
 	// 增加到Sessiongame观察列表
-	this.protocol.call(this.sessionRH, Session_AddGameSubs, []interface{}{this.userId, newSubList})
+	this.protocol.CallCtx(ctx, this.sessionRH, Session_AddGameSubs, &SessionGameSubsReq{this.userId, newSubList})
 }
 
-func (this *Player) onUnwatchGameRooms(deviceNames []interface{}) {
+func (this *Player) onUnwatchGameRooms(ctx context.Context, deviceNames []interface{}) {
 	//log.Println("Player.onUnwatchGameRooms: ", deviceNames)
 
 	// 计算出真正的移除列表,之前已在列表中的才算
 	removeSubList := make([]string, 0, len(deviceNames))
 	for _, v := range deviceNames {
-		deviceName := v.(string)
+		deviceName, _ := v.(string)
 
 		exist := false
 		for _, existName := range this.watchGames {
@@ -368,31 +470,28 @@ func (this *Player) onUnwatchGameRooms(deviceNames []interface{}) {
 	this.watchGames = newSubList
 
 	// 删除Session中的订阅信息
-	this.protocol.call(this.sessionRH, Session_RemoveGameSubs, []interface{}{this.userId, removeSubList})
+	this.protocol.CallCtx(ctx, this.sessionRH, Session_RemoveGameSubs, &SessionGameSubsReq{this.userId, removeSubList})
 }
 
-func (this *Player) onBroadcastMessage(message string) {
+func (this *Player) onBroadcastMessage(ctx context.Context, message string) {
 	log.Println("Player.onBroadcastMessage: ", message)
 
-	if this.GameRH == nil || this.GameRH.destroyed {
+	if this.GameRH == nil || this.GameRH.Destroyed() {
 		log.Println("broadcast message but not in room ")
 		return
 	}
 
-	// 广播消息
-	this.protocol.call(this.GameRH, Game_BroadcastMessage, message)
+	// 广播消息, 被审核拒绝时告诉客户端原因
+	ret, err := this.protocol.CallCtx(ctx, this.GameRH, Game_BroadcastMessage, &GameBroadcastReq{this.userId, message})
+	if err == nil && ret != "ok" {
+		this.sendMessage("chatRejected", ret)
+	}
 }
 
 // 获取game的RoutineHandle
 func (this *Player) getGameRH(deviceName string) *RoutineHandle {
-	resp := this.protocol.call(this.sessionRH, Session_GetGame, deviceName)
-	if resp == nil {
-		log.Println("room not exist: ", deviceName)
-		this.sendGameStatus(deviceName, "error")
-		return nil
-	}
-	GameRH := resp.(*RoutineHandle)
-	if GameRH == nil || GameRH.destroyed {
+	GameRH := this.registry.Lookup(KindGame, deviceName)
+	if GameRH == nil {
 		log.Println("room not exist: ", deviceName)
 		this.sendGameStatus(deviceName, "error")
 		return nil
@@ -401,8 +500,8 @@ func (this *Player) getGameRH(deviceName string) *RoutineHandle {
 	return GameRH
 }
 
-func (this *Player) onSendMessage(message interface{}) {
-	websocket.Message.Send(this.ws, message)
+func (this *Player) onSendMessage(ctx context.Context, params interface{}) (interface{}, error) {
+	return nil, this.send(params.(string))
 }
 
 // 发送game状态消息
@@ -420,5 +519,112 @@ func (this *Player) sendMessage(msgType string, data interface{}) {
 	msgObj["data"] = data
 	message, _ := json.Marshal(msgObj)
 
-	websocket.Message.Send(this.ws, string(message))
+	this.send(string(message))
+}
+
+// 发送消息到客户端, 断线等待重连时缓存起来
+func (this *Player) send(message string) error {
+	if this.ws != nil {
+		return this.ws.Send(message)
+	}
+
+	this.resumeBuffer = append(this.resumeBuffer, message)
+	if size := this.facade.config.playerResumeBuffer; len(this.resumeBuffer) > size {
+		this.resumeDropped += len(this.resumeBuffer) - size
+		this.resumeBuffer = this.resumeBuffer[len(this.resumeBuffer)-size:]
+	}
+	return nil
+}
+
+func (this *Player) setWs(ws Conn) {
+	this.wsLock.Lock()
+	defer this.wsLock.Unlock()
+	this.ws = ws
+}
+
+// 当前连接, 可以在其他goroutine中调用
+func (this *Player) currentWs() Conn {
+	this.wsLock.Lock()
+	defer this.wsLock.Unlock()
+	return this.ws
+}
+
+//////////////////////////////////////////////////////////
+// 断线重连
+
+// 发放新的重连token, 旧的token失效
+func (this *Player) newResumeToken() {
+	if this.resumeToken != "" {
+		this.registry.Unregister(KindResume, this.resumeToken, this.rh)
+	}
+	this.resumeToken = newTraceId(16)
+	this.registry.Register(KindResume, this.resumeToken, this.rh)
+}
+
+// 连接断开, 登陆过的玩家保留进程, 房间和订阅等待重连, 超时后登出
+func (this *Player) onDisconnect(ctx context.Context, params interface{}) (interface{}, error) {
+	// 已经重连到新的连接, 旧连接断开不处理
+	req := params.(*PlayerDisconnectReq)
+	if req.Ws != this.ws {
+		return nil, nil
+	}
+
+	grace := this.facade.config.playerResumeGrace
+	if this.userId == 0 || this.isKickout || this.isFlooded || grace <= 0 {
+		return this.onLogout(ctx, nil)
+	}
+
+	log.Println("Player.onDisconnect: 等待重连", this.userId)
+	this.setWs(nil)
+	this.resumeSeq++
+	this.protocol.castAfter(this.rh, grace, Player_ResumeTimeout, this.resumeSeq)
+	return nil, nil
+}
+
+// 客户端使用重连token重新连接, 换成新的连接并补发断线期间的消息
+func (this *Player) onResume(ctx context.Context, params interface{}) (interface{}, error) {
+	req := params.(*PlayerResumeReq)
+	if req.Token == "" || req.Token != this.resumeToken || this.isKickout || this.isFlooded {
+		return nil, ErrResumeRejected
+	}
+	log.Println("Player.onResume: ", this.userId)
+
+	// 旧连接还没有检测到断开
+	if this.ws != nil {
+		this.ws.Close()
+	}
+	this.setWs(req.Ws)
+	this.resumeSeq++
+	this.newResumeToken()
+	this.resumeResponse(0, "ok")
+
+	buffer := this.resumeBuffer
+	this.resumeBuffer = make([]string, 0)
+	this.resumeDropped = 0
+	for _, message := range buffer {
+		this.send(message)
+	}
+	return nil, nil
+}
+
+func (this *Player) resumeResponse(code int, message string) {
+	response := make(map[string]interface{})
+	response["code"] = code
+	response["message"] = message
+	if code == 0 {
+		response["userId"] = this.userId
+		response["resumeToken"] = this.resumeToken
+		response["buffered"] = len(this.resumeBuffer)
+		response["dropped"] = this.resumeDropped
+	}
+	this.sendMessage("resume", response)
+}
+
+// 没有按时重连, 登出
+func (this *Player) onResumeTimeout(ctx context.Context, params interface{}) (interface{}, error) {
+	if params.(int) != this.resumeSeq || this.ws != nil {
+		return nil, nil
+	}
+	log.Println("Player.onResumeTimeout: ", this.userId)
+	return this.onLogout(ctx, nil)
 }
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// 登陆的玩家加入dev1房间并观察dev2, 返回重连token
+func joinAndWatch(h *Harness, player *Player, conn *FakeConn) string {
+	h.PlayerSend(player.rh, "joinGameRoom", "dev1")
+	h.PlayerSend(player.rh, "watchGameRooms", []interface{}{"dev2"})
+	return conn.Last("login").(map[string]interface{})["resumeToken"].(string)
+}
+
+func TestPlayerResume(t *testing.T) {
+	h := NewHarness(t)
+	gameRH, _ := h.NewGame()
+	h.DeviceSend(gameRH, "login", "dev1:token")
+	h.DeviceSend(gameRH, "status", map[string]interface{}{"deviceStatus": "ready", "curPlayer": 0})
+	player, conn := h.NewLoggedInPlayer(7)
+	token := joinAndWatch(h, player, conn)
+	h.Call(gameRH, Game_Control, &GameControlReq{"start", 7, 0})
+
+	// 回合中断线, 结果缓存到重连
+	h.Call(player.rh, Player_Disconnect, &PlayerDisconnectReq{conn})
+	h.Call(gameRH, Game_Control, &GameControlReq{"catch", 7, 0})
+	h.DeviceSend(gameRH, "result", map[string]interface{}{"playResult": "0", "curPlayer": 7})
+	if conn.Last("GameResult") != nil {
+		t.Fatal("GameResult sent to closed connection")
+	}
+
+	newConn := new(FakeConn)
+	if _, err := h.facade.protocol.call(player.rh, Player_Resume, &PlayerResumeReq{"bad", newConn}); !errors.Is(err, ErrResumeRejected) {
+		t.Fatalf("resume with bad token: %v", err)
+	}
+	h.Call(player.rh, Player_Resume, &PlayerResumeReq{token, newConn})
+
+	resume := newConn.Last("resume").(map[string]interface{})
+	if resume["code"].(float64) != 0 || resume["buffered"].(float64) == 0 || resume["resumeToken"] == token {
+		t.Fatalf("resume = %v", resume)
+	}
+	if newConn.Last("GameResult") != "0" || newConn.Last("retryWindow") == nil {
+		t.Fatalf("buffered messages not replayed: GameResult = %v", newConn.Last("GameResult"))
+	}
+	if h.facade.registry.Lookup(KindResume, token) != nil {
+		t.Fatal("old resume token still valid")
+	}
+
+	// 房间和观察保持不变
+	if subs := h.Call(h.facade.sessionRH, Session_GetGameSubs, "dev2").([]int); len(subs) != 1 || subs[0] != 7 {
+		t.Fatalf("subs = %v", subs)
+	}
+	if ret := h.Call(gameRH, Game_Control, &GameControlReq{"noretry", 7, 0}); ret != "ok" {
+		t.Fatalf("noretry = %v", ret)
+	}
+
+	// 旧连接迟到的断开通知不影响新连接
+	h.Call(player.rh, Player_Disconnect, &PlayerDisconnectReq{conn})
+	h.PlayerSend(player.rh, "heartBeat", "ping")
+	if newConn.Last("heartBeat") != "ping" {
+		t.Fatalf("heartBeat = %v", newConn.Last("heartBeat"))
+	}
+}
+
+func TestPlayerResumeTimeout(t *testing.T) {
+	h := NewHarness(t)
+	gameRH, _ := h.NewGame()
+	h.DeviceSend(gameRH, "login", "dev1:token")
+	player, conn := h.NewLoggedInPlayer(7)
+	token := joinAndWatch(h, player, conn)
+	other, otherConn := h.NewLoggedInPlayer(8)
+	h.PlayerSend(other.rh, "joinGameRoom", "dev1")
+
+	// 断线后没有按时重连, 登出并离开房间
+	h.Call(player.rh, Player_Disconnect, &PlayerDisconnectReq{conn})
+	h.Advance(h.facade.config.playerResumeGrace)
+	if !player.rh.Destroyed() {
+		t.Fatal("player not logged out")
+	}
+	leave := otherConn.Last("playerMessage").(map[string]interface{})
+	if leave["type"] != "leave" || leave["data"].(map[string]interface{})["player"].(float64) != 7 {
+		t.Fatalf("playerMessage = %v", leave)
+	}
+	if _, err := h.facade.protocol.call(player.rh, Player_Resume, &PlayerResumeReq{token, new(FakeConn)}); err == nil {
+		t.Fatal("resume after timeout accepted")
+	}
+}
+
+func TestPlayerDisconnectWithoutLogin(t *testing.T) {
+	h := NewHarness(t)
+	rh, conn := h.NewPlayer()
+	h.Call(rh, Player_Disconnect, &PlayerDisconnectReq{conn})
+	if !rh.Destroyed() {
+		t.Fatal("player not logged out")
+	}
+}
+
+// 房间内收到的聊天消息数
+func countChats(conn *FakeConn) int {
+	count := 0
+	for _, message := range conn.Messages("playerMessage") {
+		if message.(map[string]interface{})["type"] == "message" {
+			count++
+		}
+	}
+	return count
+}
+
+func TestPlayerRateLimit(t *testing.T) {
+	h := NewHarness(t)
+	h.facade.config.flood = &FloodConfig{
+		Limits:          map[string]*RateLimit{"broadcastMessage": {Rate: 1, Burst: 2}, "controlGame": {Rate: 1, Burst: 1}},
+		WarnAfter:       1,
+		MuteAfter:       2,
+		DisconnectAfter: 4,
+		MuteTime:        5 * time.Second,
+		MuteTypes:       map[string]bool{"broadcastMessage": true},
+		ThrottleTypes:   map[string]bool{"controlGame": true},
+		Window:          time.Minute,
+	}
+	gameRH, deviceConn := h.NewGame()
+	h.DeviceSend(gameRH, "login", "dev1:token")
+	h.DeviceSend(gameRH, "status", map[string]interface{}{"deviceStatus": "ready", "curPlayer": 0})
+	player, conn := h.NewLoggedInPlayer(7)
+	listener, listenerConn := h.NewLoggedInPlayer(8)
+	h.PlayerSend(player.rh, "joinGameRoom", "dev1")
+	h.PlayerSend(listener.rh, "joinGameRoom", "dev1")
+	h.Call(gameRH, Game_Control, &GameControlReq{"start", 7, 0})
+
+	// 超过容量的聊天不转发, 第一次警告, 第二次禁言
+	for i := 0; i < 4; i++ {
+		h.PlayerSend(player.rh, "broadcastMessage", "hi")
+	}
+	if chats := countChats(listenerConn); chats != 2 {
+		t.Fatalf("forwarded chats = %d", chats)
+	}
+	limited := conn.Messages("rateLimited")
+	if len(limited) != 2 || limited[0].(map[string]interface{})["action"] != "warn" ||
+		limited[1].(map[string]interface{})["muteTime"].(float64) != 5000 {
+		t.Fatalf("rateLimited = %v", limited)
+	}
+
+	// 禁言期间有令牌也不处理, 心跳不受影响
+	h.Advance(2 * time.Second)
+	h.PlayerSend(player.rh, "broadcastMessage", "hi")
+	h.PlayerSend(player.rh, "heartBeat", "ping")
+	if countChats(listenerConn) != 2 || conn.Last("heartBeat") != "ping" {
+		t.Fatal("muted player chat forwarded")
+	}
+
+	// 禁言不影响游戏控制, 控制太快只丢弃, 不警告也不断开
+	controls := len(deviceConn.Messages("control"))
+	for i := 0; i < 6; i++ {
+		h.PlayerSend(player.rh, "controlGame", map[string]interface{}{"controlType": "left"})
+	}
+	if len(deviceConn.Messages("control")) != controls+1 || len(conn.Messages("rateLimited")) != 2 || conn.Closed() {
+		t.Fatalf("controls while muted = %d", len(deviceConn.Messages("control"))-controls)
+	}
+
+	// 禁言结束后恢复
+	h.Advance(5 * time.Second)
+	h.PlayerSend(player.rh, "broadcastMessage", "hi")
+	if countChats(listenerConn) != 3 {
+		t.Fatal("chat not restored after mute")
+	}
+
+	// 继续刷屏断开连接, 不能重连
+	for i := 0; i < 4; i++ {
+		h.PlayerSend(player.rh, "broadcastMessage", "hi")
+	}
+	if !conn.Closed() {
+		t.Fatal("flooding player not disconnected")
+	}
+	token := conn.Last("login").(map[string]interface{})["resumeToken"].(string)
+	h.Call(player.rh, Player_Disconnect, &PlayerDisconnectReq{conn})
+	if !player.rh.Destroyed() || h.facade.registry.Lookup(KindResume, token) != nil {
+		t.Fatal("flooding player not logged out")
+	}
+}
+
+func TestPlayerChatModeration(t *testing.T) {
+	h := NewHarness(t)
+	h.facade.chat.SetSlowMode("dev1", 3*time.Second)
+	gameRH, _ := h.NewGame()
+	h.DeviceSend(gameRH, "login", "dev1:token")
+	player, conn := h.NewLoggedInPlayer(7)
+	listener, listenerConn := h.NewLoggedInPlayer(8)
+	h.PlayerSend(player.rh, "joinGameRoom", "dev1")
+	h.PlayerSend(listener.rh, "joinGameRoom", "dev1")
+
+	// 去掉链接后广播, 记录原文
+	h.PlayerSend(player.rh, "broadcastMessage", "hi http://spam.example")
+	if countChats(listenerConn) != 1 {
+		t.Fatal("chat not forwarded")
+	}
+	if entries := h.facade.audit.Recent(1); entries[0].Action != "chatFiltered" || entries[0].Detail != "hi http://spam.example" {
+		t.Fatalf("audit = %+v", entries[0])
+	}
+
+	// 慢速模式
+	h.PlayerSend(player.rh, "broadcastMessage", "again")
+	if countChats(listenerConn) != 1 || conn.Last("chatRejected") != "slow mode" {
+		t.Fatalf("chatRejected = %v", conn.Last("chatRejected"))
+	}
+
+	// 房间禁言
+	h.Advance(3 * time.Second)
+	h.facade.chat.Mute(&ChatMute{DeviceName: "dev1", PlayerId: 7})
+	h.PlayerSend(player.rh, "broadcastMessage", "again")
+	if countChats(listenerConn) != 1 || conn.Last("chatRejected") != "muted" {
+		t.Fatalf("chatRejected = %v", conn.Last("chatRejected"))
+	}
+	h.facade.chat.Unmute("dev1", 7)
+	h.PlayerSend(player.rh, "broadcastMessage", "again")
+	if countChats(listenerConn) != 2 {
+		t.Fatal("chat not forwarded after unmute")
+	}
+}
+
+// 格式错误的消息返回错误, 不能让进程崩溃
+func TestPlayerMalformedMessages(t *testing.T) {
+	h := NewHarness(t)
+	gameRH, _ := h.NewGame()
+	h.DeviceSend(gameRH, "login", "dev1:token")
+	player, conn := h.NewLoggedInPlayer(7)
+	h.PlayerSend(player.rh, "joinGameRoom", "dev1")
+
+	bad := []string{
+		`[]`,
+		`{"type": 5}`,
+		`{"data": "dev1"}`,
+		`{"type": "joinGameRoom", "data": 5}`,
+		`{"type": "controlGame", "data": "start"}`,
+		`{"type": "watchGameRooms", "data": {}}`,
+		`{"type": "broadcastMessage"}`,
+	}
+	for _, message := range bad {
+		if _, err := h.facade.protocol.call(player.rh, Player_RecvMessage, message); !errors.Is(err, ErrBadParams) {
+			t.Fatalf("%s: err = %v", message, err)
+		}
+	}
+	for _, message := range []string{`{"type": "controlGame", "data": {"controlType": 5}}`, `{"type": "unwatchGameRooms", "data": [5]}`} {
+		if _, err := h.facade.protocol.call(player.rh, Player_RecvMessage, message); err != nil {
+			t.Fatalf("%s: err = %v", message, err)
+		}
+	}
+
+	// 进程没有重启, 登陆和房间状态还在
+	h.PlayerSend(player.rh, "heartBeat", "ping")
+	if conn.Last("heartBeat") != "ping" || player.userId != 7 || player.GameRH != gameRH {
+		t.Fatal("player state lost")
+	}
+}
+
+// 被踢下线后重新登陆, game订阅不重复
+func TestPlayerKickoutResubscribe(t *testing.T) {
+	h := NewHarness(t)
+	old, oldConn := h.NewLoggedInPlayer(7)
+	h.PlayerSend(old.rh, "watchGameRooms", []interface{}{"dev1", "dev2"})
+
+	player, _ := h.NewLoggedInPlayer(7)
+	h.Settle()
+	if !oldConn.Closed() {
+		t.Fatal("old player not kicked out")
+	}
+	h.PlayerSend(player.rh, "watchGameRooms", []interface{}{"dev1"})
+	h.Settle()
+
+	for _, deviceName := range []string{"dev1", "dev2"} {
+		if subs := h.Call(h.facade.sessionRH, Session_GetGameSubs, deviceName).([]int); len(subs) != 1 || subs[0] != 7 {
+			t.Fatalf("%s subs = %v", deviceName, subs)
+		}
+	}
+}
@@ -1,73 +1,632 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"reflect"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// 进程调用错误
+var (
+	ErrUnknownCommand = errors.New("unknown command")
+	ErrBadParams      = errors.New("bad params")
+	ErrHandlerPanic   = errors.New("handler panic")
+	ErrTimeout        = errors.New("call timeout")
+	ErrDestroyed      = errors.New("routine destroyed")
+	ErrMailboxFull    = errors.New("mailbox full")
+)
+
+// 同步调用的默认超时时间, ctx没有设置deadline时使用
+const defaultCallTimeout = 500 * time.Millisecond
+
+// 同步调用的状态
+const (
+	callPending   int32 = iota // 等待处理
+	callReplied                // 已返回结果
+	callAbandoned              // 调用方已超时放弃
+)
+
+// 进程间传递的消息信封
+type Envelope struct {
+	Ctx    context.Context
+	Cmd    int16
+	Params interface{}
+
+	// 所在优先级通道和投递时间
+	lane Lane
+	sent time.Time
+	// 投递方协议调用器的时钟, 处理时用同一个时钟计算等待和处理时间
+	clock Clock
+	// 调用链追踪id, 未开启追踪时为空
+	traceId string
+
+	// 同步调用的返回通道, cast时为nil
+	reply chan *Reply
+	state int32
+}
+
+func newCallEnvelope(ctx context.Context, clock Clock, cmd int16, params interface{}) *Envelope {
+	env := newCastEnvelope(ctx, clock, cmd, params)
+	env.reply = make(chan *Reply, 1)
+	return env
+}
+
+func newCastEnvelope(ctx context.Context, clock Clock, cmd int16, params interface{}) *Envelope {
+	return &Envelope{Ctx: ctx, Cmd: cmd, Params: params, lane: commandLane(cmd), sent: clock.Now(), clock: clock, traceId: TraceIdFrom(ctx)}
+}
+
+// 进程返回结果, 调用方已经超时放弃的返回false
+func (this *Envelope) answer(reply *Reply) bool {
+	if !atomic.CompareAndSwapInt32(&this.state, callPending, callReplied) {
+		return false
+	}
+	this.reply <- reply
+	return true
+}
+
+// 调用方放弃等待, 进程已经返回的返回false
+func (this *Envelope) abandon() bool {
+	return atomic.CompareAndSwapInt32(&this.state, callPending, callAbandoned)
+}
+
+// 同步调用的返回结果
+type Reply struct {
+	Data interface{}
+	Err  error
+}
+
+// 命令处理函数, 返回值作为call的返回结果, cast时返回值被忽略
+// ctx携带调用方的请求信息(请求id, 玩家id, 设备名等), 处理函数内的嵌套调用应继续传递
+type Handler func(ctx context.Context, params interface{}) (interface{}, error)
+
+// 命令描述
+type commandSpec struct {
+	name      string
+	paramType reflect.Type // 参数类型, nil表示该命令不需要参数
+	lane      Lane         // 投递的优先级通道
+}
+
+// 全局命令表, 各进程在init中注册自己的命令
+var commandSpecs = make(map[int16]*commandSpec)
+
+// 注册命令, params为参数类型的零值, 无参数的命令传nil
+func RegisterCommand(cmd int16, name string, params interface{}) {
+	if _, ok := commandSpecs[cmd]; ok {
+		panic(fmt.Sprintf("command %d already registered", cmd))
+	}
+	commandSpecs[cmd] = &commandSpec{name: name, paramType: reflect.TypeOf(params), lane: LaneNormal}
+}
+
+// 设置命令的优先级通道, 需要在RegisterCommand之后调用
+func SetCommandLane(cmd int16, lane Lane) {
+	spec, ok := commandSpecs[cmd]
+	if !ok {
+		panic(fmt.Sprintf("command %d not registered", cmd))
+	}
+	spec.lane = lane
+}
+
+// 获取命令的优先级通道
+func commandLane(cmd int16) Lane {
+	if spec, ok := commandSpecs[cmd]; ok {
+		return spec.lane
+	}
+	return LaneNormal
+}
+
+// 获取命令名称, 用于日志
+func commandName(cmd int16) string {
+	if spec, ok := commandSpecs[cmd]; ok {
+		return spec.name
+	}
+	return fmt.Sprintf("cmd(%d)", cmd)
+}
+
+// 校验命令参数类型
+func checkParams(cmd int16, params interface{}) error {
+	spec, ok := commandSpecs[cmd]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownCommand, cmd)
+	}
+	if reflect.TypeOf(params) != spec.paramType {
+		return fmt.Errorf("%w: %s want %v, got %T", ErrBadParams, spec.name, spec.paramType, params)
+	}
+	return nil
+}
+
+// 邮箱溢出策略
+type OverflowPolicy int
+
+const (
+	OverflowBlock      OverflowPolicy = iota // 阻塞等待, 超过blockTimeout返回ErrMailboxFull
+	OverflowDropOldest                       // 丢弃最早的消息
+	OverflowDropNewest                       // 丢弃新消息
+	OverflowDisconnect                       // 丢弃新消息并断开慢消费者
+)
+
+var overflowPolicyNames = map[string]OverflowPolicy{
+	"block":      OverflowBlock,
+	"dropOldest": OverflowDropOldest,
+	"dropNewest": OverflowDropNewest,
+	"disconnect": OverflowDisconnect,
+}
+
+// 根据名称解析溢出策略
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	if policy, ok := overflowPolicyNames[name]; ok {
+		return policy, nil
+	}
+	return OverflowBlock, fmt.Errorf("unknown overflow policy: %s", name)
+}
+
+// 进程邮箱配置
+type MailboxConfig struct {
+	Size         int            // castC缓冲大小
+	Policy       OverflowPolicy // 溢出策略
+	BlockTimeout time.Duration  // OverflowBlock的最长等待时间, 0表示一直等待
+}
+
+// 缺省邮箱配置
+var defaultMailboxConfig = &MailboxConfig{Size: 512, Policy: OverflowBlock, BlockTimeout: 500 * time.Millisecond}
+
+// 邮箱溢出统计, 按进程类型汇总
+var mailboxStats = struct {
+	sync.Mutex
+	dropped      map[string]int64
+	disconnected map[string]int64
+}{dropped: make(map[string]int64), disconnected: make(map[string]int64)}
+
+// 获取邮箱溢出统计, 用于监控
+func MailboxStats() map[string]interface{} {
+	mailboxStats.Lock()
+	defer mailboxStats.Unlock()
+
+	stats := make(map[string]interface{})
+	for name, count := range mailboxStats.dropped {
+		stats[name] = map[string]int64{"dropped": count, "disconnected": mailboxStats.disconnected[name]}
+	}
+	return stats
+}
+
 // 进程handle
 type RoutineHandle struct {
-	destroyed bool
-	callC     chan interface{} // 用于同步调用进程的channel
-	castC     chan interface{} // 用于异步调用进程的channel
+	destroyed int32
+	// 各优先级通道的邮箱
+	lanes [laneCount]*mailboxLane
+
+	stopC    chan struct{} // 关闭时通知进程停止
+	done     chan struct{} // 进程退出后关闭
+	stopOnce sync.Once
+	doneOnce sync.Once
+
+	// 进程类型名称, 用于日志和统计
+	name string
+	// 邮箱配置
+	mailbox *MailboxConfig
+	// 邮箱溢出并且策略为OverflowDisconnect时调用
+	onOverflow func()
+
+	// 命令处理函数表
+	handlers map[int16]Handler
+
+	// 调用方超时后才返回而被丢弃的结果数
+	lateReplies int64
+	// 邮箱溢出丢弃的消息数
+	dropped int64
+
+	// 手动模式下由监督者设置, 在调用方goroutine中处理消息, 用于测试时确定性地推进进程
+	inline func(env *Envelope)
 }
 
-func NewRoutineHandle() *RoutineHandle {
+func NewRoutineHandle(name string, mailbox *MailboxConfig) *RoutineHandle {
+	if mailbox == nil {
+		mailbox = defaultMailboxConfig
+	}
+
 	this := new(RoutineHandle)
-	this.callC = make(chan interface{})
-	this.castC = make(chan interface{}, 512)
+	this.name = name
+	this.mailbox = mailbox
+	for i := range this.lanes {
+		this.lanes[i] = newMailboxLane(mailbox.Size)
+	}
+	this.stopC = make(chan struct{})
+	this.done = make(chan struct{})
+	this.handlers = make(map[int16]Handler)
 	return this
 }
 
-func (this *RoutineHandle) destroy() {
-	if this.destroyed {
+// 停止进程, 不再接收新消息, 进程处理完已投递的异步消息后退出
+func (this *RoutineHandle) Stop() {
+	this.stopOnce.Do(func() {
+		atomic.StoreInt32(&this.destroyed, 1)
+		close(this.stopC)
+	})
+}
+
+// 进程是否已停止
+func (this *RoutineHandle) Destroyed() bool {
+	return atomic.LoadInt32(&this.destroyed) == 1
+}
+
+// 进程退出后关闭的channel
+func (this *RoutineHandle) Done() <-chan struct{} {
+	return this.done
+}
+
+// 标记进程已退出
+func (this *RoutineHandle) exit() {
+	this.doneOnce.Do(func() {
+		close(this.done)
+	})
+}
+
+// 被丢弃的超时返回结果数
+func (this *RoutineHandle) LateReplies() int64 {
+	return atomic.LoadInt64(&this.lateReplies)
+}
+
+// 邮箱溢出丢弃的消息数
+func (this *RoutineHandle) Dropped() int64 {
+	return atomic.LoadInt64(&this.dropped)
+}
+
+// 设置慢消费者断开处理, 需要在进程启动前调用
+func (this *RoutineHandle) setOnOverflow(onOverflow func()) {
+	this.onOverflow = onOverflow
+}
+
+// 记录一次丢弃的消息
+func (this *RoutineHandle) drop(env *Envelope) {
+	atomic.AddInt64(&this.dropped, 1)
+
+	mailboxStats.Lock()
+	mailboxStats.dropped[this.name]++
+	mailboxStats.Unlock()
+
+	log.Println(this.name, "邮箱已满, 丢弃消息: ", commandName(env.Cmd))
+}
+
+// 投递异步消息, 邮箱满时按溢出策略处理, OverflowBlock的等待时间由投递方的时钟控制
+func (this *RoutineHandle) post(ctx context.Context, env *Envelope) error {
+	castC := this.lanes[env.lane].castC
+
+	// 邮箱未满直接投递
+	select {
+	case castC <- env:
+		return nil
+	default:
+	}
+
+	switch this.mailbox.Policy {
+	case OverflowDropOldest:
+		for {
+			select {
+			case castC <- env:
+				return nil
+			default:
+			}
+			select {
+			case old := <-castC:
+				this.drop(old)
+			default:
+			}
+		}
+	case OverflowDropNewest:
+		this.drop(env)
+		return fmt.Errorf("%w: %s", ErrMailboxFull, commandName(env.Cmd))
+	case OverflowDisconnect:
+		this.drop(env)
+		mailboxStats.Lock()
+		mailboxStats.disconnected[this.name]++
+		mailboxStats.Unlock()
+		if this.onOverflow != nil {
+			log.Println(this.name, "邮箱已满, 断开慢消费者")
+			this.onOverflow()
+		}
+		return fmt.Errorf("%w: %s", ErrMailboxFull, commandName(env.Cmd))
+	default:
+		var timeoutC <-chan time.Time
+		if this.mailbox.BlockTimeout > 0 {
+			timeoutC = env.clock.After(this.mailbox.BlockTimeout)
+		}
+		select {
+		case castC <- env:
+			return nil
+		case <-this.stopC:
+			return fmt.Errorf("%w: %s", ErrDestroyed, commandName(env.Cmd))
+		case <-timeoutC:
+			this.drop(env)
+			return fmt.Errorf("%w: %s: block timeout", ErrMailboxFull, commandName(env.Cmd))
+		case <-ctx.Done():
+			this.drop(env)
+			return fmt.Errorf("%w: %s: %v", ErrMailboxFull, commandName(env.Cmd), ctx.Err())
+		}
+	}
+}
+
+// 注册命令处理函数, 需要在进程启动前调用
+func (this *RoutineHandle) handle(cmd int16, handler Handler) {
+	if _, ok := commandSpecs[cmd]; !ok {
+		panic(fmt.Sprintf("command %d not registered", cmd))
+	}
+	this.handlers[cmd] = handler
+}
+
+// 分发消息到对应的处理函数
+func (this *RoutineHandle) dispatch(env *Envelope) (interface{}, error) {
+	handler, ok := this.handlers[env.Cmd]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCommand, commandName(env.Cmd))
+	}
+	if err := checkParams(env.Cmd, env.Params); err != nil {
+		return nil, err
+	}
+	ctx := env.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return handler(ctx, env.Params)
+}
+
+// 处理一条消息, 处理函数崩溃时先给调用方返回错误, 再继续抛出由监督者处理
+func (this *RoutineHandle) process(env *Envelope) {
+	kind := SpanKindServer
+	if env.reply == nil {
+		kind = SpanKindConsumer
+	}
+	ctx, span := StartSpan(env.Ctx, "handle "+commandName(env.Cmd), kind)
+	env.Ctx = ctx
+	span.SetAttribute("actor", this.name)
+	span.SetAttribute("lane", env.lane.String())
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println(this.name, "命令处理崩溃: ", commandName(env.Cmd), env.traceId, r)
+			log.Printf("%s", debug.Stack())
+			err := fmt.Errorf("%w: %s: %v", ErrHandlerPanic, commandName(env.Cmd), r)
+			span.Finish(err)
+			this.reply(env, nil, err)
+			panic(r)
+		}
+	}()
+
+	start := env.clock.Now()
+	span.SetAttribute("wait.ms", float64(start.Sub(env.sent))/float64(time.Millisecond))
+	ret, err := this.dispatch(env)
+	recordLaneLatency(this.name, env.lane, start.Sub(env.sent), env.clock.Now().Sub(start))
+	span.Finish(err)
+	this.reply(env, ret, err)
+}
+
+// 返回处理结果, cast的错误只记录日志
+func (this *RoutineHandle) reply(env *Envelope, ret interface{}, err error) {
+	if env.reply == nil {
+		if err != nil {
+			log.Println(this.name, "处理异步命令出错: ", env.traceId, err)
+		}
 		return
 	}
-	//close(this.callC)
-	//close(this.castC)
-	this.destroyed = true
+
+	if !env.answer(&Reply{ret, err}) {
+		atomic.AddInt64(&this.lateReplies, 1)
+		log.Println(this.name, "调用方已超时, 丢弃返回结果: ", commandName(env.Cmd), env.traceId)
+	}
+}
+
+// 进程消息循环, 由各进程的run调用, 进程停止后返回
+func (this *RoutineHandle) loop() {
+	control := this.lanes[LaneControl]
+	normal := this.lanes[LaneNormal]
+
+	for !this.Destroyed() {
+		// 优先处理控制通道的消息
+		select {
+		case env := <-control.callC:
+			this.process(env)
+			continue
+		case env := <-control.castC:
+			this.process(env)
+			continue
+		default:
+		}
+
+		select {
+		case env := <-control.callC:
+			this.process(env)
+		case env := <-control.castC:
+			this.process(env)
+		case env := <-normal.callC:
+			this.process(env)
+		case env := <-normal.castC:
+			this.process(env)
+		case <-this.stopC:
+		}
+	}
+
+	this.drain()
+	this.exit()
+}
+
+// 手动模式下按优先级处理一条已投递的异步消息, 没有消息时返回false
+func (this *RoutineHandle) step() bool {
+	for _, lane := range this.lanes {
+		select {
+		case env := <-lane.castC:
+			this.inline(env)
+			return true
+		default:
+		}
+	}
+	return false
+}
+
+// 按优先级处理停止前已投递的异步消息
+func (this *RoutineHandle) drain() {
+	for _, lane := range this.lanes {
+		for drained := false; !drained; {
+			select {
+			case env := <-lane.castC:
+				this.process(env)
+			default:
+				drained = true
+			}
+		}
+	}
 }
 
 type Protocol struct {
+	// 调用超时使用的时钟
+	clock Clock
 }
 
-func NewProtocol() *Protocol {
+func NewProtocol(clock Clock) *Protocol {
 	this := new(Protocol)
+	this.clock = clock
 	return this
 }
 
-// 同步调用指定进程,等待返回值,timeout超时时间
-func (this *Protocol) call(handle *RoutineHandle, protocol int16, params interface{}) interface{} {
-	return this.callT(handle, protocol, params, 500)
+// 同步调用指定进程,等待返回值,使用默认超时时间
+func (this *Protocol) call(handle *RoutineHandle, protocol int16, params interface{}) (interface{}, error) {
+	return this.CallCtx(context.Background(), handle, protocol, params)
 }
 
-func (this *Protocol) callT(handle *RoutineHandle, protocol int16, params interface{}, timeout time.Duration) interface{} {
-	if handle.destroyed {
-		log.Println("protocol.Call routine already destroyed: ", protocol, ", ", params)
-		return nil
+// 同步调用指定进程,timeout超时时间
+func (this *Protocol) callT(handle *RoutineHandle, protocol int16, params interface{}, timeout time.Duration) (interface{}, error) {
+	return this.callTimeout(context.Background(), handle, protocol, params, timeout)
+}
+
+// 同步调用指定进程, 受ctx的deadline和取消控制, ctx没有deadline时使用默认超时时间
+func (this *Protocol) CallCtx(ctx context.Context, handle *RoutineHandle, protocol int16, params interface{}) (interface{}, error) {
+	var timeout time.Duration
+	if _, ok := ctx.Deadline(); !ok {
+		timeout = defaultCallTimeout
+	}
+	return this.callTimeout(ctx, handle, protocol, params, timeout)
+}
+
+// 同步调用指定进程, timeout为0时只受ctx控制
+func (this *Protocol) callTimeout(ctx context.Context, handle *RoutineHandle, protocol int16, params interface{}, timeout time.Duration) (interface{}, error) {
+	ctx, span := StartSpan(ctx, "call "+commandName(protocol), SpanKindClient)
+	span.SetAttribute("actor", handle.name)
+	ret, err := this.doCall(ctx, handle, protocol, params, timeout)
+	span.Finish(err)
+	return ret, err
+}
+
+func (this *Protocol) doCall(ctx context.Context, handle *RoutineHandle, protocol int16, params interface{}, timeout time.Duration) (interface{}, error) {
+	if err := checkParams(protocol, params); err != nil {
+		log.Println("protocol.Call ", err)
+		return nil, err
+	}
+
+	if handle.Destroyed() {
+		log.Println("protocol.Call routine already destroyed: ", commandName(protocol), ", ", params)
+		return nil, fmt.Errorf("%w: %s", ErrDestroyed, commandName(protocol))
+	}
+
+	// 超时由时钟控制, 调用方放弃时取消ctx通知处理函数
+	var timeoutC <-chan time.Time
+	if timeout > 0 {
+		timeoutC = this.clock.After(timeout)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	env := newCallEnvelope(ctx, this.clock, protocol, params)
+
+	// 手动模式直接在当前goroutine中处理
+	if handle.inline != nil {
+		handle.inline(env)
+		select {
+		case reply := <-env.reply:
+			return reply.Data, reply.Err
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrDestroyed, commandName(protocol))
+		}
 	}
 
 	select {
-	case handle.callC <- []interface{}{protocol, params}:
-	case <-time.After(timeout * time.Millisecond):
-		return nil
+	case handle.lanes[env.lane].callC <- env:
+	case <-handle.stopC:
+		return nil, fmt.Errorf("%w: %s", ErrDestroyed, commandName(protocol))
+	case <-timeoutC:
+		return nil, fmt.Errorf("%w: %s", ErrTimeout, commandName(protocol))
+	case <-ctx.Done():
+		return nil, ctxError(ctx, protocol)
 	}
 
-	var ret interface{}
+	var reply *Reply
 	select {
-	case ret = <-handle.callC:
-	case <-time.After(timeout * time.Millisecond):
-		log.Println("protocol.Call timeout ret <- ch protocol: ", protocol, ", ", params)
-		return nil
+	case reply = <-env.reply:
+	case <-handle.done:
+		// 进程在返回结果前退出了
+		if env.abandon() {
+			return nil, fmt.Errorf("%w: %s", ErrDestroyed, commandName(protocol))
+		}
+		reply = <-env.reply
+	case <-timeoutC:
+		if env.abandon() {
+			log.Println("protocol.Call timeout ret <- ch protocol: ", commandName(protocol), ", ", params)
+			return nil, fmt.Errorf("%w: %s", ErrTimeout, commandName(protocol))
+		}
+		// 超时的同时进程已经返回了结果
+		reply = <-env.reply
+	case <-ctx.Done():
+		if env.abandon() {
+			log.Println("protocol.Call timeout ret <- ch protocol: ", commandName(protocol), ", ", params)
+			return nil, ctxError(ctx, protocol)
+		}
+		reply = <-env.reply
 	}
-	return ret
+
+	return reply.Data, reply.Err
 }
 
 // 异步调用指定进程,不等待返回值
-func (this *Protocol) cast(handle *RoutineHandle, protocol int16, params interface{}) {
-	if handle.destroyed {
-		log.Println("protocol.Cast routine already destroyed: ", protocol, ", ", params)
-		return
+func (this *Protocol) cast(handle *RoutineHandle, protocol int16, params interface{}) error {
+	return this.CastCtx(context.Background(), handle, protocol, params)
+}
+
+// 异步调用指定进程, 邮箱已满时按进程的溢出策略处理, 无法投递时返回ErrMailboxFull
+func (this *Protocol) CastCtx(ctx context.Context, handle *RoutineHandle, protocol int16, params interface{}) error {
+	ctx, span := StartSpan(ctx, "cast "+commandName(protocol), SpanKindProducer)
+	span.SetAttribute("actor", handle.name)
+	err := this.doCast(ctx, handle, protocol, params)
+	span.Finish(err)
+	return err
+}
+
+func (this *Protocol) doCast(ctx context.Context, handle *RoutineHandle, protocol int16, params interface{}) error {
+	if err := checkParams(protocol, params); err != nil {
+		log.Println("protocol.Cast ", err)
+		return err
+	}
+
+	if handle.Destroyed() {
+		log.Println("protocol.Cast routine already destroyed: ", commandName(protocol), ", ", params)
+		return fmt.Errorf("%w: %s", ErrDestroyed, commandName(protocol))
+	}
+
+	return handle.post(ctx, newCastEnvelope(ctx, this.clock, protocol, params))
+}
+
+// d时间后异步调用指定进程, 用于进程内的定时器, 返回的Timer可以取消调用
+func (this *Protocol) castAfter(handle *RoutineHandle, d time.Duration, protocol int16, params interface{}) Timer {
+	return this.clock.AfterFunc(d, func() {
+		this.cast(handle, protocol, params)
+	})
+}
+
+// 把ctx结束的原因转换为调用错误
+func ctxError(ctx context.Context, protocol int16) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%w: %s", ErrTimeout, commandName(protocol))
 	}
-	handle.castC <- []interface{}{protocol, params}
+	return fmt.Errorf("%s: %w", commandName(protocol), ctx.Err())
 }
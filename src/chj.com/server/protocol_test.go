@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+const (
+	testCmd_Echo int16 = 9001 + iota
+	testCmd_Block
+	testCmd_Panic
+)
+
+func init() {
+	RegisterCommand(testCmd_Echo, "testCmd_Echo", "")
+	RegisterCommand(testCmd_Block, "testCmd_Block", nil)
+	RegisterCommand(testCmd_Panic, "testCmd_Panic", nil)
+}
+
+// 启动一个测试进程, testCmd_Block开始处理时关闭started, release关闭后才返回
+func newTestRoutine(sup *Supervisor, started chan struct{}, release chan struct{}) *RoutineHandle {
+	rh := NewRoutineHandle("Test", nil)
+	rh.handle(testCmd_Echo, func(ctx context.Context, params interface{}) (interface{}, error) {
+		return params, nil
+	})
+	rh.handle(testCmd_Block, func(ctx context.Context, params interface{}) (interface{}, error) {
+		close(started)
+		<-release
+		return nil, nil
+	})
+	rh.handle(testCmd_Panic, func(ctx context.Context, params interface{}) (interface{}, error) {
+		panic("boom")
+	})
+	sup.Start(&ChildSpec{Name: "Test", Restart: Transient, Run: rh.loop, Handle: rh})
+	return rh
+}
+
+func TestCallTimeout(t *testing.T) {
+	clock := NewFakeClock()
+	protocol := NewProtocol(clock)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	rh := newTestRoutine(NewSupervisor("TestSup", nil, 10, time.Minute, 0), started, release)
+	defer rh.Stop()
+
+	errC := make(chan error, 1)
+	go func() {
+		_, err := protocol.call(rh, testCmd_Block, nil)
+		errC <- err
+	}()
+
+	// 等待处理函数开始执行后让时钟超时
+	<-started
+	clock.BlockUntil(1)
+	clock.Advance(defaultCallTimeout)
+	if err := <-errC; !errors.Is(err, ErrTimeout) {
+		t.Fatalf("err = %v, want ErrTimeout", err)
+	}
+
+	// 处理函数返回后结果被丢弃
+	close(release)
+	if ret, err := protocol.call(rh, testCmd_Echo, "x"); err != nil || ret != "x" {
+		t.Fatalf("echo = %v, %v", ret, err)
+	}
+	if rh.LateReplies() != 1 {
+		t.Fatalf("LateReplies = %d", rh.LateReplies())
+	}
+}
+
+func TestCallErrors(t *testing.T) {
+	h := NewHarness(t)
+	rh := newTestRoutine(h.facade.rootSup, nil, nil)
+	protocol := h.facade.protocol
+
+	if _, err := protocol.call(rh, testCmd_Echo, 1); !errors.Is(err, ErrBadParams) {
+		t.Fatalf("err = %v, want ErrBadParams", err)
+	}
+	if _, err := protocol.call(rh, Game_Join, &GameJoinReq{}); !errors.Is(err, ErrUnknownCommand) {
+		t.Fatalf("err = %v, want ErrUnknownCommand", err)
+	}
+
+	// 崩溃后返回错误, 监督者重启后进程仍然可用
+	if _, err := protocol.call(rh, testCmd_Panic, nil); !errors.Is(err, ErrHandlerPanic) {
+		t.Fatalf("err = %v, want ErrHandlerPanic", err)
+	}
+	if ret, err := protocol.call(rh, testCmd_Echo, "x"); err != nil || ret != "x" {
+		t.Fatalf("echo = %v, %v", ret, err)
+	}
+
+	rh.Stop()
+	if _, err := protocol.call(rh, testCmd_Echo, "x"); !errors.Is(err, ErrDestroyed) {
+		t.Fatalf("err = %v, want ErrDestroyed", err)
+	}
+}
+
+// 启动一个手动模式的测试进程, 邮箱容量为2, 收到的testCmd_Echo参数按顺序记录在返回的slice中
+func newOverflowRoutine(h *Harness, name string, policy OverflowPolicy) (*RoutineHandle, *[]string) {
+	received := make([]string, 0)
+	rh := NewRoutineHandle(name, &MailboxConfig{Size: 2, Policy: policy, BlockTimeout: time.Second})
+	rh.handle(testCmd_Echo, func(ctx context.Context, params interface{}) (interface{}, error) {
+		received = append(received, params.(string))
+		return nil, nil
+	})
+	h.facade.rootSup.Start(&ChildSpec{Name: name, Restart: Transient, Run: rh.loop, Handle: rh})
+	return rh, &received
+}
+
+// 处理完进程邮箱中的所有消息
+func drainRoutine(rh *RoutineHandle) {
+	for rh.step() {
+	}
+}
+
+// 获取进程类型的邮箱溢出统计
+func mailboxCounters(name string) (dropped int64, disconnected int64) {
+	if stat, ok := MailboxStats()[name].(map[string]int64); ok {
+		return stat["dropped"], stat["disconnected"]
+	}
+	return 0, 0
+}
+
+func TestOverflowBlock(t *testing.T) {
+	h := NewHarness(t)
+	clock := NewFakeClock()
+	protocol := NewProtocol(clock)
+	rh, received := newOverflowRoutine(h, "TestOverflowBlock", OverflowBlock)
+	dropped, _ := mailboxCounters("TestOverflowBlock")
+
+	protocol.cast(rh, testCmd_Echo, "a")
+	protocol.cast(rh, testCmd_Echo, "b")
+
+	// 邮箱满时等待, 超时后丢弃新消息
+	errC := make(chan error, 1)
+	go func() {
+		errC <- protocol.cast(rh, testCmd_Echo, "c")
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	if err := <-errC; !errors.Is(err, ErrMailboxFull) {
+		t.Fatalf("err = %v, want ErrMailboxFull", err)
+	}
+
+	// 等待期间邮箱有空位时投递成功
+	go func() {
+		errC <- protocol.cast(rh, testCmd_Echo, "d")
+	}()
+	clock.BlockUntil(1)
+	rh.step()
+	if err := <-errC; err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	drainRoutine(rh)
+	if fmt.Sprint(*received) != "[a b d]" {
+		t.Fatalf("received = %v", *received)
+	}
+	if n, _ := mailboxCounters("TestOverflowBlock"); rh.Dropped() != 1 || n-dropped != 1 {
+		t.Fatalf("dropped = %d, stats = %d", rh.Dropped(), n-dropped)
+	}
+}
+
+func TestOverflowDropOldest(t *testing.T) {
+	h := NewHarness(t)
+	rh, received := newOverflowRoutine(h, "TestOverflowDropOldest", OverflowDropOldest)
+	dropped, _ := mailboxCounters("TestOverflowDropOldest")
+
+	for _, s := range []string{"a", "b", "c", "d"} {
+		if err := h.facade.protocol.cast(rh, testCmd_Echo, s); err != nil {
+			t.Fatalf("cast %s: %v", s, err)
+		}
+	}
+
+	drainRoutine(rh)
+	if fmt.Sprint(*received) != "[c d]" {
+		t.Fatalf("received = %v", *received)
+	}
+	if n, _ := mailboxCounters("TestOverflowDropOldest"); rh.Dropped() != 2 || n-dropped != 2 {
+		t.Fatalf("dropped = %d, stats = %d", rh.Dropped(), n-dropped)
+	}
+}
+
+func TestOverflowDropNewest(t *testing.T) {
+	h := NewHarness(t)
+	rh, received := newOverflowRoutine(h, "TestOverflowDropNewest", OverflowDropNewest)
+	dropped, disconnected := mailboxCounters("TestOverflowDropNewest")
+
+	h.facade.protocol.cast(rh, testCmd_Echo, "a")
+	h.facade.protocol.cast(rh, testCmd_Echo, "b")
+	if err := h.facade.protocol.cast(rh, testCmd_Echo, "c"); !errors.Is(err, ErrMailboxFull) {
+		t.Fatalf("err = %v, want ErrMailboxFull", err)
+	}
+
+	drainRoutine(rh)
+	if fmt.Sprint(*received) != "[a b]" {
+		t.Fatalf("received = %v", *received)
+	}
+	n, d := mailboxCounters("TestOverflowDropNewest")
+	if rh.Dropped() != 1 || n-dropped != 1 || d != disconnected {
+		t.Fatalf("dropped = %d, stats = %d, %d", rh.Dropped(), n-dropped, d-disconnected)
+	}
+}
+
+func TestOverflowDisconnect(t *testing.T) {
+	h := NewHarness(t)
+	rh, received := newOverflowRoutine(h, "TestOverflowDisconnect", OverflowDisconnect)
+	dropped, disconnected := mailboxCounters("TestOverflowDisconnect")
+	overflows := 0
+	rh.setOnOverflow(func() {
+		overflows++
+	})
+
+	h.facade.protocol.cast(rh, testCmd_Echo, "a")
+	h.facade.protocol.cast(rh, testCmd_Echo, "b")
+	if err := h.facade.protocol.cast(rh, testCmd_Echo, "c"); !errors.Is(err, ErrMailboxFull) {
+		t.Fatalf("err = %v, want ErrMailboxFull", err)
+	}
+	if overflows != 1 {
+		t.Fatalf("overflows = %d", overflows)
+	}
+
+	drainRoutine(rh)
+	if fmt.Sprint(*received) != "[a b]" {
+		t.Fatalf("received = %v", *received)
+	}
+	n, d := mailboxCounters("TestOverflowDisconnect")
+	if rh.Dropped() != 1 || n-dropped != 1 || d-disconnected != 1 {
+		t.Fatalf("dropped = %d, stats = %d, %d", rh.Dropped(), n-dropped, d-disconnected)
+	}
+}
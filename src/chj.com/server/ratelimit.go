@@ -0,0 +1,167 @@
+package main
+
+// 消息限流-每个玩家按消息类型使用令牌桶限流, 同一类型持续超限时逐级处理: 丢弃, 警告, 禁言(只对聊天), 断开连接
+// 控制指令只限流, 不会因为操作太快被禁言或断开
+
+import (
+	"time"
+)
+
+// 超限处理
+type FloodAction int
+
+const (
+	FloodAllow      FloodAction = iota // 正常处理
+	FloodDrop                          // 丢弃消息
+	FloodWarn                          // 丢弃消息并警告客户端
+	FloodMute                          // 丢弃消息并开始禁言
+	FloodDisconnect                    // 断开连接
+)
+
+// 令牌桶参数, Rate为每秒补充的令牌数, Burst为桶容量
+type RateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+// 限流配置
+type FloodConfig struct {
+	// 消息类型 -> 限流参数, default用于没有单独配置的类型, rate为0表示不限流
+	Limits map[string]*RateLimit
+	// 窗口内超限次数达到时的处理, 0表示不使用该级别
+	WarnAfter       int
+	MuteAfter       int
+	DisconnectAfter int
+	// 禁言时长, 禁言期间丢弃该类型的消息
+	MuteTime time.Duration
+	// 可以禁言的消息类型, 其他类型跳过禁言级别
+	MuteTypes map[string]bool
+	// 只限流的消息类型, 超限时只丢弃, 不警告, 禁言或断开
+	ThrottleTypes map[string]bool
+	// 超过该时间没有超限时, 超限次数清零
+	Window time.Duration
+}
+
+// 缺省限流配置, 聊天每秒1条, 控制每秒20条
+func defaultFloodConfig() *FloodConfig {
+	return &FloodConfig{
+		Limits: map[string]*RateLimit{
+			"broadcastMessage": {Rate: 1, Burst: 3},
+			"controlGame":      {Rate: 20, Burst: 20},
+			"default":          {Rate: 10, Burst: 20},
+		},
+		WarnAfter:       3,
+		MuteAfter:       10,
+		DisconnectAfter: 30,
+		MuteTime:        30 * time.Second,
+		MuteTypes:       map[string]bool{"broadcastMessage": true},
+		ThrottleTypes:   map[string]bool{"controlGame": true},
+		Window:          10 * time.Second,
+	}
+}
+
+type TokenBucket struct {
+	limit  *RateLimit
+	tokens float64
+	last   time.Time
+}
+
+// 创建时桶是满的
+func NewTokenBucket(limit *RateLimit, now time.Time) *TokenBucket {
+	return &TokenBucket{limit: limit, tokens: limit.Burst, last: now}
+}
+
+// 取一个令牌, 没有令牌时返回false
+func (this *TokenBucket) Allow(now time.Time) bool {
+	if elapsed := now.Sub(this.last); elapsed > 0 {
+		this.tokens += elapsed.Seconds() * this.limit.Rate
+		if this.tokens > this.limit.Burst {
+			this.tokens = this.limit.Burst
+		}
+		this.last = now
+	}
+	if this.tokens < 1 {
+		return false
+	}
+	this.tokens--
+	return true
+}
+
+// 一个玩家的限流状态, 只在player进程中使用, 不需要加锁
+type FloodGuard struct {
+	config *FloodConfig
+	states map[string]*floodState
+}
+
+// 一种消息类型的令牌桶和超限状态
+type floodState struct {
+	// 令牌桶, nil表示不限流
+	bucket *TokenBucket
+	// 窗口内的超限次数和最后一次超限的时间
+	violations    int
+	lastViolation time.Time
+	// 禁言结束时间
+	mutedUntil time.Time
+}
+
+func NewFloodGuard(config *FloodConfig) *FloodGuard {
+	this := new(FloodGuard)
+	this.config = config
+	this.states = make(map[string]*floodState)
+	return this
+}
+
+// 检查收到的消息, 返回处理方式
+func (this *FloodGuard) Check(now time.Time, msgType string) FloodAction {
+	if msgType == "heartBeat" {
+		return FloodAllow
+	}
+
+	key, state := this.state(now, msgType)
+	allowed := state.bucket == nil || state.bucket.Allow(now)
+	muted := now.Before(state.mutedUntil)
+	if allowed {
+		if muted {
+			return FloodDrop
+		}
+		return FloodAllow
+	}
+	if this.config.ThrottleTypes[key] {
+		return FloodDrop
+	}
+
+	if this.config.Window > 0 && now.Sub(state.lastViolation) > this.config.Window {
+		state.violations = 0
+	}
+	state.violations++
+	state.lastViolation = now
+
+	switch {
+	case this.config.DisconnectAfter > 0 && state.violations >= this.config.DisconnectAfter:
+		return FloodDisconnect
+	case this.config.MuteTypes[key] && this.config.MuteAfter > 0 && state.violations >= this.config.MuteAfter && !muted:
+		state.mutedUntil = now.Add(this.config.MuteTime)
+		return FloodMute
+	case this.config.WarnAfter > 0 && state.violations == this.config.WarnAfter:
+		return FloodWarn
+	}
+	return FloodDrop
+}
+
+// 消息类型的限流状态, 返回配置中的类型名
+// 没有单独配置的类型共用default的状态, 避免客户端用随机类型绕过限流
+func (this *FloodGuard) state(now time.Time, msgType string) (string, *floodState) {
+	key := msgType
+	if _, ok := this.config.Limits[key]; !ok {
+		key = "default"
+	}
+	if state, ok := this.states[key]; ok {
+		return key, state
+	}
+	state := new(floodState)
+	if limit := this.config.Limits[key]; limit != nil && limit.Rate > 0 {
+		state.bucket = NewTokenBucket(limit, now)
+	}
+	this.states[key] = state
+	return key, state
+}
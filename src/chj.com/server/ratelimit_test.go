@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.Local)
+	bucket := NewTokenBucket(&RateLimit{Rate: 2, Burst: 3}, now)
+	for i := 0; i < 3; i++ {
+		if !bucket.Allow(now) {
+			t.Fatalf("burst %d not allowed", i)
+		}
+	}
+	if bucket.Allow(now) {
+		t.Fatal("allowed over burst")
+	}
+
+	// 每秒补充2个, 不超过容量
+	now = now.Add(500 * time.Millisecond)
+	if !bucket.Allow(now) || bucket.Allow(now) {
+		t.Fatal("refill after 500ms")
+	}
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		bucket.Allow(now)
+	}
+	if bucket.Allow(now) {
+		t.Fatal("refilled over burst")
+	}
+}
+
+func TestFloodGuard(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.Local)
+	config := &FloodConfig{
+		Limits:          map[string]*RateLimit{"chat": {Rate: 1, Burst: 1}, "control": {Rate: 1, Burst: 1}, "default": {Rate: 1, Burst: 1}},
+		WarnAfter:       2,
+		MuteAfter:       3,
+		DisconnectAfter: 5,
+		MuteTime:        time.Minute,
+		MuteTypes:       map[string]bool{"chat": true},
+		ThrottleTypes:   map[string]bool{"control": true},
+		Window:          10 * time.Second,
+	}
+	guard := NewFloodGuard(config)
+
+	expected := []FloodAction{FloodAllow, FloodDrop, FloodWarn, FloodMute, FloodDrop, FloodDisconnect}
+	for i, action := range expected {
+		if got := guard.Check(now, "chat"); got != action {
+			t.Fatalf("check %d = %v, want %v", i, got, action)
+		}
+	}
+
+	// 禁言只对聊天有效, 控制指令只限流
+	if guard.Check(now, "heartBeat") != FloodAllow || guard.Check(now, "control") != FloodAllow {
+		t.Fatal("muted other types")
+	}
+	for i := 0; i < 10; i++ {
+		if action := guard.Check(now, "control"); action != FloodDrop {
+			t.Fatalf("control over limit = %v", action)
+		}
+	}
+
+	// 不能禁言的类型跳过禁言级别, 超限次数按类型计算
+	expected = []FloodAction{FloodAllow, FloodDrop, FloodWarn, FloodDrop, FloodDrop, FloodDisconnect}
+	for i, action := range expected {
+		if got := guard.Check(now, "join"); got != action {
+			t.Fatalf("join check %d = %v, want %v", i, got, action)
+		}
+	}
+
+	// 没有配置的类型共用default
+	guard = NewFloodGuard(config)
+	if guard.Check(now, "a") != FloodAllow || guard.Check(now, "b") != FloodDrop {
+		t.Fatal("unknown types not sharing default bucket")
+	}
+
+	// 窗口内没有超限, 次数清零
+	now = now.Add(time.Minute)
+	if guard.Check(now, "b") != FloodAllow || guard.Check(now, "b") != FloodDrop || guard.Check(now, "b") != FloodWarn {
+		t.Fatal("violations not reset after window")
+	}
+}
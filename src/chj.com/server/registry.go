@@ -0,0 +1,128 @@
+package main
+
+// 进程注册表-按类型和id登记在线的进程, 可以并发查询, 不经过Session进程
+
+import (
+	"sync"
+)
+
+// 进程类型
+const (
+	KindGame   = "Game"
+	KindPlayer = "Player"
+	// 按断线重连token登记的player进程
+	KindResume = "Resume"
+)
+
+// 进程退出通知
+type DeathListener func(id interface{}, rh *RoutineHandle)
+
+// 一次登记, 删除登记时关闭cancel停止等待进程退出
+type registration struct {
+	rh     *RoutineHandle
+	cancel chan struct{}
+}
+
+type Registry struct {
+	lock sync.RWMutex
+
+	// 类型 -> id -> 登记
+	actors map[string]map[interface{}]*registration
+	// 类型 -> 退出通知
+	listeners map[string][]DeathListener
+}
+
+func NewRegistry() *Registry {
+	this := new(Registry)
+	this.actors = make(map[string]map[interface{}]*registration)
+	this.listeners = make(map[string][]DeathListener)
+	return this
+}
+
+// 登记进程, 返回之前登记在同一id下的进程, 进程退出后自动删除
+func (this *Registry) Register(kind string, id interface{}, rh *RoutineHandle) *RoutineHandle {
+	this.lock.Lock()
+	actors, ok := this.actors[kind]
+	if !ok {
+		actors = make(map[interface{}]*registration)
+		this.actors[kind] = actors
+	}
+	old := actors[id]
+	if old != nil && old.rh == rh {
+		this.lock.Unlock()
+		return nil
+	}
+	reg := &registration{rh: rh, cancel: make(chan struct{})}
+	actors[id] = reg
+	this.lock.Unlock()
+
+	go this.watch(kind, id, reg)
+	if old == nil {
+		return nil
+	}
+	// 被替换的进程退出时不再通知
+	close(old.cancel)
+	return old.rh
+}
+
+// 删除进程, 只有id下登记的仍是rh时才删除, 返回是否删除
+func (this *Registry) Unregister(kind string, id interface{}, rh *RoutineHandle) bool {
+	this.lock.RLock()
+	reg := this.actors[kind][id]
+	this.lock.RUnlock()
+
+	return reg != nil && reg.rh == rh && this.remove(kind, id, reg)
+}
+
+// 删除登记并停止等待进程退出, 只有id下仍是这次登记时才删除
+func (this *Registry) remove(kind string, id interface{}, reg *registration) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if actors, ok := this.actors[kind]; ok && actors[id] == reg {
+		delete(actors, id)
+		close(reg.cancel)
+		return true
+	}
+	return false
+}
+
+// 查询进程, 不存在或已停止时返回nil
+func (this *Registry) Lookup(kind string, id interface{}) *RoutineHandle {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	reg := this.actors[kind][id]
+	if reg == nil || reg.rh.Destroyed() {
+		return nil
+	}
+	return reg.rh
+}
+
+// 注册进程退出通知, 只有退出时仍然登记着的进程才会通知
+func (this *Registry) OnDeath(kind string, listener DeathListener) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.listeners[kind] = append(this.listeners[kind], listener)
+}
+
+// 等待进程退出, 删除登记并通知; 登记被删除或替换时直接返回
+func (this *Registry) watch(kind string, id interface{}, reg *registration) {
+	select {
+	case <-reg.rh.Done():
+	case <-reg.cancel:
+		return
+	}
+	if !this.remove(kind, id, reg) {
+		return
+	}
+
+	this.lock.RLock()
+	listeners := this.listeners[kind]
+	this.lock.RUnlock()
+
+	for _, listener := range listeners {
+		listener(id, reg.rh)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+// 停止进程并标记退出, 触发注册表的退出通知
+func killRoutine(rh *RoutineHandle) {
+	rh.Stop()
+	rh.exit()
+}
+
+// 等待一次退出通知
+type deathEvent struct {
+	id interface{}
+	rh *RoutineHandle
+}
+
+func waitDeath(t *testing.T, deaths chan deathEvent) deathEvent {
+	select {
+	case death := <-deaths:
+		return death
+	case <-time.After(time.Second):
+		t.Fatal("death not notified")
+		return deathEvent{}
+	}
+}
+
+func TestRegistryLookup(t *testing.T) {
+	registry := NewRegistry()
+	rh := NewRoutineHandle("Test", nil)
+	defer killRoutine(rh)
+
+	if old := registry.Register(KindPlayer, 1, rh); old != nil {
+		t.Fatalf("old = %v", old)
+	}
+	if registry.Lookup(KindPlayer, 1) != rh {
+		t.Fatal("lookup registered")
+	}
+
+	// 类型和id分开登记
+	if registry.Lookup(KindGame, 1) != nil || registry.Lookup(KindPlayer, 2) != nil {
+		t.Fatal("lookup unregistered")
+	}
+
+	// 已停止的进程查询不到
+	rh.Stop()
+	if registry.Lookup(KindPlayer, 1) != nil {
+		t.Fatal("lookup stopped routine")
+	}
+}
+
+func TestRegistryReplace(t *testing.T) {
+	registry := NewRegistry()
+	rh1 := NewRoutineHandle("Test", nil)
+	rh2 := NewRoutineHandle("Test", nil)
+	defer killRoutine(rh1)
+	defer killRoutine(rh2)
+
+	registry.Register(KindPlayer, 1, rh1)
+	if old := registry.Register(KindPlayer, 1, rh2); old != rh1 {
+		t.Fatalf("old = %v, want rh1", old)
+	}
+	// 重复登记同一个进程不返回旧进程
+	if old := registry.Register(KindPlayer, 1, rh2); old != nil {
+		t.Fatalf("old = %v, want nil", old)
+	}
+	if registry.Lookup(KindPlayer, 1) != rh2 {
+		t.Fatal("lookup replaced")
+	}
+
+	// 只有仍然登记着的进程才能删除
+	if registry.Unregister(KindPlayer, 1, rh1) {
+		t.Fatal("unregister replaced routine")
+	}
+	if registry.Lookup(KindPlayer, 1) != rh2 {
+		t.Fatal("replacement unregistered")
+	}
+	if !registry.Unregister(KindPlayer, 1, rh2) || registry.Lookup(KindPlayer, 1) != nil {
+		t.Fatal("unregister owner")
+	}
+	if registry.Unregister(KindPlayer, 1, rh2) {
+		t.Fatal("unregister twice")
+	}
+}
+
+func TestRegistryOnDeath(t *testing.T) {
+	registry := NewRegistry()
+	deaths := make(chan deathEvent, 4)
+	registry.OnDeath(KindPlayer, func(id interface{}, rh *RoutineHandle) {
+		deaths <- deathEvent{id, rh}
+	})
+
+	// 被替换的进程退出时不通知, 也不删除新进程
+	rh1 := NewRoutineHandle("Test", nil)
+	rh2 := NewRoutineHandle("Test", nil)
+	registry.Register(KindPlayer, 1, rh1)
+	registry.Register(KindPlayer, 1, rh2)
+	killRoutine(rh1)
+
+	// 只停止还没有退出时不通知
+	rh2.Stop()
+	select {
+	case death := <-deaths:
+		t.Fatalf("death before exit: %v", death)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	rh2.exit()
+	if death := waitDeath(t, deaths); death.id != 1 || death.rh != rh2 {
+		t.Fatalf("death = %v", death)
+	}
+	if registry.Unregister(KindPlayer, 1, rh2) {
+		t.Fatal("dead routine still registered")
+	}
+
+	// 主动删除登记后退出不通知, 其他类型不通知
+	rh3 := NewRoutineHandle("Test", nil)
+	rh4 := NewRoutineHandle("Test", nil)
+	registry.Register(KindPlayer, 3, rh3)
+	registry.Register(KindGame, 4, rh4)
+	registry.Unregister(KindPlayer, 3, rh3)
+	killRoutine(rh3)
+	killRoutine(rh4)
+	select {
+	case death := <-deaths:
+		t.Fatalf("unexpected death: %v", death)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestRegistryRotateNoWatcherLeak(t *testing.T) {
+	registry := NewRegistry()
+	deaths := make(chan deathEvent, 4)
+	registry.OnDeath(KindResume, func(id interface{}, rh *RoutineHandle) {
+		deaths <- deathEvent{id, rh}
+	})
+	rh := NewRoutineHandle("Test", nil)
+	registry.Register(KindResume, 0, rh)
+	goroutines := runtime.NumGoroutine()
+
+	// 同一个进程反复更换登记id, 删除登记时停止等待, 不会累积goroutine
+	for i := 1; i <= 100; i++ {
+		registry.Unregister(KindResume, i-1, rh)
+		registry.Register(KindResume, i, rh)
+	}
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > goroutines+5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines = %d, want about %d", runtime.NumGoroutine(), goroutines)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// 最后一次登记仍然在进程退出时通知
+	killRoutine(rh)
+	if death := waitDeath(t, deaths); death.id != 100 || death.rh != rh {
+		t.Fatalf("death = %v", death)
+	}
+	select {
+	case death := <-deaths:
+		t.Fatalf("unexpected death: %v", death)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
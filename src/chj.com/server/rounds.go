@@ -0,0 +1,239 @@
+package main
+
+// 游戏回合记录-每局游戏从开始到结束的操作和结果, 结束时写入日志文件, 供客服按玩家或设备查询
+// 转发给设备的指令记录收到, 转发的时间和设备之后报告的状态, 可以回放成时间线处理玩家投诉
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 内存中保留的最近回合数, 更早的回合只保存在文件中
+const roundRecentSize = 10000
+
+// 回合内的一次操作, 转发给设备的指令(开始/重试/移动/下爪/重置)或设备返回的结果
+type RoundControl struct {
+	// 服务器收到指令或设备消息的时间
+	Time    time.Time `json:"time"`
+	Control string    `json:"control"`
+	// 附加信息, 如结果值, 自动下爪
+	Value string `json:"value,omitempty"`
+	// 发送指令的玩家, 0表示服务器产生的指令
+	PlayerId int `json:"playerId,omitempty"`
+	// 转发给设备的时间, 设备消息为空
+	ForwardTime *time.Time `json:"forwardTime,omitempty"`
+	// 转发后设备报告的下一个状态和收到的时间
+	DeviceStatus string     `json:"deviceStatus,omitempty"`
+	DeviceTime   *time.Time `json:"deviceTime,omitempty"`
+}
+
+// 一个玩家在设备上的一局游戏, 重试窗口内的重试属于同一局
+type PlayRound struct {
+	Id         string          `json:"id"`
+	DeviceName string          `json:"deviceName"`
+	PlayerId   int             `json:"playerId"`
+	StartTime  time.Time       `json:"startTime"`
+	EndTime    time.Time       `json:"endTime"`
+	Controls   []*RoundControl `json:"controls"`
+	// 最后一次的结果, 为空表示没有返回结果
+	Result string `json:"result"`
+	// 结束原因: result/noretry/timeout/leave/forceReset/logout等
+	EndReason string `json:"endReason"`
+	Retries   int    `json:"retries"`
+	// 最后一次开始时的中奖决定, 由php服务器决定时为空
+	Payout *PayoutDecision `json:"payout,omitempty"`
+	// 最后一次结果的结算记录
+	SettlementKey string `json:"settlementKey,omitempty"`
+}
+
+func NewPlayRound(now time.Time, deviceName string, playerId int) *PlayRound {
+	this := new(PlayRound)
+	this.Id = fmt.Sprintf("%s-%d-%s", deviceName, now.UnixNano(), newTraceId(4))
+	this.DeviceName = deviceName
+	this.PlayerId = playerId
+	this.StartTime = now
+	this.Controls = make([]*RoundControl, 0)
+	return this
+}
+
+func (this *PlayRound) addControl(control *RoundControl) {
+	this.Controls = append(this.Controls, control)
+}
+
+// 设备报告了新状态, 填写到还没有收到设备状态的已转发指令上
+func (this *PlayRound) deviceReport(now time.Time, status string) {
+	for i := len(this.Controls) - 1; i >= 0; i-- {
+		control := this.Controls[i]
+		if control.ForwardTime == nil {
+			continue
+		}
+		if control.DeviceStatus != "" {
+			break
+		}
+		control.DeviceStatus = status
+		control.DeviceTime = &now
+	}
+}
+
+// 回合时间线上的一个事件
+type TimelineEvent struct {
+	Time time.Time `json:"time"`
+	// 距回合开始的毫秒数
+	Offset int64 `json:"offset"`
+	// 事件来源: player/server/device
+	Source string `json:"source"`
+	Event  string `json:"event"`
+}
+
+func (this *TimelineEvent) String() string {
+	return fmt.Sprintf("%+9.3fs %-6s %s", float64(this.Offset)/1000, this.Source, this.Event)
+}
+
+// 按时间排列回合内的指令收到, 转发和设备报告
+func (this *PlayRound) Timeline() []*TimelineEvent {
+	events := make([]*TimelineEvent, 0, len(this.Controls)*3+2)
+	add := func(t time.Time, source string, format string, args ...interface{}) {
+		events = append(events, &TimelineEvent{
+			Time:   t,
+			Offset: int64(t.Sub(this.StartTime) / time.Millisecond),
+			Source: source,
+			Event:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	add(this.StartTime, "server", "round %s start, player %d", this.Id, this.PlayerId)
+	for _, control := range this.Controls {
+		name := control.Control
+		if control.Value != "" {
+			name += "(" + control.Value + ")"
+		}
+		if control.ForwardTime == nil {
+			add(control.Time, "device", "%s", name)
+			continue
+		}
+
+		if control.PlayerId != 0 {
+			add(control.Time, "player", "player %d sent %s", control.PlayerId, name)
+		} else {
+			add(control.Time, "server", "server sent %s", name)
+		}
+		add(*control.ForwardTime, "server", "%s forwarded to device, delay %s", name, control.ForwardTime.Sub(control.Time))
+		if control.DeviceTime != nil {
+			add(*control.DeviceTime, "device", "status %s after %s, delay %s", control.DeviceStatus, name, control.DeviceTime.Sub(*control.ForwardTime))
+		}
+	}
+	if !this.EndTime.IsZero() {
+		add(this.EndTime, "server", "round end: %s, result %q, retries %d", this.EndReason, this.Result, this.Retries)
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+	return events
+}
+
+type RoundStore struct {
+	lock sync.Mutex
+	// 日志文件, nil表示只保存在内存中
+	file *os.File
+	// 最近结束的回合, 新的在后面
+	recent []*PlayRound
+}
+
+// 打开回合记录文件, 读取最近的回合, path为空时只保存在内存中
+func OpenRoundStore(path string) (*RoundStore, error) {
+	this := new(RoundStore)
+	this.recent = make([]*PlayRound, 0)
+	if path == "" {
+		return this, nil
+	}
+
+	if err := this.load(path); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	this.file = f
+	return this, nil
+}
+
+func (this *RoundStore) load(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		round := new(PlayRound)
+		if err := json.Unmarshal(scanner.Bytes(), round); err != nil {
+			log.Println("回合记录解析失败: ", err)
+			continue
+		}
+		this.append(round)
+	}
+	return scanner.Err()
+}
+
+// 需要持有锁
+func (this *RoundStore) append(round *PlayRound) {
+	this.recent = append(this.recent, round)
+	if len(this.recent) > roundRecentSize {
+		this.recent = this.recent[len(this.recent)-roundRecentSize:]
+	}
+}
+
+// 保存结束的回合, 之后不能再修改
+func (this *RoundStore) Add(round *PlayRound) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.append(round)
+	if this.file == nil {
+		return nil
+	}
+	line, _ := json.Marshal(round)
+	_, err := this.file.Write(append(line, '\n'))
+	return err
+}
+
+// 按设备和玩家查询最近的回合, 新的在前面, deviceName为空或playerId为0表示不限
+func (this *RoundStore) Query(deviceName string, playerId int, n int) []*PlayRound {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	ret := make([]*PlayRound, 0)
+	for i := len(this.recent) - 1; i >= 0 && len(ret) < n; i-- {
+		round := this.recent[i]
+		if (deviceName == "" || round.DeviceName == deviceName) && (playerId == 0 || round.PlayerId == playerId) {
+			ret = append(ret, round)
+		}
+	}
+	return ret
+}
+
+// 按回合id查询, 没有时返回nil
+func (this *RoundStore) Get(id string) *PlayRound {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for i := len(this.recent) - 1; i >= 0; i-- {
+		if this.recent[i].Id == id {
+			return this.recent[i]
+		}
+	}
+	return nil
+}
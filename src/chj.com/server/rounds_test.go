@@ -0,0 +1,42 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRoundStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rounds.log")
+	rounds, err := OpenRoundStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1500000000, 0)
+	for i, playerId := range []int{7, 8, 7} {
+		round := NewPlayRound(now.Add(time.Duration(i)*time.Minute), "dev1", playerId)
+		round.addControl(&RoundControl{Time: round.StartTime, Control: "start"})
+		round.EndReason = "result"
+		if err := rounds.Add(round); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rounds.Add(NewPlayRound(now, "dev2", 7))
+
+	// 重启后从文件恢复, 新的在前面
+	rounds, err = OpenRoundStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := rounds.Query("dev1", 7, 10)
+	if len(found) != 2 || !found[0].StartTime.After(found[1].StartTime) || len(found[0].Controls) != 1 {
+		t.Fatalf("rounds = %+v", found)
+	}
+	if found := rounds.Query("", 7, 2); len(found) != 2 || found[0].DeviceName != "dev2" {
+		t.Fatalf("rounds by player = %+v", found)
+	}
+	if round := rounds.Get(found[1].Id); round == nil || round.PlayerId != 7 {
+		t.Fatalf("round = %+v", round)
+	}
+}
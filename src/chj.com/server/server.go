@@ -6,14 +6,20 @@ package main
 // 3. 处理api调用请求
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"runtime/debug"
 	"strconv"
-	"strings"
+	"time"
 
 	"golang.org/x/net/websocket"
 )
@@ -23,21 +29,28 @@ type Server struct {
 	config    *Config
 	protocol  *Protocol
 	sessionRH *RoutineHandle
+	registry  *Registry
 
-	Games []*Game // 当前在线的game列表
+	Games   []*Game   // 当前在线的game列表
 	players []*Player // 当前在线的客户端列表
 }
 
 func NewServer(facade *Facade) {
+	this := newServer(facade)
+
+	// 启动websocket监听
+	go this.run()
+}
+
+func newServer(facade *Facade) *Server {
 	this := new(Server)
 
 	this.facade = facade
 	this.config = this.facade.config
 	this.protocol = this.facade.protocol
 	this.sessionRH = this.facade.sessionRH
-
-	// 启动websocket监听
-	go this.run()
+	this.registry = this.facade.registry
+	return this
 }
 
 func (this *Server) run() {
@@ -61,7 +74,7 @@ func (this *Server) run() {
 	}()
 
 	// 启动socket监听
-	err := http.ListenAndServe(this.config.socketHost, websocket.Server{websocket.Config{}, nil, this.socketHandler})
+	err := http.ListenAndServe(this.config.socketHost, websocket.Server{Handler: this.socketHandler})
 	if err != nil {
 		log.Println("创建WebSocket监听失败: ", err)
 		return
@@ -87,8 +100,10 @@ func (this *Server) playerHandler(ws *websocket.Conn) {
 	//log.Println("Server.playerHandler")
 
 	// 创建一个player对象
-	playerRH := NewPlayer(this.facade, ws)
+	conn := NewWsConn(ws)
+	playerRH := NewPlayer(this.facade, conn)
 
+	first := true
 	for {
 		var message string
 		if err := websocket.Message.Receive(ws, &message); err != nil {
@@ -100,12 +115,41 @@ func (this *Server) playerHandler(ws *websocket.Conn) {
 
 		//log.Println("playerHandler-recv: ", message)
 
-		// 调用player处理消息
-		this.protocol.cast(playerRH, Player_RecvMessage, message)
+		// 第一条消息是重连时换回断线前的player进程, 新建的进程退出
+		if first {
+			first = false
+			if resumeRH := this.resumePlayer(conn, message); resumeRH != nil {
+				this.protocol.call(playerRH, Player_Logout, nil)
+				playerRH = resumeRH
+				continue
+			}
+		}
+
+		// 调用player处理消息, 记录收到的时间
+		ctx := WithReceiveTime(context.Background(), this.facade.clock.Now())
+		this.protocol.CastCtx(ctx, playerRH, Player_RecvMessage, message)
 	}
 
-	// 连接断开, 调用player logout
-	this.protocol.call(playerRH, Player_Logout, nil)
+	// 连接断开, 由player决定登出或等待重连
+	this.protocol.call(playerRH, Player_Disconnect, &PlayerDisconnectReq{conn})
+}
+
+// 处理重连消息, 格式: {"type": "resume", "data": "重连token"}, 成功时返回断线前的player进程
+func (this *Server) resumePlayer(ws Conn, message string) *RoutineHandle {
+	var msgObj map[string]interface{}
+	if err := json.Unmarshal([]byte(message), &msgObj); err != nil || msgObj["type"] != "resume" {
+		return nil
+	}
+	token, _ := msgObj["data"].(string)
+	playerRH := this.registry.Lookup(KindResume, token)
+	if playerRH == nil {
+		return nil
+	}
+	if _, err := this.protocol.call(playerRH, Player_Resume, &PlayerResumeReq{token, ws}); err != nil {
+		log.Println("Server.resumePlayer: ", err)
+		return nil
+	}
+	return playerRH
 }
 
 // game连接处理器
@@ -113,7 +157,7 @@ func (this *Server) GameHandler(ws *websocket.Conn) {
 	//log.Println("Server.GameHandler")
 
 	// 创建一个Game对象
-	GameRH := NewGame(this.facade, ws)
+	GameRH := NewGame(this.facade, NewWsConn(ws))
 
 	for {
 		var message string
@@ -127,8 +171,9 @@ func (this *Server) GameHandler(ws *websocket.Conn) {
 
 		//log.Println("GameHandler-recv: ", message)
 
-		// 调用Game处理消息
-		this.protocol.cast(GameRH, Game_RecvMessage, message)
+		// 调用Game处理消息, 记录收到的时间
+		ctx := WithReceiveTime(context.Background(), this.facade.clock.Now())
+		this.protocol.CastCtx(ctx, GameRH, Game_RecvMessage, message)
 	}
 
 	// 连接断开, 调用Game logout
@@ -146,26 +191,92 @@ func (this *Server) apiHandler(w http.ResponseWriter, r *http.Request) {
 		r.Body.Close()
 	}()
 
-	message := make([]byte, r.ContentLength)
-	r.Body.Read(message)
+	message, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("读取服务器消息出错: ", err)
+		fmt.Fprint(w, this.apiErrorResponse("read body error"))
+		return
+	}
 
 	//log.Println("apiHandler-recv: ", string(message))
 
 	// 解析json请求,然后路由处理
-	var msgObj map[string]interface{}
-	if err := json.Unmarshal(message, &msgObj); err != nil {
+	msg, err := parseClientMessage(string(message))
+	if err != nil {
 		log.Println("解析服务器消息出错: ", err, string(message))
 		fmt.Fprint(w, this.apiErrorResponse("parse json error"))
 		return
 	}
+	msgType := msg.Type
+
+	// 管理接口需要签名
+	if adminApis[msgType] {
+		if err := this.checkAdminSignature(r, message); err != nil {
+			log.Println("管理接口签名错误: ", msgType, r.RemoteAddr, err)
+			this.facade.audit.Record(&AuditEntry{
+				Action: "adminRejected",
+				Detail: msgType + " from " + r.RemoteAddr + ": " + err.Error(),
+			})
+			fmt.Fprint(w, this.apiErrorResponse("unauthorized"))
+			return
+		}
+	}
+
+	// 每个请求生成独立的请求id, 随调用链传递
+	ctx := WithReceiveTime(WithRequestId(r.Context(), newRequestId()), this.facade.clock.Now())
+	ctx, span := StartSpan(ctx, "api "+msgType, SpanKindServer)
+	defer span.Finish(nil)
+
+	// 参数都是数组, 可以省略
+	var params []interface{}
+	if msg.Data != nil {
+		if params, err = msg.List(); err != nil {
+			log.Println("服务器消息参数错误: ", err)
+			fmt.Fprint(w, this.apiErrorResponse("invalid params"))
+			return
+		}
+	}
 
 	var resp string
-	msgType := msgObj["type"].(string)
 	switch msgType {
 	case "startPlay":
-		resp = this.onStartPlay(msgObj["data"].([]interface{}))
+		resp = this.onStartPlay(ctx, params)
 	case "getDeviceInfos":
-		resp = this.onGetDeviceInfos(msgObj["data"].([]interface{}))
+		resp = this.onGetDeviceInfos(ctx, params)
+	case "getMailboxStats":
+		resp = this.apiDataResponse(MailboxStats())
+	case "getLaneStats":
+		resp = this.apiDataResponse(LaneStats())
+	case "getAuditLog":
+		resp = this.apiDataResponse(this.facade.audit.Recent(100))
+	case "getPayoutDecisions":
+		resp = this.onGetPayoutDecisions(params)
+	case "setMaintenance":
+		resp = this.onSetMaintenance(ctx, params)
+	case "setOperator":
+		resp = this.onSetOperator(ctx, params)
+	case "setPrize":
+		resp = this.onSetPrize(ctx, params)
+	case "setDevice":
+		resp = this.onSetDevice(ctx, params)
+	case "chatMute":
+		resp = this.onChatMute(params)
+	case "chatUnmute":
+		resp = this.onChatUnmute(params)
+	case "getChatMutes":
+		resp = this.apiDataResponse(this.facade.chat.Mutes(this.facade.clock.Now()))
+	case "setSlowMode":
+		resp = this.onSetSlowMode(params)
+	case "getPlayRounds":
+		resp = this.onGetPlayRounds(params)
+	case "getPlayRound":
+		resp = this.onGetPlayRound(params)
+	case "getRoundTimeline":
+		resp = this.onGetRoundTimeline(params)
+	case "getDeadLetters":
+		resp = this.onGetDeadLetters(ctx)
+	case "replayDeadLetter":
+		resp = this.onReplayDeadLetter(ctx, params)
 	default:
 		log.Println("unknow message type: ", msgType)
 		resp = this.apiErrorResponse("unknow message type: " + msgType)
@@ -177,6 +288,57 @@ func (this *Server) apiHandler(w http.ResponseWriter, r *http.Request) {
 //////////////////////////////////////////////////////////
 // 公用方法
 
+// 需要管理员签名的接口, 会改变设备, 玩家或结算状态, 或者返回玩家, 中奖和结算记录
+var adminApis = map[string]bool{
+	"setMaintenance":   true,
+	"setOperator":      true,
+	"setPrize":         true,
+	"setDevice":        true,
+	"chatMute":         true,
+	"chatUnmute":       true,
+	"setSlowMode":      true,
+	"replayDeadLetter": true,
+
+	"getAuditLog":        true,
+	"getPayoutDecisions": true,
+	"getChatMutes":       true,
+	"getPlayRounds":      true,
+	"getPlayRound":       true,
+	"getRoundTimeline":   true,
+	"getDeadLetters":     true,
+}
+
+// 管理接口签名允许的时间误差
+const adminSignatureSkew = 5 * time.Minute
+
+// 管理接口签名, 请求头X-Admin-Time为unix秒, X-Admin-Signature为hex(HMAC-SHA256(adminSecret, "时间.请求内容"))
+func SignAdminRequest(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// 校验管理接口签名, 没有配置adminSecret时拒绝所有管理接口
+func (this *Server) checkAdminSignature(r *http.Request, body []byte) error {
+	if this.config.adminSecret == "" {
+		return errors.New("admin api disabled")
+	}
+	timestamp, err := strconv.ParseInt(r.Header.Get("X-Admin-Time"), 10, 64)
+	if err != nil {
+		return errors.New("missing timestamp")
+	}
+	skew := this.facade.clock.Now().Sub(time.Unix(timestamp, 0))
+	if skew > adminSignatureSkew || skew < -adminSignatureSkew {
+		return errors.New("timestamp expired")
+	}
+	expected := SignAdminRequest(this.config.adminSecret, timestamp, body)
+	if !hmac.Equal([]byte(r.Header.Get("X-Admin-Signature")), []byte(expected)) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
 // 构造api返回数据
 func (this *Server) apiDataResponse(data interface{}) string {
 	respobj := make(map[string]interface{})
@@ -193,33 +355,26 @@ func (this *Server) apiErrorResponse(errMsg string) string {
 }
 
 // 校验玩家在线token并返回玩家id
-func (this *Server) checkOnilneUserToken(userToken string) int {
+func (this *Server) checkOnilneUserToken(ctx context.Context, userToken string) int {
 	if userToken == "" {
 		return 0
 	}
-	tokenArr := strings.Split(userToken, ":")
-	var userId int
-	var err error
-	if userId, err = strconv.Atoi(tokenArr[0]); err != nil || userId == 0 {
-		log.Println("Server.checkOnilneUserToken error1: ", err)
+	userId := tokenUserId(userToken)
+	if userId == 0 {
+		log.Println("Server.checkOnilneUserToken: invalid token")
 		return 0
 	}
 
 	// 查询玩家是否在线
-	response := this.protocol.call(this.sessionRH, Session_GetPlayer, userId)
-	if response == nil {
-		log.Println("Server.checkOnilneUserToken: player offline1")
-		return 0
-	}
-	playerRH := response.(*RoutineHandle)
-	if playerRH == nil || playerRH.destroyed {
-		log.Println("Server.checkOnilneUserToken: player offline2")
+	playerRH := this.registry.Lookup(KindPlayer, userId)
+	if playerRH == nil {
+		log.Println("Server.checkOnilneUserToken: player offline")
 		return 0
 	}
 
 	// 检查在线玩家token是否一致
-	existToken := this.protocol.call(playerRH, Player_GetToken, nil)
-	if existToken == nil || existToken.(string) != userToken {
+	existToken, err := this.protocol.CallCtx(ctx, playerRH, Player_GetToken, nil)
+	if token, ok := existToken.(string); err != nil || !ok || token != userToken {
 		log.Println("Server.checkOnilneUserToken: invalid token")
 		return 0
 	}
@@ -231,75 +386,411 @@ func (this *Server) checkOnilneUserToken(userToken string) int {
 // 具体调用逻辑实现
 
 // 开始游戏
-func (this *Server) onStartPlay(params []interface{}) string {
-	userToken := params[0].(string)
-	deviceName := params[1].(string)
+func (this *Server) onStartPlay(ctx context.Context, params []interface{}) string {
+	if len(params) < 2 {
+		return this.apiErrorResponse("invalid params")
+	}
+	userToken, ok := params[0].(string)
+	deviceName, ok2 := params[1].(string)
+	if !ok || !ok2 {
+		return this.apiErrorResponse("invalid params")
+	}
 	// 第3个参数，设置是否抓中，目前用于雪暴科技主板通过服务器计算概率的使用
 	result := int(0)
 	if len(params) > 2 {
-		result = int(params[2].(float64))
+		value, ok := params[2].(float64)
+		if !ok {
+			return this.apiErrorResponse("invalid params")
+		}
+		result = int(value)
 	}
 
 	log.Println("Server.onStartPlay: ", userToken, ",", deviceName)
 
-	userId := this.checkOnilneUserToken(userToken)
+	userId := this.checkOnilneUserToken(ctx, userToken)
 	if userId == 0 {
 		log.Println("Server.onStartPlay: invalid token")
 		return this.apiErrorResponse("invalid token")
 	}
 
 	// 查询game是否在线
-	response := this.protocol.call(this.sessionRH, Session_GetGame, deviceName)
-	if response == nil {
-		log.Println("Server.onStartPlay: device offline1")
-		return this.apiErrorResponse("device offline1")
-	}
-	GameRH := response.(*RoutineHandle)
-	if GameRH == nil || GameRH.destroyed {
-		log.Println("Server.onStartPlay: device offline2")
-		return this.apiErrorResponse("device offline2")
+	GameRH := this.registry.Lookup(KindGame, deviceName)
+	if GameRH == nil {
+		log.Println("Server.onStartPlay: device offline")
+		return this.apiErrorResponse("device offline")
 	}
 
 	// 给game发送开始游戏指令
-	GameResp := this.protocol.call(GameRH, Game_Control, []interface{}{"start", userId, result}).(string)
+	ctx = WithDeviceName(WithUserId(ctx, userId), deviceName)
+	GameResp, err := this.protocol.CallCtx(ctx, GameRH, Game_Control, &GameControlReq{"start", userId, result})
+	if err != nil {
+		log.Println("Server.onStartPlay: ", err)
+		return this.apiErrorResponse(err.Error())
+	}
 	if GameResp != "ok" {
 		log.Println("Server.onStartPlay: ", GameResp)
-		return this.apiErrorResponse(GameResp)
+		return this.apiErrorResponse(fmt.Sprint(GameResp))
 	}
 
 	return this.apiDataResponse("ok")
 }
 
 // 获取设备信息
-func (this *Server) onGetDeviceInfos(params []interface{}) string {
+func (this *Server) onGetDeviceInfos(ctx context.Context, params []interface{}) string {
 	deviceInfos := make(map[string]interface{})
 
-	GameRHs := this.protocol.call(this.sessionRH, Session_GetGames, params)
-	if GameRHs == nil {
-		log.Println("Server.onGetDeviceInfos: get from session error")
-		return this.apiErrorResponse("get from session error")
-	}
-	for i, GameRH := range GameRHs.([]*RoutineHandle) {
-		deviceName := params[i].(string)
+	for _, v := range params {
+		deviceName, _ := v.(string)
 
-		if GameRH != nil && !GameRH.destroyed {
-			deviceInfo := this.protocol.call(GameRH, Game_GetDeviceInfo, nil)
-			if deviceInfo != nil {
+		GameRH := this.registry.Lookup(KindGame, deviceName)
+		if GameRH != nil {
+			deviceInfo, err := this.protocol.CallCtx(ctx, GameRH, Game_GetDeviceInfo, nil)
+			if err == nil && deviceInfo != nil {
 				deviceInfos[deviceName] = deviceInfo
 				continue
 			}
 		}
 
 		// 设备没在线或出错了
-		deviceInfo := make(map[string]interface{})
-		deviceInfo["deviceName"] = deviceName
-		deviceInfo["deviceStatus"] = "error"
-		deviceInfo["curPlayer"] = 0
-		deviceInfos[deviceName] = deviceInfo
+		deviceInfos[deviceName] = &DeviceInfo{
+			DeviceName:   deviceName,
+			DeviceStatus: StateOffline.String(),
+			Prize:        this.facade.inventory.Get(deviceName),
+		}
 	}
 
 	return this.apiDataResponse(deviceInfos)
 }
 
+// 获取设备最近的中奖决定和当前状态, 参数为设备名, 没有参数时返回所有设备最近的决定
+func (this *Server) onGetPayoutDecisions(params []interface{}) string {
+	deviceName := ""
+	if len(params) > 0 {
+		deviceName, _ = params[0].(string)
+	}
+	decisions, state := this.facade.payout.Recent(deviceName, 100)
+
+	data := make(map[string]interface{})
+	data["decisions"] = decisions
+	data["state"] = state
+	return this.apiDataResponse(data)
+}
+
+// 设置设备维护, 参数为[设备名, 是否维护, 操作员工, 原因]
+func (this *Server) onSetMaintenance(ctx context.Context, params []interface{}) string {
+	if len(params) < 2 {
+		return this.apiErrorResponse("invalid params")
+	}
+	deviceName, _ := params[0].(string)
+	enable, _ := params[1].(bool)
+	req := &GameMaintenanceReq{Enable: enable}
+	if len(params) > 2 {
+		req.Operator, _ = params[2].(string)
+	}
+	if len(params) > 3 {
+		req.Reason, _ = params[3].(string)
+	}
+	return this.callGame(ctx, deviceName, Game_Maintenance, req, "ok", "pending")
+}
+
+// 设置维护中操作设备的员工, 参数为[设备名, 员工玩家id(0表示结束), 操作员工]
+func (this *Server) onSetOperator(ctx context.Context, params []interface{}) string {
+	if len(params) < 2 {
+		return this.apiErrorResponse("invalid params")
+	}
+	deviceName, _ := params[0].(string)
+	playerId, _ := params[1].(float64)
+	req := &GameOperatorReq{PlayerId: int(playerId)}
+	if len(params) > 2 {
+		req.Operator, _ = params[2].(string)
+	}
+	return this.callGame(ctx, deviceName, Game_Operator, req, "ok")
+}
+
+// 调用在线的game, 返回值不是成功结果时作为错误返回
+func (this *Server) callGame(ctx context.Context, deviceName string, cmd int16, params interface{}, okResults ...string) string {
+	GameRH := this.registry.Lookup(KindGame, deviceName)
+	if GameRH == nil {
+		return this.apiErrorResponse("device offline")
+	}
+
+	ctx = WithDeviceName(ctx, deviceName)
+	GameResp, err := this.protocol.CallCtx(ctx, GameRH, cmd, params)
+	if err != nil {
+		return this.apiErrorResponse(err.Error())
+	}
+	for _, ok := range okResults {
+		if GameResp == ok {
+			return this.apiDataResponse(GameResp)
+		}
+	}
+	log.Println("Server.callGame: ", deviceName, GameResp)
+	return this.apiErrorResponse(fmt.Sprint(GameResp))
+}
+
+// 设置设备的奖品和数量, 参数为[设备名, 奖品sku, 奖品名称, 数量, 图片], sku为空表示不再跟踪库存
+func (this *Server) onSetPrize(ctx context.Context, params []interface{}) string {
+	if len(params) < 2 {
+		return this.apiErrorResponse("invalid params")
+	}
+	deviceName, _ := params[0].(string)
+	sku, _ := params[1].(string)
+
+	var prize *Prize
+	if sku != "" {
+		prize = &Prize{Sku: sku}
+		if len(params) > 2 {
+			prize.Name, _ = params[2].(string)
+		}
+		if len(params) > 3 {
+			stock, _ := params[3].(float64)
+			prize.Stock = int(stock)
+		}
+		if len(params) > 4 {
+			prize.Image, _ = params[4].(string)
+		}
+	}
+	if err := this.facade.inventory.Set(deviceName, prize); err != nil {
+		log.Println("Server.onSetPrize: ", err)
+		return this.apiErrorResponse(err.Error())
+	}
+
+	// 设备在线时按新的库存更新状态
+	if GameRH := this.registry.Lookup(KindGame, deviceName); GameRH != nil {
+		this.protocol.cast(GameRH, Game_PrizeChanged, nil)
+	}
+	return this.apiDataResponse("ok")
+}
+
+// 登记设备, 参数为[设备名, 是否启用, 密钥, 操作员工], 密钥为空时保留原来的密钥, 停用时踢掉在线的设备
+func (this *Server) onSetDevice(ctx context.Context, params []interface{}) string {
+	if len(params) < 2 {
+		return this.apiErrorResponse("invalid params")
+	}
+	deviceName, _ := params[0].(string)
+	enabled, _ := params[1].(bool)
+	secret := ""
+	if len(params) > 2 {
+		secret, _ = params[2].(string)
+	}
+	operator := ""
+	if len(params) > 3 {
+		operator, _ = params[3].(string)
+	}
+	if deviceName == "" {
+		return this.apiErrorResponse("invalid params")
+	}
+
+	record := this.facade.devices.Get(deviceName)
+	if record == nil {
+		record = new(DeviceRecord)
+	}
+	if secret != "" {
+		record.Secret = secret
+	}
+	if record.Secret == "" {
+		return this.apiErrorResponse("secret required")
+	}
+	record.Enabled = enabled
+	if err := this.facade.devices.Set(deviceName, record); err != nil {
+		log.Println("Server.onSetDevice: ", err)
+		return this.apiErrorResponse(err.Error())
+	}
+
+	action := "deviceEnabled"
+	if !enabled {
+		action = "deviceDisabled"
+	}
+	detail := ""
+	if secret != "" {
+		detail = "secret changed"
+	}
+	this.facade.audit.Record(&AuditEntry{
+		Action:     action,
+		DeviceName: deviceName,
+		Operator:   operator,
+		Detail:     detail,
+	})
+
+	// 停用或更换密钥后, 在线的设备需要重新登陆
+	if !enabled || secret != "" {
+		if GameRH := this.registry.Lookup(KindGame, deviceName); GameRH != nil {
+			this.protocol.CastCtx(WithDeviceName(ctx, deviceName), GameRH, Game_Kickout, nil)
+		}
+	}
+	return this.apiDataResponse("ok")
+}
+
+// 聊天禁言, 参数为[设备名, 玩家id, 时长(毫秒), 操作员工, 原因], 设备名为空表示所有房间, 时长为0表示永久禁言
+func (this *Server) onChatMute(params []interface{}) string {
+	if len(params) < 2 {
+		return this.apiErrorResponse("invalid params")
+	}
+	mute := new(ChatMute)
+	mute.DeviceName, _ = params[0].(string)
+	playerId, _ := params[1].(float64)
+	mute.PlayerId = int(playerId)
+	duration := 0.0
+	if len(params) > 2 {
+		duration, _ = params[2].(float64)
+	}
+	if len(params) > 3 {
+		mute.Operator, _ = params[3].(string)
+	}
+	if len(params) > 4 {
+		mute.Reason, _ = params[4].(string)
+	}
+	if mute.PlayerId <= 0 {
+		return this.apiErrorResponse("invalid params")
+	}
+
+	action := "chatBan"
+	if duration > 0 {
+		action = "chatMute"
+		mute.Until = this.facade.clock.Now().Add(time.Duration(duration) * time.Millisecond)
+	}
+	if err := this.facade.chat.Mute(mute); err != nil {
+		log.Println("Server.onChatMute: ", err)
+		return this.apiErrorResponse(err.Error())
+	}
+	this.facade.audit.Record(&AuditEntry{
+		Action:     action,
+		DeviceName: mute.DeviceName,
+		PlayerId:   mute.PlayerId,
+		Operator:   mute.Operator,
+		Detail:     mute.Reason,
+	})
+	return this.apiDataResponse("ok")
+}
+
+// 解除聊天禁言, 参数为[设备名, 玩家id, 操作员工], 设备名为空表示解除所有房间的禁言
+func (this *Server) onChatUnmute(params []interface{}) string {
+	if len(params) < 2 {
+		return this.apiErrorResponse("invalid params")
+	}
+	deviceName, _ := params[0].(string)
+	playerId, _ := params[1].(float64)
+	operator := ""
+	if len(params) > 2 {
+		operator, _ = params[2].(string)
+	}
+
+	if err := this.facade.chat.Unmute(deviceName, int(playerId)); err != nil {
+		log.Println("Server.onChatUnmute: ", err)
+		return this.apiErrorResponse(err.Error())
+	}
+	this.facade.audit.Record(&AuditEntry{
+		Action:     "chatUnmute",
+		DeviceName: deviceName,
+		PlayerId:   int(playerId),
+		Operator:   operator,
+	})
+	return this.apiDataResponse("ok")
+}
+
+// 设置房间的慢速模式, 参数为[设备名, 间隔(毫秒), 操作员工], 设备名为default表示所有房间, 间隔为0表示关闭
+func (this *Server) onSetSlowMode(params []interface{}) string {
+	if len(params) < 2 {
+		return this.apiErrorResponse("invalid params")
+	}
+	deviceName, _ := params[0].(string)
+	interval, _ := params[1].(float64)
+	operator := ""
+	if len(params) > 2 {
+		operator, _ = params[2].(string)
+	}
+	if deviceName == "" || interval < 0 {
+		return this.apiErrorResponse("invalid params")
+	}
+
+	this.facade.chat.SetSlowMode(deviceName, time.Duration(interval)*time.Millisecond)
+	this.facade.audit.Record(&AuditEntry{
+		Action:     "chatSlowMode",
+		DeviceName: deviceName,
+		Operator:   operator,
+		Detail:     fmt.Sprintf("%dms", int64(interval)),
+	})
+	return this.apiDataResponse("ok")
+}
+
+// 查询最近的游戏回合, 参数为[设备名, 玩家id, 数量], 设备名为空或玩家id为0表示不限, 数量缺省100
+func (this *Server) onGetPlayRounds(params []interface{}) string {
+	deviceName := ""
+	playerId := 0
+	limit := 100
+	if len(params) > 0 {
+		deviceName, _ = params[0].(string)
+	}
+	if len(params) > 1 {
+		id, _ := params[1].(float64)
+		playerId = int(id)
+	}
+	if len(params) > 2 {
+		if n, ok := params[2].(float64); ok && n > 0 {
+			limit = int(n)
+		}
+	}
+	return this.apiDataResponse(this.facade.rounds.Query(deviceName, playerId, limit))
+}
+
+// 按回合id查询游戏回合, 参数为[回合id]
+func (this *Server) onGetPlayRound(params []interface{}) string {
+	id := ""
+	if len(params) > 0 {
+		id, _ = params[0].(string)
+	}
+	round := this.facade.rounds.Get(id)
+	if round == nil {
+		return this.apiErrorResponse("round not found")
+	}
+	return this.apiDataResponse(round)
+}
+
+// 回放游戏回合, 按时间列出玩家指令, 转发给设备和设备报告的状态, 参数为[回合id]
+func (this *Server) onGetRoundTimeline(params []interface{}) string {
+	id := ""
+	if len(params) > 0 {
+		id, _ = params[0].(string)
+	}
+	round := this.facade.rounds.Get(id)
+	if round == nil {
+		return this.apiErrorResponse("round not found")
+	}
+
+	timeline := round.Timeline()
+	lines := make([]string, 0, len(timeline))
+	for _, event := range timeline {
+		lines = append(lines, event.String())
+	}
+
+	data := make(map[string]interface{})
+	data["round"] = round
+	data["timeline"] = timeline
+	data["lines"] = lines
+	return this.apiDataResponse(data)
+}
+
+// 获取投递失败的结算记录
+func (this *Server) onGetDeadLetters(ctx context.Context) string {
+	deadLetters, err := this.protocol.CallCtx(ctx, this.facade.outboxRH, Outbox_GetDeadLetters, nil)
+	if err != nil {
+		return this.apiErrorResponse(err.Error())
+	}
+	return this.apiDataResponse(deadLetters)
+}
+
+// 重新投递结算记录, 参数为幂等key, 没有参数时重新投递全部死信
+func (this *Server) onReplayDeadLetter(ctx context.Context, params []interface{}) string {
+	key := ""
+	if len(params) > 0 {
+		key, _ = params[0].(string)
+	}
+	count, err := this.protocol.CallCtx(ctx, this.facade.outboxRH, Outbox_Replay, key)
+	if err != nil {
+		return this.apiErrorResponse(err.Error())
+	}
+	return this.apiDataResponse(count)
+}
+
 // http api请求处理 - end
 //////////////////////////////////////////////////////////
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 调用http api接口, timestamp不为0时按secret签名
+func postApi(server *Server, body string, secret string, timestamp int64) map[string]interface{} {
+	r := httptest.NewRequest("POST", "/api", strings.NewReader(body))
+	if timestamp != 0 {
+		r.Header.Set("X-Admin-Time", strconv.FormatInt(timestamp, 10))
+		r.Header.Set("X-Admin-Signature", SignAdminRequest(secret, timestamp, []byte(body)))
+	}
+	w := httptest.NewRecorder()
+	server.apiHandler(w, r)
+
+	var resp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp
+}
+
+func TestApiAdminSignature(t *testing.T) {
+	h := NewHarness(t)
+	server := newServer(h.facade)
+	body := `{"type": "setDevice", "data": ["dev5", true, "secret"]}`
+	now := h.clock.Now().Unix()
+
+	// 没有配置密钥时关闭管理接口
+	if resp := postApi(server, body, "", now); resp["error"] != "unauthorized" {
+		t.Fatalf("resp = %v", resp)
+	}
+
+	h.facade.config.adminSecret = "admin"
+	for _, c := range []struct {
+		secret    string
+		timestamp int64
+	}{{"admin", 0}, {"wrong", now}, {"admin", now - int64(10*time.Minute/time.Second)}} {
+		if resp := postApi(server, body, c.secret, c.timestamp); resp["error"] != "unauthorized" {
+			t.Fatalf("%+v: resp = %v", c, resp)
+		}
+	}
+	if h.facade.devices.Get("dev5") != nil {
+		t.Fatal("device set without signature")
+	}
+
+	if resp := postApi(server, body, "admin", now); resp["data"] != "ok" {
+		t.Fatalf("resp = %v", resp)
+	}
+	if h.facade.devices.Get("dev5") == nil {
+		t.Fatal("device not set")
+	}
+
+	// 返回玩家和结算记录的查询接口也需要签名, 监控统计不需要
+	for _, msgType := range []string{"getAuditLog", "getPayoutDecisions", "getChatMutes", "getPlayRounds", "getRoundTimeline", "getDeadLetters"} {
+		if resp := postApi(server, `{"type": "`+msgType+`", "data": []}`, "", 0); resp["error"] != "unauthorized" {
+			t.Fatalf("unsigned %s: resp = %v", msgType, resp)
+		}
+	}
+	if resp := postApi(server, `{"type": "getAuditLog", "data": []}`, "admin", now); resp["data"] == nil {
+		t.Fatalf("resp = %v", resp)
+	}
+	if resp := postApi(server, `{"type": "getMailboxStats", "data": []}`, "", 0); resp["error"] != nil {
+		t.Fatalf("resp = %v", resp)
+	}
+}
+
+// 格式错误的请求返回错误, 不能让处理goroutine崩溃
+func TestApiMalformed(t *testing.T) {
+	h := NewHarness(t)
+	server := newServer(h.facade)
+	h.NewLoggedInPlayer(7)
+
+	for _, body := range []string{
+		`[]`,
+		`{"type": 1}`,
+		`{"type": "startPlay"}`,
+		`{"type": "startPlay", "data": "7:token"}`,
+		`{"type": "startPlay", "data": ["7:token"]}`,
+		`{"type": "startPlay", "data": [7, "dev1"]}`,
+		`{"type": "startPlay", "data": ["7:token", "dev1", "1"]}`,
+		`{"type": "getDeviceInfos", "data": {"dev1": true}}`,
+		`{"type": "getPayoutDecisions", "data": "dev1"}`,
+	} {
+		if resp := postApi(server, body, "", 0); resp["error"] == nil {
+			t.Fatalf("%s: resp = %v", body, resp)
+		}
+	}
+
+	// 可以省略参数
+	if resp := postApi(server, `{"type": "getDeviceInfos"}`, "", 0); resp["data"] == nil {
+		t.Fatalf("resp = %v", resp)
+	}
+}
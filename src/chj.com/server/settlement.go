@@ -0,0 +1,277 @@
+package main
+
+// 结算记录存储-游戏结果先写入本地日志文件再投递给php服务器, 进程重启后未投递的记录不会丢失
+// 文件按行追加记录的最新状态, 打开时回放并压缩掉已投递的记录
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 结算记录状态
+const (
+	SettlementPending   = "pending"   // 等待投递
+	SettlementDelivered = "delivered" // 已投递
+	SettlementDead      = "dead"      // 投递失败次数过多, 等待人工处理
+)
+
+type Settlement struct {
+	// 幂等key, php服务器按key去重
+	Key        string    `json:"key"`
+	Seq        int64     `json:"seq"`
+	DeviceName string    `json:"deviceName"`
+	PlayerId   int       `json:"playerId"`
+	PlayResult string    `json:"playResult"`
+	Created    time.Time `json:"created"`
+
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+type SettlementStore struct {
+	clock Clock
+
+	lock sync.Mutex
+	// 日志文件, nil表示只保存在内存中
+	file *os.File
+	// 未投递和投递失败的记录
+	entries map[string]*Settlement
+	seq     int64
+}
+
+// 打开结算记录文件, path为空时只保存在内存中
+func OpenSettlementStore(clock Clock, path string) (*SettlementStore, error) {
+	this := new(SettlementStore)
+	this.clock = clock
+	this.entries = make(map[string]*Settlement)
+	if path == "" {
+		return this, nil
+	}
+
+	if err := this.load(path); err != nil {
+		return nil, err
+	}
+	if err := this.compact(path); err != nil {
+		return nil, err
+	}
+	return this, nil
+}
+
+// 回放日志文件, 同一key以最后一行为准
+func (this *SettlementStore) load(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := new(Settlement)
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			// 最后一行可能没写完
+			log.Println("结算记录解析失败: ", err)
+			continue
+		}
+		if entry.Seq > this.seq {
+			this.seq = entry.Seq
+		}
+		if entry.Status == SettlementDelivered {
+			delete(this.entries, entry.Key)
+		} else {
+			this.entries[entry.Key] = entry
+		}
+	}
+	return scanner.Err()
+}
+
+// 只保留未投递的记录重写日志文件
+func (this *SettlementStore) compact(path string) error {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	for _, entry := range this.sorted(nil) {
+		line, _ := json.Marshal(entry)
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	this.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+// 写入记录的最新状态, 需要持有锁
+func (this *SettlementStore) write(entry *Settlement) error {
+	if this.file == nil {
+		return nil
+	}
+	line, _ := json.Marshal(entry)
+	if _, err := this.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return this.file.Sync()
+}
+
+// 按写入顺序返回满足条件的记录副本
+func (this *SettlementStore) sorted(filter func(entry *Settlement) bool) []*Settlement {
+	ret := make([]*Settlement, 0, len(this.entries))
+	for _, entry := range this.entries {
+		if filter == nil || filter(entry) {
+			copied := *entry
+			ret = append(ret, &copied)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Seq < ret[j].Seq
+	})
+	return ret
+}
+
+// 增加一条待投递的结算记录, 写入文件失败时记录仍保存在内存中并继续投递
+func (this *SettlementStore) Add(deviceName string, playerId int, playResult string) (*Settlement, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := this.clock.Now()
+	this.seq++
+	entry := &Settlement{
+		Key:         fmt.Sprintf("%s-%d-%s", deviceName, now.UnixNano(), newTraceId(4)),
+		Seq:         this.seq,
+		DeviceName:  deviceName,
+		PlayerId:    playerId,
+		PlayResult:  playResult,
+		Created:     now,
+		Status:      SettlementPending,
+		NextAttempt: now,
+	}
+	this.entries[entry.Key] = entry
+
+	copied := *entry
+	return &copied, this.write(entry)
+}
+
+// 到了投递时间的记录
+func (this *SettlementStore) Due(now time.Time) []*Settlement {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.sorted(func(entry *Settlement) bool {
+		return entry.Status == SettlementPending && !entry.NextAttempt.After(now)
+	})
+}
+
+// 最早的下次投递时间, 没有待投递的记录时返回false
+func (this *SettlementStore) NextAttempt() (time.Time, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	var next time.Time
+	found := false
+	for _, entry := range this.entries {
+		if entry.Status == SettlementPending && (!found || entry.NextAttempt.Before(next)) {
+			next = entry.NextAttempt
+			found = true
+		}
+	}
+	return next, found
+}
+
+// 投递成功, 从存储中删除
+func (this *SettlementStore) MarkDelivered(key string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	entry, ok := this.entries[key]
+	if !ok {
+		return nil
+	}
+	delete(this.entries, key)
+	entry.Status = SettlementDelivered
+	return this.write(entry)
+}
+
+// 投递失败, 按退避时间安排重试, 超过maxAttempts次后转入死信列表
+func (this *SettlementStore) MarkFailed(key string, reason string, maxAttempts int) (*Settlement, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	entry, ok := this.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	entry.Attempts++
+	entry.LastError = reason
+	if entry.Attempts >= maxAttempts {
+		entry.Status = SettlementDead
+	} else {
+		entry.NextAttempt = this.clock.Now().Add(settlementBackoff(entry.Attempts))
+	}
+
+	copied := *entry
+	return &copied, this.write(entry)
+}
+
+// 死信列表
+func (this *SettlementStore) DeadLetters() []*Settlement {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.sorted(func(entry *Settlement) bool {
+		return entry.Status == SettlementDead
+	})
+}
+
+// 把死信重新放回投递队列并重置重试次数, key为空时重新投递全部死信, 返回重新投递的记录数
+func (this *SettlementStore) Replay(key string) (int, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	count := 0
+	var lastErr error
+	for _, entry := range this.entries {
+		if entry.Status != SettlementDead || (key != "" && entry.Key != key) {
+			continue
+		}
+		entry.Status = SettlementPending
+		entry.Attempts = 0
+		entry.NextAttempt = this.clock.Now()
+		if err := this.write(entry); err != nil {
+			lastErr = err
+		}
+		count++
+	}
+	return count, lastErr
+}
+
+// 第attempts次失败后的重试等待时间, 从1秒开始翻倍, 最长5分钟
+func settlementBackoff(attempts int) time.Duration {
+	backoff := time.Second
+	for i := 1; i < attempts && backoff < 5*time.Minute; i++ {
+		backoff *= 2
+	}
+	if backoff > 5*time.Minute {
+		backoff = 5 * time.Minute
+	}
+	return backoff
+}
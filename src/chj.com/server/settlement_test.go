@@ -0,0 +1,56 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSettlementStoreReload(t *testing.T) {
+	clock := NewFakeClock()
+	path := filepath.Join(t.TempDir(), "outbox.log")
+
+	store, err := OpenSettlementStore(clock, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivered, _ := store.Add("dev1", 7, "1")
+	pending, _ := store.Add("dev1", 8, "0")
+	dead, _ := store.Add("dev2", 9, "0")
+	store.MarkDelivered(delivered.Key)
+	store.MarkFailed(pending.Key, "timeout", 3)
+	store.MarkFailed(dead.Key, "timeout", 1)
+
+	// 重新打开后只剩未投递的记录
+	store, err = OpenSettlementStore(clock, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if due := store.Due(clock.Now()); len(due) != 0 {
+		t.Fatalf("due before backoff = %d", len(due))
+	}
+	clock.Advance(settlementBackoff(1))
+	due := store.Due(clock.Now())
+	if len(due) != 1 || due[0].Key != pending.Key || due[0].Attempts != 1 {
+		t.Fatalf("due = %+v", due)
+	}
+	deadLetters := store.DeadLetters()
+	if len(deadLetters) != 1 || deadLetters[0].Key != dead.Key || deadLetters[0].LastError != "timeout" {
+		t.Fatalf("dead letters = %+v", deadLetters)
+	}
+
+	// 新记录的序号接着之前的
+	added, _ := store.Add("dev1", 7, "1")
+	if added.Seq <= dead.Seq {
+		t.Fatalf("seq = %d", added.Seq)
+	}
+}
+
+func TestSettlementBackoff(t *testing.T) {
+	if settlementBackoff(1) != time.Second || settlementBackoff(3) != 4*time.Second {
+		t.Fatalf("backoff = %v, %v", settlementBackoff(1), settlementBackoff(3))
+	}
+	if settlementBackoff(100) != 5*time.Minute {
+		t.Fatalf("backoff = %v", settlementBackoff(100))
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+// 监督者-管理进程的崩溃重启
+// 每个子进程独立重启(one-for-one), 监督者在window时间内重启次数超过maxRestarts时升级到父监督者,
+// 父监督者同意后重置该监督者的重启计数并继续重启, 根监督者不同意时放弃重启
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// 子进程重启类型
+type RestartType int
+
+const (
+	Permanent RestartType = iota // 退出后总是重启
+	Transient                    // 崩溃时重启, 正常退出不重启
+	Temporary                    // 从不重启
+)
+
+// 子进程描述
+type ChildSpec struct {
+	Name    string
+	Restart RestartType
+
+	// 进程主循环, 正常返回表示进程退出, panic表示崩溃
+	Run func()
+	// 崩溃后调用, 此时进程主循环已停止, 可以直接访问进程状态
+	OnCrash func(reason interface{})
+	// 崩溃后不再重启时调用, 用于清理进程占用的资源
+	OnGiveUp func(reason interface{})
+
+	// 进程通信Handle, 放弃重启时停止并标记退出
+	Handle *RoutineHandle
+}
+
+type Supervisor struct {
+	name   string
+	parent *Supervisor
+
+	// 重启强度: window时间内最多重启maxRestarts次
+	maxRestarts int
+	window      time.Duration
+	// 重启前的等待时间
+	restartDelay time.Duration
+
+	lock     sync.Mutex
+	restarts []time.Time
+
+	// 重启计数和重启等待使用的时钟
+	clock Clock
+
+	// 手动模式: 不启动进程goroutine, 消息在调用方goroutine中处理, 用于测试
+	manual bool
+}
+
+func NewSupervisor(name string, parent *Supervisor, maxRestarts int, window time.Duration, restartDelay time.Duration) *Supervisor {
+	this := new(Supervisor)
+	this.name = name
+	this.parent = parent
+	this.maxRestarts = maxRestarts
+	this.window = window
+	this.restartDelay = restartDelay
+	this.clock = realClock{}
+	return this
+}
+
+// 启动子进程
+func (this *Supervisor) Start(spec *ChildSpec) {
+	if this.manual && spec.Handle != nil {
+		spec.Handle.inline = func(env *Envelope) {
+			this.runInline(spec, env)
+		}
+		return
+	}
+	go this.runChild(spec)
+}
+
+func (this *Supervisor) runChild(spec *ChildSpec) {
+	reason, crashed := this.execute(spec, spec.Run)
+	if !this.onExit(spec, reason, crashed) {
+		return
+	}
+
+	// 休眠一下再重启...
+	<-this.clock.After(this.restartDelay)
+	log.Println(this.name, "进程重启: ", spec.Name)
+	go this.runChild(spec)
+}
+
+// 手动模式下处理一条消息, 崩溃时按重启策略处理, 进程状态保留即视为重启
+func (this *Supervisor) runInline(spec *ChildSpec, env *Envelope) {
+	reason, crashed := this.execute(spec, func() {
+		spec.Handle.process(env)
+	})
+	if crashed && this.onExit(spec, reason, crashed) {
+		log.Println(this.name, "进程重启: ", spec.Name)
+	}
+
+	// 进程已停止, 处理完剩余的异步消息后退出
+	if spec.Handle.Destroyed() {
+		this.execute(spec, spec.Handle.drain)
+		spec.Handle.exit()
+	}
+}
+
+// 子进程退出后的处理, 需要重启时返回true
+func (this *Supervisor) onExit(spec *ChildSpec, reason interface{}, crashed bool) bool {
+	if crashed && spec.OnCrash != nil {
+		spec.OnCrash(reason)
+	}
+
+	if !this.shouldRestart(spec, crashed) {
+		if crashed {
+			log.Println(this.name, "进程崩溃, 不再重启: ", spec.Name)
+			this.giveUp(spec, reason)
+		}
+		return false
+	}
+
+	if !this.allowRestart() && !this.escalate(reason) {
+		log.Println(this.name, "重启次数过多, 放弃重启: ", spec.Name)
+		this.giveUp(spec, reason)
+		return false
+	}
+	return true
+}
+
+// 运行子进程主循环, 返回崩溃原因
+func (this *Supervisor) execute(spec *ChildSpec, run func()) (reason interface{}, crashed bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println(this.name, "进程崩溃: ", spec.Name, r)
+			reason = r
+			crashed = true
+		}
+	}()
+
+	run()
+	return nil, false
+}
+
+// 进程已被停止时不重启, 即使是Permanent
+func (this *Supervisor) shouldRestart(spec *ChildSpec, crashed bool) bool {
+	if spec.Handle != nil && spec.Handle.Destroyed() {
+		return false
+	}
+	switch spec.Restart {
+	case Permanent:
+		return true
+	case Transient:
+		return crashed
+	default:
+		return false
+	}
+}
+
+// 记录一次重启, 超过重启强度返回false
+func (this *Supervisor) allowRestart() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := this.clock.Now()
+	restarts := make([]time.Time, 0, len(this.restarts)+1)
+	for _, t := range this.restarts {
+		if now.Sub(t) < this.window {
+			restarts = append(restarts, t)
+		}
+	}
+	if len(restarts) >= this.maxRestarts {
+		this.restarts = restarts
+		return false
+	}
+	this.restarts = append(restarts, now)
+	return true
+}
+
+// 升级到父监督者, 父监督者同意时重置自己的重启计数并返回true
+func (this *Supervisor) escalate(reason interface{}) bool {
+	if this.parent == nil {
+		log.Println(this.name, "根监督者重启次数过多: ", reason)
+		return false
+	}
+
+	log.Println(this.name, "重启次数过多, 升级到: ", this.parent.name)
+	if !this.parent.allowRestart() && !this.parent.escalate(reason) {
+		return false
+	}
+
+	this.lock.Lock()
+	this.restarts = nil
+	this.lock.Unlock()
+	return true
+}
+
+func (this *Supervisor) giveUp(spec *ChildSpec, reason interface{}) {
+	if spec.OnGiveUp != nil {
+		spec.OnGiveUp(reason)
+	}
+	if spec.Handle != nil {
+		spec.Handle.Stop()
+		spec.Handle.exit()
+	}
+}
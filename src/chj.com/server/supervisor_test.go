@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// 创建手动模式的测试监督者
+func newTestSupervisor(name string, parent *Supervisor, clock Clock, maxRestarts int) *Supervisor {
+	sup := NewSupervisor(name, parent, maxRestarts, time.Minute, 0)
+	sup.manual = true
+	sup.clock = clock
+	return sup
+}
+
+// 记录子进程崩溃和放弃重启次数的ChildSpec
+type testChild struct {
+	spec    *ChildSpec
+	crashes int
+	giveUps int
+}
+
+func newTestChild(restart RestartType) *testChild {
+	this := new(testChild)
+	this.spec = &ChildSpec{
+		Name:    "Test",
+		Restart: restart,
+		OnCrash: func(reason interface{}) {
+			this.crashes++
+		},
+		OnGiveUp: func(reason interface{}) {
+			this.giveUps++
+		},
+	}
+	return this
+}
+
+func TestSupervisorRestartIntensity(t *testing.T) {
+	clock := NewFakeClock()
+	sup := newTestSupervisor("TestSup", nil, clock, 2)
+	protocol := NewProtocol(clock)
+
+	child := newTestChild(Permanent)
+	rh := NewRoutineHandle("Test", nil)
+	rh.handle(testCmd_Echo, func(ctx context.Context, params interface{}) (interface{}, error) {
+		return params, nil
+	})
+	rh.handle(testCmd_Panic, func(ctx context.Context, params interface{}) (interface{}, error) {
+		panic("boom")
+	})
+	child.spec.Handle = rh
+	child.spec.Run = rh.loop
+	sup.Start(child.spec)
+
+	// window内崩溃maxRestarts次仍然重启
+	for i := 0; i < 2; i++ {
+		if _, err := protocol.call(rh, testCmd_Panic, nil); !errors.Is(err, ErrHandlerPanic) {
+			t.Fatalf("err = %v, want ErrHandlerPanic", err)
+		}
+	}
+	if ret, err := protocol.call(rh, testCmd_Echo, "x"); err != nil || ret != "x" || rh.Destroyed() {
+		t.Fatalf("echo = %v, %v", ret, err)
+	}
+
+	// 超过window后重新计数
+	clock.Advance(time.Minute)
+	for i := 0; i < 2; i++ {
+		protocol.call(rh, testCmd_Panic, nil)
+	}
+	if rh.Destroyed() || child.giveUps != 0 {
+		t.Fatal("restart outside window refused")
+	}
+
+	// window内第三次崩溃时放弃重启, 进程被停止
+	protocol.call(rh, testCmd_Panic, nil)
+	if !rh.Destroyed() || child.crashes != 5 || child.giveUps != 1 {
+		t.Fatalf("destroyed = %v, crashes = %d, giveUps = %d", rh.Destroyed(), child.crashes, child.giveUps)
+	}
+	select {
+	case <-rh.Done():
+	default:
+		t.Fatal("routine not exited")
+	}
+	if _, err := protocol.call(rh, testCmd_Echo, "x"); !errors.Is(err, ErrDestroyed) {
+		t.Fatalf("err = %v, want ErrDestroyed", err)
+	}
+}
+
+func TestSupervisorRestartTypes(t *testing.T) {
+	clock := NewFakeClock()
+	cases := []struct {
+		restartType RestartType
+		crashed     bool
+		want        bool
+	}{
+		{Permanent, false, true},
+		{Permanent, true, true},
+		{Transient, false, false},
+		{Transient, true, true},
+		{Temporary, false, false},
+		{Temporary, true, false},
+	}
+	for _, c := range cases {
+		sup := newTestSupervisor("TestSup", nil, clock, 10)
+		child := newTestChild(c.restartType)
+		if restart := sup.onExit(child.spec, "boom", c.crashed); restart != c.want {
+			t.Fatalf("restart type %d, crashed %v: restart = %v", c.restartType, c.crashed, restart)
+		}
+
+		// 崩溃后不重启时放弃, 正常退出不算放弃
+		giveUps := 0
+		if c.crashed && !c.want {
+			giveUps = 1
+		}
+		if child.giveUps != giveUps {
+			t.Fatalf("restart type %d, crashed %v: giveUps = %d", c.restartType, c.crashed, child.giveUps)
+		}
+	}
+}
+
+func TestSupervisorEscalate(t *testing.T) {
+	clock := NewFakeClock()
+	root := newTestSupervisor("RootSup", nil, clock, 1)
+	sup := newTestSupervisor("TestSup", root, clock, 1)
+
+	// 自己的重启次数用完后升级到父监督者, 父监督者同意时重置重启计数
+	if !sup.allowRestart() {
+		t.Fatal("first restart refused")
+	}
+	if sup.allowRestart() {
+		t.Fatal("restart intensity not enforced")
+	}
+	if !sup.escalate("boom") {
+		t.Fatal("escalate refused by root")
+	}
+	if !sup.allowRestart() {
+		t.Fatal("restart count not reset after escalate")
+	}
+
+	// 父监督者的重启次数也用完, 根监督者放弃
+	if sup.allowRestart() || sup.escalate("boom") {
+		t.Fatal("escalate allowed after root exhausted")
+	}
+
+	child := newTestChild(Permanent)
+	if sup.onExit(child.spec, "boom", true) || child.giveUps != 1 {
+		t.Fatalf("giveUps = %d", child.giveUps)
+	}
+
+	// 超过window后重新计数, 同意重启
+	clock.Advance(time.Minute)
+	child = newTestChild(Permanent)
+	if !sup.onExit(child.spec, "boom", true) || child.giveUps != 0 {
+		t.Fatal("restart refused after window")
+	}
+}
+
+func TestSupervisorRestartDelay(t *testing.T) {
+	clock := NewFakeClock()
+	sup := NewSupervisor("TestSup", nil, 10, time.Minute, 3*time.Second)
+	sup.clock = clock
+
+	// 第一次运行崩溃, 等待restartDelay后重启
+	runs := make(chan int, 2)
+	count := 0
+	sup.Start(&ChildSpec{Name: "Test", Restart: Transient, Run: func() {
+		count++
+		runs <- count
+		if count == 1 {
+			panic("boom")
+		}
+	}})
+	<-runs
+
+	clock.BlockUntil(1)
+	select {
+	case <-runs:
+		t.Fatal("restarted before delay")
+	default:
+	}
+	clock.Advance(3 * time.Second)
+	if n := <-runs; n != 2 {
+		t.Fatalf("run = %d", n)
+	}
+}
+
+// 被停止的Permanent进程正常退出后不重启, 不占用重启次数
+func TestSupervisorStoppedPermanent(t *testing.T) {
+	clock := NewFakeClock()
+	sup := NewSupervisor("TestSup", nil, 1, time.Minute, 0)
+	sup.clock = clock
+
+	rh := NewRoutineHandle("Test", nil)
+	runs := make(chan struct{}, 2)
+	sup.Start(&ChildSpec{Name: "Test", Restart: Permanent, Handle: rh, Run: func() {
+		runs <- struct{}{}
+		rh.loop()
+	}})
+	<-runs
+
+	rh.Stop()
+	<-rh.Done()
+	select {
+	case <-runs:
+		t.Fatal("stopped child restarted")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if !sup.allowRestart() {
+		t.Fatal("stopped child used restart intensity")
+	}
+}
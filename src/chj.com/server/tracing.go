@@ -0,0 +1,312 @@
+package main
+
+// 进程调用链追踪-每个call/cast记录一个span, 以OpenTelemetry(OTLP/JSON)格式导出
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// span类型, 取值与OTLP一致
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1 + iota
+	SpanKindServer
+	SpanKindClient
+	SpanKindProducer
+	SpanKindConsumer
+)
+
+type Span struct {
+	TraceId      string
+	SpanId       string
+	ParentSpanId string
+	Name         string
+	Kind         SpanKind
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]interface{}
+	Err          error
+}
+
+type spanCtxKey struct{}
+
+// 开始一个span, 父span从ctx中获取, 没有则开始新的trace; 追踪关闭时返回nil span
+func StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if currentTracer() == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		SpanId:     newTraceId(8),
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: make(map[string]interface{}),
+	}
+	if parent := SpanFrom(ctx); parent != nil {
+		span.TraceId = parent.TraceId
+		span.ParentSpanId = parent.SpanId
+	} else {
+		span.TraceId = newTraceId(16)
+	}
+
+	// 请求上下文中的信息记录到span上
+	if requestId := RequestIdFrom(ctx); requestId != "" {
+		span.Attributes["request.id"] = requestId
+	}
+	if userId := UserIdFrom(ctx); userId != 0 {
+		span.Attributes["user.id"] = userId
+	}
+	if deviceName := DeviceNameFrom(ctx); deviceName != "" {
+		span.Attributes["device.name"] = deviceName
+	}
+
+	return context.WithValue(ctx, spanCtxKey{}, span), span
+}
+
+// 获取ctx中当前的span
+func SpanFrom(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanCtxKey{}).(*Span)
+	return span
+}
+
+// 获取ctx中的trace id, 没有时返回空串
+func TraceIdFrom(ctx context.Context) string {
+	if span := SpanFrom(ctx); span != nil {
+		return span.TraceId
+	}
+	return ""
+}
+
+func (this *Span) SetAttribute(key string, value interface{}) {
+	if this == nil {
+		return
+	}
+	this.Attributes[key] = value
+}
+
+// 结束span并提交导出, err为nil表示成功
+func (this *Span) Finish(err error) {
+	if this == nil {
+		return
+	}
+	this.End = time.Now()
+	this.Err = err
+	if tracer := currentTracer(); tracer != nil {
+		tracer.record(this)
+	}
+}
+
+func newTraceId(size int) string {
+	buf := make([]byte, size)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+//////////////////////////////////////////////////////////
+// 追踪器
+
+// span导出器
+type SpanExporter interface {
+	Export(spans []*Span) error
+}
+
+type Tracer struct {
+	exporter SpanExporter
+	spanC    chan *Span
+	// 立即导出请求, 导出完成后关闭请求中的channel
+	flushC chan chan struct{}
+
+	// 缓冲区满丢弃的span数
+	dropped int64
+}
+
+// 全局追踪器, nil表示关闭追踪
+var tracer atomic.Value
+
+func currentTracer() *Tracer {
+	t, _ := tracer.Load().(*Tracer)
+	return t
+}
+
+// 设置全局追踪器
+func SetTracer(t *Tracer) {
+	tracer.Store(t)
+}
+
+func NewTracer(exporter SpanExporter) *Tracer {
+	this := new(Tracer)
+	this.exporter = exporter
+	this.spanC = make(chan *Span, 4096)
+	this.flushC = make(chan chan struct{})
+	go this.run()
+	return this
+}
+
+// 记录span, 缓冲区满时丢弃, 不阻塞业务进程
+func (this *Tracer) record(span *Span) {
+	select {
+	case this.spanC <- span:
+	default:
+		atomic.AddInt64(&this.dropped, 1)
+	}
+}
+
+// 立即导出已记录的span, 导出完成后返回
+func (this *Tracer) Flush() {
+	done := make(chan struct{})
+	this.flushC <- done
+	<-done
+}
+
+// 批量导出, 攒够100个或每秒导出一次
+func (this *Tracer) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, 100)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := this.exporter.Export(batch); err != nil {
+			log.Println("导出追踪数据失败: ", err)
+		}
+		batch = make([]*Span, 0, 100)
+	}
+
+	for {
+		select {
+		case span := <-this.spanC:
+			batch = append(batch, span)
+			if len(batch) >= 100 {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case done := <-this.flushC:
+			for drained := false; !drained; {
+				select {
+				case span := <-this.spanC:
+					batch = append(batch, span)
+				default:
+					drained = true
+				}
+			}
+			flush()
+			close(done)
+		}
+	}
+}
+
+//////////////////////////////////////////////////////////
+// OTLP/JSON导出器, 每批span写一行
+
+type jsonExporter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// 输出到标准输出
+func NewStdoutExporter() SpanExporter {
+	return &jsonExporter{w: os.Stdout}
+}
+
+// 追加写入到文件
+func NewFileExporter(path string) (SpanExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonExporter{w: f}, nil
+}
+
+func (this *jsonExporter) Export(spans []*Span) error {
+	otlpSpans := make([]interface{}, 0, len(spans))
+	for _, span := range spans {
+		otlpSpans = append(otlpSpans, otlpSpan(span))
+	}
+
+	data := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]interface{}{"service.name": "gogame"}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "chj.com/server"},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	}
+
+	line, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	_, err = this.w.Write(append(line, '\n'))
+	return err
+}
+
+func otlpSpan(span *Span) map[string]interface{} {
+	status := map[string]interface{}{"code": 1} // STATUS_CODE_OK
+	if span.Err != nil {
+		status = map[string]interface{}{"code": 2, "message": span.Err.Error()} // STATUS_CODE_ERROR
+	}
+
+	ret := map[string]interface{}{
+		"traceId":           span.TraceId,
+		"spanId":            span.SpanId,
+		"name":              span.Name,
+		"kind":              int(span.Kind),
+		"startTimeUnixNano": strconv.FormatInt(span.Start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(span.End.UnixNano(), 10),
+		"attributes":        otlpAttributes(span.Attributes),
+		"status":            status,
+	}
+	if span.ParentSpanId != "" {
+		ret["parentSpanId"] = span.ParentSpanId
+	}
+	return ret
+}
+
+func otlpAttributes(attrs map[string]interface{}) []interface{} {
+	ret := make([]interface{}, 0, len(attrs))
+	for key, value := range attrs {
+		var v map[string]interface{}
+		switch value := value.(type) {
+		case string:
+			v = map[string]interface{}{"stringValue": value}
+		case bool:
+			v = map[string]interface{}{"boolValue": value}
+		case int:
+			v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+		case int64:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+		case float64:
+			v = map[string]interface{}{"doubleValue": value}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+		}
+		ret = append(ret, map[string]interface{}{"key": key, "value": v})
+	}
+	return ret
+}
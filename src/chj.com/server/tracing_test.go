@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// 解析导出的OTLP/JSON, 返回所有span
+func parseOtlpSpans(t *testing.T, output string) []map[string]interface{} {
+	var spans []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		var data struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []map[string]interface{} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.Unmarshal([]byte(line), &data); err != nil {
+			t.Fatalf("bad otlp line %q: %v", line, err)
+		}
+		for _, resource := range data.ResourceSpans {
+			for _, scope := range resource.ScopeSpans {
+				spans = append(spans, scope.Spans...)
+			}
+		}
+	}
+	return spans
+}
+
+// 按名称和类型查找span
+func findSpan(t *testing.T, spans []map[string]interface{}, name string, kind SpanKind) map[string]interface{} {
+	for _, span := range spans {
+		if span["name"] == name && span["kind"] == float64(kind) {
+			return span
+		}
+	}
+	t.Fatalf("span %s(%d) not exported", name, kind)
+	return nil
+}
+
+// 获取span的字符串属性
+func spanAttribute(span map[string]interface{}, key string) string {
+	attrs, _ := span["attributes"].([]interface{})
+	for _, attr := range attrs {
+		attr, _ := attr.(map[string]interface{})
+		if attr["key"] == key {
+			value, _ := attr["value"].(map[string]interface{})
+			s, _ := value["stringValue"].(string)
+			return s
+		}
+	}
+	return ""
+}
+
+func TestTracePropagation(t *testing.T) {
+	h := NewHarness(t)
+	output := new(bytes.Buffer)
+	tracer := NewTracer(&jsonExporter{w: output})
+	SetTracer(tracer)
+	defer SetTracer((*Tracer)(nil))
+
+	// TraceA处理call时cast给TraceB
+	rhB := NewRoutineHandle("TraceB", nil)
+	rhB.handle(testCmd_Echo, func(ctx context.Context, params interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	rhA := NewRoutineHandle("TraceA", nil)
+	rhA.handle(testCmd_Echo, func(ctx context.Context, params interface{}) (interface{}, error) {
+		return params, h.facade.protocol.CastCtx(ctx, rhB, testCmd_Echo, params)
+	})
+	h.facade.rootSup.Start(&ChildSpec{Name: "TraceA", Restart: Transient, Run: rhA.loop, Handle: rhA})
+	h.facade.rootSup.Start(&ChildSpec{Name: "TraceB", Restart: Transient, Run: rhB.loop, Handle: rhB})
+
+	ctx, root := StartSpan(WithRequestId(context.Background(), "req1"), "api test", SpanKindServer)
+	if _, err := h.facade.protocol.CallCtx(ctx, rhA, testCmd_Echo, "x"); err != nil {
+		t.Fatalf("call: %v", err)
+	}
+	rhB.step()
+	root.Finish(nil)
+	tracer.Flush()
+
+	spans := parseOtlpSpans(t, output.String())
+	chain := []map[string]interface{}{
+		findSpan(t, spans, "api test", SpanKindServer),
+		findSpan(t, spans, "call testCmd_Echo", SpanKindClient),
+		findSpan(t, spans, "handle testCmd_Echo", SpanKindServer),
+		findSpan(t, spans, "cast testCmd_Echo", SpanKindProducer),
+		findSpan(t, spans, "handle testCmd_Echo", SpanKindConsumer),
+	}
+
+	// 同一个trace, 每个span的父span是链上的前一个
+	if _, ok := chain[0]["parentSpanId"]; ok || chain[0]["traceId"] != root.TraceId {
+		t.Fatalf("root span = %v", chain[0])
+	}
+	for i := 1; i < len(chain); i++ {
+		if chain[i]["traceId"] != root.TraceId {
+			t.Fatalf("%s traceId = %v, want %s", chain[i]["name"], chain[i]["traceId"], root.TraceId)
+		}
+		if chain[i]["parentSpanId"] != chain[i-1]["spanId"] {
+			t.Fatalf("%s parentSpanId = %v, want %v", chain[i]["name"], chain[i]["parentSpanId"], chain[i-1]["spanId"])
+		}
+	}
+
+	// 请求信息和处理进程记录在span属性上
+	if spanAttribute(chain[4], "request.id") != "req1" || spanAttribute(chain[4], "actor") != "TraceB" {
+		t.Fatalf("consumer span attributes = %v", chain[4]["attributes"])
+	}
+	if spanAttribute(chain[2], "actor") != "TraceA" || spanAttribute(chain[4], "lane") != "normal" {
+		t.Fatal("actor or lane attribute missing")
+	}
+}
@@ -3,13 +3,12 @@ package main
 // game对象-处理game请求
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log"
-	"runtime/debug"
 	"strings"
 	"time"
-
-	"golang.org/x/net/websocket"
 )
 
 // 与Game进程通信协议
@@ -25,146 +24,310 @@ const (
 	Game_Watch                               // 列表观察
 	Game_Unwatch                             // 取消列表观察
 	Game_RecvMessage                         // 接收game消息
+	Game_OfferTimeout                        // 排队邀请确认超时
+	Game_RoundTick                           // 游戏倒计时
+	Game_ResultTimeout                       // 等待抓取结果超时
+	Game_RetryTimeout                        // 重试窗口超时
+	Game_Maintenance                         // 进入或退出维护
+	Game_Operator                            // 设置维护中操作设备的员工
+	Game_PrizeChanged                        // 奖品库存变化
 )
 
+// Game_Init 参数
+type GameInitReq struct {
+	Facade *Facade
+	Ws     Conn
+}
+
+// Game_Join 参数
+type GameJoinReq struct {
+	PlayerId int
+	PlayerRH *RoutineHandle
+}
+
+// Game_Control 参数, Result仅在start时有效
+type GameControlReq struct {
+	ControlType string
+	PlayerId    int
+	Result      int
+}
+
+// Game_BroadcastMessage 参数, 发言玩家和聊天内容
+type GameBroadcastReq struct {
+	PlayerId int
+	Message  string
+}
+
+// Game_Maintenance 参数, Operator为操作的员工, 记录到审计日志
+type GameMaintenanceReq struct {
+	Enable   bool
+	Operator string
+	Reason   string
+}
+
+// Game_Operator 参数, PlayerId为员工的玩家账号, 0表示结束员工操作
+type GameOperatorReq struct {
+	PlayerId int
+	Operator string
+}
+
+// Game_GetDeviceInfo 返回值
+type DeviceInfo struct {
+	DeviceName        string `json:"deviceName"`
+	DeviceStatus      string `json:"deviceStatus"`
+	CurPlayer         int    `json:"curPlayer"`
+	QueueLength       int    `json:"queueLength"`
+	MaintenanceReason string `json:"maintenanceReason,omitempty"`
+	OperatorPlayer    int    `json:"operatorPlayer,omitempty"`
+	Prize             *Prize `json:"prize,omitempty"`
+}
+
+func init() {
+	RegisterCommand(Game_Init, "Game_Init", (*GameInitReq)(nil))
+	RegisterCommand(Game_Logout, "Game_Logout", nil)
+	RegisterCommand(Game_Kickout, "Game_Kickout", nil)
+	RegisterCommand(Game_GetDeviceInfo, "Game_GetDeviceInfo", nil)
+	RegisterCommand(Game_Join, "Game_Join", (*GameJoinReq)(nil))
+	RegisterCommand(Game_Leave, "Game_Leave", 0)
+	RegisterCommand(Game_BroadcastMessage, "Game_BroadcastMessage", (*GameBroadcastReq)(nil))
+	RegisterCommand(Game_Control, "Game_Control", (*GameControlReq)(nil))
+	RegisterCommand(Game_RecvMessage, "Game_RecvMessage", "")
+	RegisterCommand(Game_OfferTimeout, "Game_OfferTimeout", 0)
+	RegisterCommand(Game_RoundTick, "Game_RoundTick", 0)
+	RegisterCommand(Game_ResultTimeout, "Game_ResultTimeout", 0)
+	RegisterCommand(Game_RetryTimeout, "Game_RetryTimeout", 0)
+	RegisterCommand(Game_Maintenance, "Game_Maintenance", (*GameMaintenanceReq)(nil))
+	RegisterCommand(Game_Operator, "Game_Operator", (*GameOperatorReq)(nil))
+	RegisterCommand(Game_PrizeChanged, "Game_PrizeChanged", nil)
+
+	// 控制指令和设备消息优先于聊天, 进出房间处理
+	SetCommandLane(Game_Control, LaneControl)
+	SetCommandLane(Game_RecvMessage, LaneControl)
+	SetCommandLane(Game_OfferTimeout, LaneControl)
+	SetCommandLane(Game_RoundTick, LaneControl)
+	SetCommandLane(Game_ResultTimeout, LaneControl)
+	SetCommandLane(Game_RetryTimeout, LaneControl)
+	SetCommandLane(Game_Maintenance, LaneControl)
+	SetCommandLane(Game_Operator, LaneControl)
+	SetCommandLane(Game_PrizeChanged, LaneControl)
+}
+
 type Game struct {
 	facade    *Facade
 	protocol  *Protocol
 	sessionRH *RoutineHandle
+	registry  *Registry
+	clock     Clock
 
 	// 进程通信Handle
 	rh *RoutineHandle
 
 	// 客户端连接
-	ws *websocket.Conn
+	ws Conn
 
 	// 当前token和名称
-	GameToken string
-	deviceName  string
+	GameToken  string
+	deviceName string
 
 	// 房间内所有玩家
 	players map[int]*RoutineHandle
 	// 按加入顺序排列的玩家列表, 先加入的在前面
 	playerIds []int
+	// 玩家最后一次发言的时间, 用于慢速模式
+	chatTimes map[int]time.Time
 
-	// game当前状态
-	GameStatus string
+	// 设备状态
+	state *DeviceStateMachine
 
 	// 当前玩家Id
 	curPlayerId int
+	// 当前玩家开始游戏时php服务器计算的结果, 免费重试时沿用
+	curResult int
 
 	// 当前玩家是否离开
 	isLeave bool
 
-	// 是否被踢下线
+	// 是否被踢下线, 踢下线后设备归新登陆的进程控制, 不再自动下爪, 重置设备或广播离线
 	isKickout bool
 
+	// 发给设备的挑战随机串, 空表示没有等待应答的挑战
+	loginNonce string
+
 	// 游戏开始时间
 	startTime int64
+
+	// 进行中的回合记录, 结束时保存
+	playRound *PlayRound
+
+	// 排队等待游戏的玩家, 先排队的在前面
+	queue []int
+	// 被邀请开始游戏的玩家, 需要在确认时间内开始游戏, 超时跳过
+	offerPlayerId int
+	// 邀请序号, 用于忽略已取消邀请的超时消息
+	offerSeq   int
+	offerTimer Timer
+
+	// 回合序号, 用于忽略已结束回合的定时消息
+	roundSeq int
+	// 回合结束时间, 到时自动下爪, 为零值表示没有进行中的回合
+	roundDeadline time.Time
+	// 已经下爪, 等待设备返回结果
+	roundCatching bool
+	// 倒计时或等待结果的定时器
+	roundTimer Timer
+
+	// 重试窗口内独占设备的玩家, 0表示没有重试窗口
+	retryPlayerId int
+	retrySeq      int
+	retryTimer    Timer
+
+	// 维护原因, 为空表示不在维护中
+	maintenanceReason string
+	// 等待当前回合结束后进入维护
+	maintenancePending bool
+	// 维护中可以操作设备的员工, 员工的游戏不收费也不记录结果
+	operatorPlayerId int
 }
 
-func NewGame(facade *Facade, ws *websocket.Conn) *RoutineHandle {
+func NewGame(facade *Facade, ws Conn) *RoutineHandle {
 	this := new(Game)
-	this.rh = NewRoutineHandle()
-	go this.run()
-	facade.protocol.call(this.rh, Game_Init, []interface{}{facade, ws})
+	this.rh = NewRoutineHandle("Game", facade.config.mailboxConfig("game"))
+	// 消息堆积时断开连接, 由Server处理登出
+	this.rh.setOnOverflow(func() { ws.Close() })
+	this.registerHandlers()
+	facade.gameSup.Start(&ChildSpec{
+		Name:     "Game",
+		Restart:  Transient,
+		Run:      this.run,
+		Handle:   this.rh,
+		OnCrash:  this.onCrash,
+		OnGiveUp: this.onGiveUp,
+	})
+	facade.protocol.call(this.rh, Game_Init, &GameInitReq{facade, ws})
 	return this.rh
 }
 
-func (this *Game) run() {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Println("Game进程崩溃, 3秒后重启: ", r)
-			log.Printf("%s", debug.Stack())
+// 注册命令处理函数
+func (this *Game) registerHandlers() {
+	this.rh.handle(Game_Init, this.onInit)
+	this.rh.handle(Game_Logout, this.onLogout)
+	this.rh.handle(Game_Kickout, this.onKickout)
+	this.rh.handle(Game_GetDeviceInfo, this.onGetDeviceInfo)
+	this.rh.handle(Game_Join, this.onJoin)
+	this.rh.handle(Game_Leave, this.onLeave)
+	this.rh.handle(Game_BroadcastMessage, this.onBroadcastMessage)
+	this.rh.handle(Game_Control, this.onControl)
+	this.rh.handle(Game_RecvMessage, this.onRecvMessage)
+	this.rh.handle(Game_OfferTimeout, this.onOfferTimeout)
+	this.rh.handle(Game_RoundTick, this.onRoundTick)
+	this.rh.handle(Game_ResultTimeout, this.onResultTimeout)
+	this.rh.handle(Game_RetryTimeout, this.onRetryTimeout)
+	this.rh.handle(Game_Maintenance, this.onMaintenance)
+	this.rh.handle(Game_Operator, this.onOperator)
+	this.rh.handle(Game_PrizeChanged, this.onPrizeChanged)
+}
 
-			// 休眠一下再重启...
-			time.Sleep(time.Second * 3)
-			log.Println("Game进程重启!")
-			go this.run()
-		}
-	}()
+func (this *Game) run() {
+	this.rh.loop()
+}
 
-	for {
-		select {
-		case recv := <-this.rh.callC:
-			cmd, _ := recv.([]interface{})
-			switch cmd[0] {
-			case Game_Init:
-				this.onInit(cmd[1].([]interface{}))
-			case Game_Logout:
-				this.onLogout()
-			case Game_Kickout:
-				this.onKickout()
-			case Game_GetDeviceInfo:
-				this.onGetDeviceInfo()
-			case Game_Join:
-				this.onJoin(cmd[1].([]interface{}))
-			case Game_Leave:
-				this.onLeave(cmd[1].(int))
-			case Game_BroadcastMessage:
-				this.onBroadcastMessage(cmd[1].(string))
-			case Game_Control:
-				this.onControl(cmd[1].([]interface{}))
-			default:
-				log.Println("Game 未处理的命令: ", cmd[0])
-				this.rh.callC <- nil
-			}
-		case recv := <-this.rh.castC:
-			cmd, _ := recv.([]interface{})
-			switch cmd[0] {
-			case Game_RecvMessage:
-				this.onRecvMessage(cmd[1].(string))
-			default:
-				log.Println("Game 未处理的命令: ", cmd[0])
-			}
-		}
+// 进程崩溃, 设备进入故障状态并通知玩家
+func (this *Game) onCrash(reason interface{}) {
+	if this.deviceName == "" {
+		return
 	}
+	this.changeState(context.Background(), StateError, fmt.Sprint("crash: ", reason))
 }
 
-func (this *Game) onInit(params []interface{}) {
-	defer func() {
-		this.rh.callC <- nil
-	}()
+// 进程不再重启, 从会话管理器删除自己并断开设备连接
+func (this *Game) onGiveUp(reason interface{}) {
+	this.onLogout(context.Background(), nil)
+	this.ws.Close()
+}
 
-	this.facade = params[0].(*Facade)
+func (this *Game) onInit(ctx context.Context, params interface{}) (interface{}, error) {
+	req := params.(*GameInitReq)
+	this.facade = req.Facade
 	this.protocol = this.facade.protocol
 	this.sessionRH = this.facade.sessionRH
-	this.ws = params[1].(*websocket.Conn)
+	this.registry = this.facade.registry
+	this.clock = this.facade.clock
+	this.ws = req.Ws
 
 	this.GameToken = ""
 	this.deviceName = ""
 
 	this.players = make(map[int]*RoutineHandle)
 	this.playerIds = make([]int, 0)
+	this.chatTimes = make(map[int]time.Time)
 
-	this.GameStatus = "error"
+	this.state = NewDeviceStateMachine(this.clock)
+	this.state.Subscribe(this.onStateChange)
 	this.curPlayerId = 0
+	this.curResult = 0
 	this.isLeave = false
 	this.isKickout = false
+	this.loginNonce = ""
 	this.startTime = 0
+	this.playRound = nil
+
+	this.queue = make([]int, 0)
+	this.offerPlayerId = 0
+	this.offerSeq = 0
+	this.offerTimer = nil
+
+	this.roundSeq = 0
+	this.roundCatching = false
+	this.roundTimer = nil
+
+	this.retryPlayerId = 0
+	this.retrySeq = 0
+	this.retryTimer = nil
+
+	this.maintenancePending = false
+	this.maintenanceReason = ""
+	this.operatorPlayerId = 0
+	return nil, nil
 }
 
 // 接收game的消息
-func (this *Game) onRecvMessage(message string) {
-	// 解析json请求,然后路由处理
-	var msgObj map[string]interface{}
-	if err := json.Unmarshal([]byte(message), &msgObj); err != nil {
+func (this *Game) onRecvMessage(ctx context.Context, params interface{}) (interface{}, error) {
+	message := params.(string)
+
+	// 解析json请求,然后路由处理, 格式错误的消息返回错误, 不处理
+	msg, err := parseClientMessage(message)
+	if err != nil {
 		log.Println("解析客户端消息出错: ", err, message)
+		return nil, err
 	}
 
-	msgType := msgObj["type"].(string)
-	switch msgType {
+	if this.deviceName != "" {
+		ctx = WithDeviceName(ctx, this.deviceName)
+	}
+
+	var data string
+	var object map[string]interface{}
+	switch msg.Type {
 	case "heartBeat": // 心跳包
-		this.onHeartBeat(msgObj["data"].(string))
+		if data, err = msg.String(); err == nil {
+			this.onHeartBeat(data)
+		}
 	case "login": // 登陆
-		this.onLogin(msgObj["data"].(string))
+		if data, err = msg.String(); err == nil {
+			this.onLogin(ctx, data)
+		}
 	case "status": // 同步状态
-		this.onStatus(msgObj["data"].(map[string]interface{}))
+		if object, err = msg.Object(); err == nil {
+			this.onStatus(ctx, object)
+		}
 	case "result": // 抓取结果
-		this.onResult(msgObj["data"].(map[string]interface{}))
+		if object, err = msg.Object(); err == nil {
+			this.onResult(ctx, object)
+		}
 	default:
-		log.Println("Game未处理的消息类型: ", msgType)
+		log.Println("Game未处理的消息类型: ", msg.Type)
 	}
+	return nil, err
 }
 
 // 心跳包
@@ -175,47 +338,104 @@ func (this *Game) onHeartBeat(data string) {
 	this.sendMessage("heartBeat", data)
 }
 
-// 登陆
-func (this *Game) onLogin(GameToken string) {
-	log.Println("Game.onLogin: ", GameToken)
+// 登陆, token格式见device.go
+func (this *Game) onLogin(ctx context.Context, GameToken string) {
 	if GameToken == "" {
 		this.loginResponse(1, "invalid token1")
 		return
 	}
 
+	// token中有密钥, 只记录设备名
 	tokenArr := strings.Split(GameToken, ":")
 	deviceName := tokenArr[0]
+	log.Println("Game.onLogin: ", deviceName)
 
 	if deviceName == "" {
 		this.loginResponse(1, "invalid token2")
 		return
 	}
 
-	// TODO 使用token进行登录, 从数据库取出token进行校验
-	//	sessionModel := model.NewSessionModel(int32(userId))
-	//	if sessionModel.GetToken() != userToken {
-	//		this.loginResponse(1, "invalid token4")
-	//		return
-	//	}
+	// 校验设备, 挑战只能应答一次
+	var err error
+	nonce := this.loginNonce
+	this.loginNonce = ""
+	switch len(tokenArr) {
+	case 1:
+		if err = this.facade.devices.CheckEnabled(deviceName); err == nil {
+			this.sendChallenge()
+			return
+		}
+	case 2:
+		if this.facade.config.devicesEnroll {
+			err = this.enrollDevice(deviceName, tokenArr[1])
+		} else {
+			err = this.facade.devices.CheckSecret(deviceName, tokenArr[1])
+		}
+	case 3:
+		if nonce == "" || tokenArr[1] != nonce {
+			err = ErrDeviceSignature
+		} else {
+			err = this.facade.devices.CheckChallenge(deviceName, nonce, tokenArr[2])
+		}
+	default:
+		err = ErrDeviceSecret
+	}
+	if err != nil {
+		this.rejectLogin(deviceName, err)
+		return
+	}
 
 	this.GameToken = GameToken
 	this.deviceName = deviceName
+	this.state.setDeviceName(deviceName)
+	ctx = WithDeviceName(ctx, deviceName)
 
-	// 登陆成功, 把自己记录到Session中
-	response := this.protocol.call(this.sessionRH, Session_GetGame, this.deviceName)
-	if response != nil {
+	// 登陆成功, 把自己登记到注册表中
+	GameRH := this.registry.Register(KindGame, this.deviceName, this.rh)
+	if GameRH != nil && !GameRH.Destroyed() {
 		// 已经在别处登陆了,踢下线
-		GameRH := response.(*RoutineHandle)
-		if GameRH != nil && !GameRH.destroyed {
-			this.protocol.call(GameRH, Game_Kickout, nil)
-		}
+		this.protocol.CallCtx(ctx, GameRH, Game_Kickout, nil)
 	}
-	this.protocol.call(this.sessionRH, Session_AddGame, []interface{}{this.deviceName, this.rh})
 
 	// 发送登陆成功消息
 	this.loginResponse(0, "ok")
 }
 
+// 升级期间没有登记的设备首次登陆时登记, 之后按登记的密钥校验
+func (this *Game) enrollDevice(deviceName string, secret string) error {
+	enrolled, err := this.facade.devices.Enroll(deviceName, secret)
+	if enrolled {
+		log.Println("Game.enrollDevice: ", deviceName)
+		this.facade.audit.Record(&AuditEntry{
+			Action:     "deviceEnrolled",
+			DeviceName: deviceName,
+		})
+	}
+	return err
+}
+
+// 发送挑战随机串, 设备用密钥签名后再次登陆
+func (this *Game) sendChallenge() {
+	this.loginNonce = newTraceId(16)
+	response := make(map[string]interface{})
+	response["code"] = 2
+	response["message"] = "challenge"
+	response["nonce"] = this.loginNonce
+	this.sendMessage("login", response)
+}
+
+// 拒绝登陆, 记录审计日志后断开连接, 避免在同一连接上反复尝试
+func (this *Game) rejectLogin(deviceName string, err error) {
+	log.Println("Game.rejectLogin: ", deviceName, err)
+	this.facade.audit.Record(&AuditEntry{
+		Action:     "deviceLoginRejected",
+		DeviceName: deviceName,
+		Detail:     err.Error(),
+	})
+	this.loginResponse(1, err.Error())
+	this.ws.Close()
+}
+
 func (this *Game) loginResponse(code int, message string) {
 	response := make(map[string]interface{})
 	response["code"] = code
@@ -223,109 +443,187 @@ func (this *Game) loginResponse(code int, message string) {
 	this.sendMessage("login", response)
 }
 
-func (this *Game) onStatus(params map[string]interface{}) {
+func (this *Game) onStatus(ctx context.Context, params map[string]interface{}) {
 	log.Println("Game.onStatus", params)
 
-	deviceStatus, _ := params["deviceStatus"]
-	curPlayer, _ := params["curPlayer"]
-	this.GameStatus = deviceStatus.(string)
-	this.curPlayerId = int(curPlayer.(float64))
+	if this.deviceName == "" {
+		log.Println("Game.onStatus: not login")
+		return
+	}
+
+	deviceStatus, _ := params["deviceStatus"].(string)
+	curPlayer, _ := params["curPlayer"].(float64)
+	state, err := ParseDeviceState(deviceStatus)
+	if err != nil {
+		log.Println("Game.onStatus: ", this.deviceName, err)
+		return
+	}
+	this.recordDeviceReport(ctx, deviceStatus)
+
+	// 排队邀请, 重试窗口和库存由服务器管理, 设备报告空闲时保持原来的状态
+	if current := this.state.State(); state == StateReady && (current == StateReserved || current == StateOutOfStock) {
+		return
+	}
+
+	// 维护状态由服务器管理, 只接受设备报告故障
+	if this.state.State() == StateMaintenance && state != StateError {
+		return
+	}
 
-	// 清除离开状态
+	// 状态变化由状态机广播, 不允许的变化保持原来的状态
+	prevPlayerId := this.curPlayerId
+	this.curPlayerId = int(curPlayer)
+	if !this.changeState(ctx, state, "device status") {
+		this.curPlayerId = prevPlayerId
+		return
+	}
+
+	// 清除离开状态, 结束回合
 	if this.curPlayerId == 0 {
 		this.isLeave = false
 		this.startTime = 0
+		this.endRound()
+		this.finishPlayRound("device idle")
 	}
 
-	// 广播game状态消息
-	this.broadcastGameStatus(this.GameStatus, this.curPlayerId)
+	// game空闲了, 邀请下一个排队的玩家
+	this.offerNext()
 }
 
-func (this *Game) onResult(params map[string]interface{}) {
+func (this *Game) onResult(ctx context.Context, params map[string]interface{}) {
 	log.Println("Game.onResult", params)
 
-	playResult0, _ := params["playResult"]
-	curPlayer0, _ := params["curPlayer"]
-	playResult := playResult0.(string)
-	curPlayer := int(curPlayer0.(float64))
+	playResult, ok := params["playResult"].(string)
+	curPlayer0, ok2 := params["curPlayer"].(float64)
+	if !ok || !ok2 {
+		log.Println("Game.onResult: 结果格式错误", this.deviceName, params)
+		return
+	}
+	curPlayer := int(curPlayer0)
 
 	if this.curPlayerId != curPlayer {
 		log.Println("Game result curPlayer != this.curPlayerId")
 		return
 	}
 
-	// 调用php服务器记录游戏结果
-	resp := this.facade.callApi("play", "GetResult", []interface{}{this.facade.config.apiSecret, this.deviceName, curPlayer, playResult})
-	if resp == nil {
+	// 收到结果, 停止等待结果的定时器
+	this.endRound()
+
+	// 员工测试的结果不结算
+	if this.state.State() == StateMaintenance {
+		this.onOperatorResult(ctx, playResult)
 		return
 	}
 
-	// 通知玩家游戏结果
-	this.sendGameResultToCurPlayer(playResult)
+	this.changeState(ctx, StateSettling, "result")
+
+	// 结果先写入结算记录, 由结算投递进程发送给php服务器
+	settlement, err := this.facade.settlements.Add(this.deviceName, curPlayer, playResult)
+	if err != nil {
+		log.Println("Game.onResult: 写入结算记录失败: ", err)
+	}
+	this.recordDeviceReport(ctx, "result")
+	this.recordControl(ctx, "result", playResult)
+	if this.playRound != nil {
+		this.playRound.Result = playResult
+		this.playRound.SettlementKey = settlement.Key
+	}
+	this.protocol.cast(this.facade.outboxRH, Outbox_Deliver, nil)
+
+	// 通知玩家游戏结果和结算状态, 没抓中时给玩家重试的机会
+	// 通过startPlay接口开始游戏的玩家可能没有加入房间, 使用注册表中的进程
+	if playerRH := this.sendGameResultToCurPlayer(ctx, playResult); playerRH != nil {
+		this.protocol.cast(playerRH, Player_SendMessage, settlementMessage(settlement, SettlementPending))
+		if !isWinResult(playResult) {
+			this.openRetryWindow(ctx)
+		}
+	}
+
+	// 抓中扣减库存, 抓完后在回合结束时进入缺货状态
+	if isWinResult(playResult) {
+		stock, err := this.facade.inventory.Take(this.deviceName)
+		if err != nil {
+			log.Println("Game.onResult: 写入奖品库存失败: ", err)
+		}
+		if stock == 0 {
+			log.Println("Game.onResult: 奖品已抓完: ", this.deviceName)
+		}
+	}
+
+	// 没有重试机会时回合结束
+	if this.retryPlayerId == 0 {
+		this.finishPlayRound("result")
+	}
 }
 
-func (this *Game) onLogout() {
+// 抓中的结果
+func isWinResult(playResult string) bool {
+	return playResult == "1"
+}
+
+func (this *Game) onLogout(ctx context.Context, params interface{}) (interface{}, error) {
 	log.Println("Game.onLogout", this.deviceName)
-	defer func() {
-		this.rh.callC <- nil
-	}()
 
-	if this.deviceName != "" {
-		// TODO 其他清理逻辑
+	reason := "logout"
+	if this.isKickout {
+		reason = "kickout"
+	}
+	this.cancelOffer()
+	this.endRound()
+	this.closeRetryWindow(reason)
+	this.finishPlayRound(reason)
 
-		// 广播自己出错状态
-		this.broadcastGameStatus("error", 0)
+	if this.deviceName != "" && !this.isKickout {
+		// TODO 其他清理逻辑
 
-		// 从会话管理器删除自己
-		if !this.isKickout {
-			this.protocol.call(this.sessionRH, Session_RemoveGame, this.deviceName)
-		}
+		// 广播自己离线状态
+		this.curPlayerId = 0
+		this.changeState(ctx, StateOffline, "logout")
 	}
 
-	// 清理资源
-	this.rh.destroy()
+	// 清理资源, 进程退出后自动从注册表删除
+	this.rh.Stop()
+	return nil, nil
 }
 
-func (this *Game) onKickout() {
+func (this *Game) onKickout(ctx context.Context, params interface{}) (interface{}, error) {
 	log.Println("Game.onKickout: ", this.deviceName)
-	defer func() {
-		this.rh.callC <- nil
-	}()
-
-	// 从会话管理器删除自己
-	this.protocol.call(this.sessionRH, Session_RemoveGame, this.deviceName)
 
+	// 新登陆的进程已经替换了注册表中的自己
 	this.isKickout = true
 	this.ws.Close()
+	return nil, nil
 }
 
-func (this *Game) onGetDeviceInfo() {
+func (this *Game) onGetDeviceInfo(ctx context.Context, params interface{}) (interface{}, error) {
 	//log.Println("Game.onGetDeviceInfo: ", this.deviceName)
 
-	deviceInfo := make(map[string]interface{})
-	deviceInfo["deviceName"] = this.deviceName
-	deviceInfo["deviceStatus"] = this.GameStatus
-	deviceInfo["curPlayer"] = this.curPlayerId
-
-	this.rh.callC <- deviceInfo
+	deviceInfo := &DeviceInfo{
+		DeviceName:        this.deviceName,
+		DeviceStatus:      this.state.State().String(),
+		CurPlayer:         this.curPlayerId,
+		QueueLength:       len(this.queue),
+		MaintenanceReason: this.maintenanceReason,
+		OperatorPlayer:    this.operatorPlayerId,
+		Prize:             this.facade.inventory.Get(this.deviceName),
+	}
+	return deviceInfo, nil
 }
 
 // 玩家加入房间
-func (this *Game) onJoin(params []interface{}) {
+func (this *Game) onJoin(ctx context.Context, params interface{}) (interface{}, error) {
 	log.Println("Game.onJoin: ", params)
-	defer func() {
-		this.rh.callC <- nil
-	}()
 
-	playerId := params[0].(int)
-	playerRH := params[1].(*RoutineHandle)
+	req := params.(*GameJoinReq)
+	playerId := req.PlayerId
+	playerRH := req.PlayerRH
 
 	// 当前游戏玩家返回，取消离开状态
 	if this.curPlayerId == playerId {
 		this.isLeave = false
 
 		// 给玩家发送游戏已经过去的时间
-		passTime := int(time.Now().Unix() - this.startTime)
+		passTime := int(this.clock.Now().Unix() - this.startTime)
 		this.sendMessageToPlayer(playerRH, "GamePassTime", passTime)
 	}
 
@@ -333,29 +631,37 @@ func (this *Game) onJoin(params []interface{}) {
 	this.players[playerId] = playerRH
 	this.playerIds = append(this.playerIds, playerId)
 
+	// 加入排队
+	this.enqueue(playerId)
+
 	// 给所有房间内玩家广播加入消息(弹幕功能)
 	data := make(map[string]interface{})
 	data["player"] = playerId
 	data["count"] = len(this.playerIds)
 	data["players"] = this.getLastPlayerIds()
 	this.broadcastPlayerMessage("join", data)
+	return nil, nil
 }
 
 // 玩家离开房间
-func (this *Game) onLeave(playerId int) {
-	log.Println("Game.onLeave: ", playerId)
+func (this *Game) onLeave(ctx context.Context, params interface{}) (interface{}, error) {
+	log.Println("Game.onLeave: ", params)
 
-	defer func() {
-		this.rh.callC <- nil
-	}()
+	playerId := params.(int)
 
 	// 当前玩家离开状态, 记录离开状态
 	if this.curPlayerId == playerId {
 		this.isLeave = true
 	}
 
+	// 重试窗口内离开, 放弃重试
+	if this.retryPlayerId == playerId {
+		this.releaseRetry(ctx, "leave")
+	}
+
 	// 从玩家列表中删除
 	delete(this.players, playerId)
+	delete(this.chatTimes, playerId)
 	playerIds := make([]int, 0, len(this.playerIds))
 	for _, v := range this.playerIds {
 		if v != playerId {
@@ -364,22 +670,56 @@ func (this *Game) onLeave(playerId int) {
 	}
 	this.playerIds = playerIds
 
+	// 退出排队
+	this.dequeue(playerId)
+
 	// 给所有房间内玩家广播离开消息(弹幕功能)
 	data := make(map[string]interface{})
 	data["player"] = playerId
 	data["count"] = len(this.playerIds)
 	data["players"] = this.getLastPlayerIds()
 	this.broadcastPlayerMessage("leave", data)
+	return nil, nil
 }
 
-func (this *Game) onBroadcastMessage(message string) {
-	log.Println("Game.onBroadcastMessage: ", message)
-	defer func() {
-		this.rh.callC <- nil
-	}()
+// 玩家聊天, 经过禁言, 慢速模式和内容过滤后广播, 返回ok或拒绝原因
+func (this *Game) onBroadcastMessage(ctx context.Context, params interface{}) (interface{}, error) {
+	req := params.(*GameBroadcastReq)
+	log.Println("Game.onBroadcastMessage: ", req.PlayerId, req.Message)
 
-	// 给所有房间内玩家广播离开消息(弹幕功能)
+	if _, ok := this.players[req.PlayerId]; !ok {
+		return "not in room", nil
+	}
+
+	chat := this.facade.chat
+	now := receiveTime(ctx, this.clock.Now())
+	if chat.Muted(now, this.deviceName, req.PlayerId) {
+		return ErrChatMuted.Error(), nil
+	}
+	if interval := chat.SlowMode(this.deviceName); interval > 0 {
+		if last, ok := this.chatTimes[req.PlayerId]; ok && now.Sub(last) < interval {
+			return "slow mode", nil
+		}
+	}
+
+	message, filtered, err := chat.Filter(req.Message)
+	if err != nil {
+		return err.Error(), nil
+	}
+	if filtered {
+		// 记录原文, 便于事后审核
+		this.facade.audit.Record(&AuditEntry{
+			Action:     "chatFiltered",
+			DeviceName: this.deviceName,
+			PlayerId:   req.PlayerId,
+			Detail:     req.Message,
+		})
+	}
+	this.chatTimes[req.PlayerId] = now
+
+	// 给所有房间内玩家广播消息(弹幕功能)
 	this.broadcastPlayerMessage("message", message)
+	return "ok", nil
 }
 
 func (this Game) getLastPlayerIds() []int {
@@ -393,67 +733,789 @@ func (this Game) getLastPlayerIds() []int {
 	return ids
 }
 
-func (this *Game) onControl(params []interface{}) {
+func (this *Game) onControl(ctx context.Context, params interface{}) (interface{}, error) {
 	log.Println("Game.onControl: ", params)
 
-	controlType := params[0].(string)
-	playerId := params[1].(int)
+	req := params.(*GameControlReq)
+	controlType := req.ControlType
+	playerId := req.PlayerId
+
+	// 等待进入维护时当前回合照常进行, 只拒绝其他玩家和重新开始
+	if this.maintenancePending {
+		if playerId == 0 || playerId != this.curPlayerId || controlType == "start" || controlType == "retry" {
+			return "device in maintenance", nil
+		}
+	} else if this.maintenanceReason != "" {
+		// 维护中只有员工可以操作设备
+		if playerId == 0 || playerId != this.operatorPlayerId {
+			return "device in maintenance", nil
+		}
+		return this.onOperatorControl(ctx, req)
+	}
 
 	switch controlType {
 	case "start": // 开始
+		if this.outOfStock() {
+			return "out of stock", nil
+		}
+
 		// 当前玩家不是自己, 返回busy状态
 		if this.curPlayerId > 0 && this.curPlayerId != playerId {
-			this.rh.callC <- "busy"
-			return
+			return "busy", nil
 		}
 
-		result := params[2].(int)
+		// 设备不在可以开始游戏的状态
+		if current := this.state.State(); current != StatePlaying && !canTransition(current, StatePlaying) {
+			return "device not ready", nil
+		}
+
+		// 有玩家排队时只有轮到的玩家可以开始
+		if this.curPlayerId != playerId && !this.takeTurn(playerId) {
+			return "busy", nil
+		}
+
+		result := req.Result
+		this.curResult = req.Result
+
+		// 配置了中奖策略的设备由服务器决定是否抓中
+		decision := this.facade.payout.Decide(this.deviceName, playerId)
+		if decision != nil {
+			log.Println("Game.onControl: 中奖决定: ", this.deviceName, playerId, decision.Win, decision.Rule)
+			result = 0
+			if decision.Win {
+				result = 1
+			}
+		}
+
+		// 重试窗口内重新开始
+		if this.retryPlayerId == playerId {
+			this.closeRetryWindow("retry")
+		}
 
 		if this.curPlayerId != playerId {
 			// 开始逻辑
 			this.curPlayerId = playerId
+			this.beginPlayRound(playerId, decision)
 			// 通知game开始
 			data := make(map[string]interface{})
 			data["controlType"] = controlType
 			data["playerId"] = playerId
 			data["result"] = result
-			this.sendMessage("control", data)
+			this.forwardControl(ctx, playerId, data, "")
 		} else {
 			// 重试逻辑
+			this.retryPlayRound(playerId, decision)
 			// 通知game重试
 			data := make(map[string]interface{})
 			data["controlType"] = "retry"
 			data["playerId"] = playerId
 			data["result"] = result
-			this.sendMessage("control", data)
+			this.forwardControl(ctx, playerId, data, "")
 		}
 
 		// 记录倒计时开始时间
-		this.startTime = time.Now().Unix()
-
-		this.rh.callC <- "ok"
-	case "catch", "stopmove", "up", "down", "left", "right", "retry", "noretry":
+		this.startTime = this.clock.Now().Unix()
+		this.changeState(ctx, StatePlaying, "start")
+		this.startRound()
+
+		return "ok", nil
+	case "retry": // 重试窗口内免费重试
+		if this.retryPlayerId == 0 || this.retryPlayerId != playerId {
+			return "no retry window", nil
+		}
+		if this.facade.config.playRetryCharged {
+			return "retry must start by startPlay", nil
+		}
+		result := req.Result
+		if result == 0 {
+			result = this.curResult
+		}
+		return this.onControl(ctx, &GameControlReq{ControlType: "start", PlayerId: playerId, Result: result})
+	case "noretry": // 放弃重试
+		if this.retryPlayerId != 0 && this.retryPlayerId == playerId {
+			this.releaseRetry(ctx, "noretry")
+			return "ok", nil
+		}
 		data := make(map[string]interface{})
 		data["controlType"] = controlType
 		this.sendMessage("control", data)
-		this.rh.callC <- "ok"
+		return "ok", nil
+	case "catch", "stopmove", "up", "down", "left", "right":
+		data := make(map[string]interface{})
+		data["controlType"] = controlType
+		this.forwardControl(ctx, playerId, data, "")
+
+		// 当前玩家下爪, 停止倒计时等待结果
+		if controlType == "catch" && playerId == this.curPlayerId {
+			this.catchRound(ctx)
+		}
+		return "ok", nil
 	default:
-		this.rh.callC <- "unknown control type"
+		return "unknown control type", nil
+	}
+}
+
+//////////////////////////////////////////////////////////
+// 排队
+
+// 加入排队, 已在排队或正在游戏的玩家忽略
+func (this *Game) enqueue(playerId int) {
+	if playerId == this.curPlayerId || playerId == this.offerPlayerId {
+		return
+	}
+	// 维护中和缺货时不排队, 恢复后房间内的玩家重新排队
+	if this.maintenanceReason != "" || this.outOfStock() {
+		return
+	}
+	for _, id := range this.queue {
+		if id == playerId {
+			return
+		}
+	}
+
+	this.queue = append(this.queue, playerId)
+	this.sendQueuePositions()
+	this.offerNext()
+}
+
+// 退出排队, 被邀请的玩家退出时邀请下一个玩家
+func (this *Game) dequeue(playerId int) {
+	if playerId == this.offerPlayerId {
+		this.cancelOffer()
+		this.offerNext()
+		return
+	}
+
+	queue := make([]int, 0, len(this.queue))
+	for _, id := range this.queue {
+		if id != playerId {
+			queue = append(queue, id)
+		}
+	}
+	if len(queue) != len(this.queue) {
+		this.queue = queue
+		this.sendQueuePositions()
+	}
+}
+
+// 玩家开始游戏前检查是否轮到自己, 被邀请的玩家或排在最前面的玩家可以开始, 没有人排队时任何玩家都可以开始
+func (this *Game) takeTurn(playerId int) bool {
+	if this.offerPlayerId != 0 {
+		if this.offerPlayerId != playerId {
+			return false
+		}
+		this.cancelOffer()
+		return true
+	}
+
+	if len(this.queue) == 0 {
+		return true
+	}
+	if this.queue[0] != playerId {
+		return false
 	}
+	this.queue = this.queue[1:]
+	this.sendQueuePositions()
+	return true
+}
+
+// game空闲时邀请排在最前面的玩家, 玩家需要在确认时间内开始游戏, 没有玩家排队时回到空闲状态
+func (this *Game) offerNext() {
+	if state := this.state.State(); state != StateReady && state != StateReserved ||
+		this.curPlayerId != 0 || this.offerPlayerId != 0 {
+		return
+	}
+	// 回合结束了, 进入等待中的维护
+	if this.maintenancePending {
+		this.enterMaintenance(context.Background())
+		return
+	}
+	// 奖品抓完了, 不再邀请玩家
+	if this.outOfStock() {
+		this.enterOutOfStock(context.Background())
+		return
+	}
+	defer func() {
+		if this.offerPlayerId == 0 {
+			this.changeState(context.Background(), StateReady, "no player queued")
+		}
+	}()
+
+	for len(this.queue) > 0 {
+		playerId := this.queue[0]
+		this.queue = this.queue[1:]
+
+		// 已经离开房间的玩家直接跳过
+		playerRH := this.players[playerId]
+		if playerRH == nil || playerRH.Destroyed() {
+			continue
+		}
+
+		timeout := this.facade.config.playConfirmTimeout
+		this.offerSeq++
+		this.offerPlayerId = playerId
+		this.offerTimer = this.protocol.castAfter(this.rh, timeout, Game_OfferTimeout, this.offerSeq)
+		this.changeState(context.Background(), StateReserved, "offer")
+
+		data := make(map[string]interface{})
+		data["deviceName"] = this.deviceName
+		data["timeout"] = int(timeout / time.Second)
+		this.sendMessageToPlayer(playerRH, "playOffer", data)
+		break
+	}
+
+	this.sendQueuePositions()
+}
+
+// 取消当前的邀请
+func (this *Game) cancelOffer() {
+	if this.offerTimer != nil {
+		this.offerTimer.Stop()
+		this.offerTimer = nil
+	}
+	this.offerPlayerId = 0
+}
+
+// 被邀请的玩家没有按时开始游戏, 跳过该玩家
+func (this *Game) onOfferTimeout(ctx context.Context, params interface{}) (interface{}, error) {
+	seq := params.(int)
+	if seq != this.offerSeq || this.offerPlayerId == 0 {
+		return nil, nil
+	}
+
+	playerId := this.offerPlayerId
+	log.Println("Game.onOfferTimeout: ", this.deviceName, playerId)
+	this.offerTimer = nil
+	this.offerPlayerId = 0
+
+	data := make(map[string]interface{})
+	data["deviceName"] = this.deviceName
+	this.sendMessageToPlayer(this.players[playerId], "playOfferExpired", data)
+
+	this.offerNext()
+	return nil, nil
+}
+
+// 给排队的玩家推送当前的排队位置
+func (this *Game) sendQueuePositions() {
+	for i, playerId := range this.queue {
+		data := make(map[string]interface{})
+		data["deviceName"] = this.deviceName
+		data["position"] = i + 1
+		data["length"] = len(this.queue)
+		this.sendMessageToPlayer(this.players[playerId], "queuePosition", data)
+	}
+}
+
+//////////////////////////////////////////////////////////
+// 游戏回合计时, 以服务器时间为准, 不依赖设备结束回合
+
+// 开始一个新回合, 每秒给房间内的玩家推送剩余时间
+func (this *Game) startRound() {
+	this.endRound()
+	this.roundDeadline = this.clock.Now().Add(this.facade.config.playRoundTime)
+	this.onRoundTick(context.Background(), this.roundSeq)
+}
+
+// 结束当前回合, 取消所有回合定时器
+func (this *Game) endRound() {
+	if this.roundTimer != nil {
+		this.roundTimer.Stop()
+		this.roundTimer = nil
+	}
+	this.roundSeq++
+	this.roundDeadline = time.Time{}
+	this.roundCatching = false
+}
+
+// 已经下爪, 停止倒计时, 在宽限时间内等待设备返回结果
+func (this *Game) catchRound(ctx context.Context) {
+	if this.roundDeadline.IsZero() || this.roundCatching {
+		return
+	}
+	this.changeState(ctx, StateCatching, "catch")
+	if this.roundTimer != nil {
+		this.roundTimer.Stop()
+	}
+	this.roundCatching = true
+	this.roundTimer = this.protocol.castAfter(this.rh, this.facade.config.playResultGrace, Game_ResultTimeout, this.roundSeq)
+}
+
+func (this *Game) onRoundTick(ctx context.Context, params interface{}) (interface{}, error) {
+	if params.(int) != this.roundSeq || this.roundCatching || this.isKickout {
+		return nil, nil
+	}
+	this.roundTimer = nil
+
+	remaining := this.roundDeadline.Sub(this.clock.Now())
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	data := make(map[string]interface{})
+	data["deviceName"] = this.deviceName
+	data["curPlayer"] = this.curPlayerId
+	data["remaining"] = int((remaining + time.Second - 1) / time.Second)
+	for _, playerRH := range this.players {
+		this.sendMessageToPlayer(playerRH, "countdown", data)
+	}
+
+	if remaining > 0 {
+		// 下一次推送对齐到整秒
+		next := remaining % time.Second
+		if next == 0 {
+			next = time.Second
+		}
+		this.roundTimer = this.protocol.castAfter(this.rh, next, Game_RoundTick, this.roundSeq)
+		return nil, nil
+	}
+
+	// 时间到了, 自动下爪
+	log.Println("Game.onRoundTick: 时间到, 自动下爪", this.deviceName, this.curPlayerId)
+	control := make(map[string]interface{})
+	control["controlType"] = "catch"
+	this.forwardControl(ctx, 0, control, "auto")
+	this.catchRound(ctx)
+	return nil, nil
+}
+
+// 设备没有按时返回结果, 强制把设备重置为空闲状态并记录审计日志
+func (this *Game) onResultTimeout(ctx context.Context, params interface{}) (interface{}, error) {
+	if params.(int) != this.roundSeq || !this.roundCatching || this.isKickout {
+		return nil, nil
+	}
+
+	log.Println("Game.onResultTimeout: 等待结果超时, 强制重置设备", this.deviceName, this.curPlayerId)
+	this.facade.audit.Record(&AuditEntry{
+		Action:     "forceReset",
+		DeviceName: this.deviceName,
+		PlayerId:   this.curPlayerId,
+		Detail:     "no result within " + this.facade.config.playResultGrace.String(),
+	})
+	this.endRound()
+
+	control := make(map[string]interface{})
+	control["controlType"] = "reset"
+	this.forwardControl(ctx, 0, control, "force")
+	this.finishPlayRound("forceReset")
+
+	this.curPlayerId = 0
+	this.isLeave = false
+	this.startTime = 0
+	this.changeState(ctx, StateReady, "force reset")
+	this.offerNext()
+	return nil, nil
+}
+
+//////////////////////////////////////////////////////////
+// 回合记录
+
+// 开始记录新回合, 上一个没有结束的回合先保存
+func (this *Game) beginPlayRound(playerId int, decision *PayoutDecision) {
+	this.finishPlayRound("replaced")
+	this.playRound = NewPlayRound(this.clock.Now(), this.deviceName, playerId)
+	this.playRound.Payout = decision
+}
+
+// 当前玩家重试, 属于同一回合
+func (this *Game) retryPlayRound(playerId int, decision *PayoutDecision) {
+	if this.playRound == nil || this.playRound.PlayerId != playerId {
+		this.beginPlayRound(playerId, decision)
+		return
+	}
+	this.playRound.Retries++
+	this.playRound.Payout = decision
+}
+
+// 转发指令给设备并记录到回合中, playerId为0表示服务器产生的指令
+func (this *Game) forwardControl(ctx context.Context, playerId int, data map[string]interface{}, value string) {
+	this.sendMessage("control", data)
+	if this.playRound == nil {
+		return
+	}
+
+	now := this.clock.Now()
+	control, _ := data["controlType"].(string)
+	this.playRound.addControl(&RoundControl{
+		Time:        receiveTime(ctx, now),
+		Control:     control,
+		Value:       value,
+		PlayerId:    playerId,
+		ForwardTime: &now,
+	})
+}
+
+// 记录设备的消息, 没有进行中的回合时忽略
+func (this *Game) recordControl(ctx context.Context, control string, value string) {
+	if this.playRound != nil {
+		this.playRound.addControl(&RoundControl{Time: receiveTime(ctx, this.clock.Now()), Control: control, Value: value})
+	}
+}
+
+// 记录设备在指令之后报告的状态
+func (this *Game) recordDeviceReport(ctx context.Context, status string) {
+	if this.playRound != nil {
+		this.playRound.deviceReport(receiveTime(ctx, this.clock.Now()), status)
+	}
+}
+
+// 消息的收到时间, 没有记录时使用处理的时间
+func receiveTime(ctx context.Context, now time.Time) time.Time {
+	if receiveTime := ReceiveTimeFrom(ctx); !receiveTime.IsZero() {
+		return receiveTime
+	}
+	return now
+}
+
+// 结束并保存当前回合
+func (this *Game) finishPlayRound(reason string) {
+	if this.playRound == nil {
+		return
+	}
+	round := this.playRound
+	this.playRound = nil
+
+	round.EndTime = this.clock.Now()
+	round.EndReason = reason
+	if err := this.facade.rounds.Add(round); err != nil {
+		log.Println("Game.finishPlayRound: 写入回合记录失败: ", err)
+	}
+}
+
+//////////////////////////////////////////////////////////
+// 设备状态
+
+// 变化设备状态, 不允许的变化记录日志并返回false
+func (this *Game) changeState(ctx context.Context, to DeviceState, reason string) bool {
+	if err := this.state.Transition(ctx, to, this.curPlayerId, reason); err != nil {
+		log.Println("Game.changeState: ", this.deviceName, err)
+		return false
+	}
+	return true
+}
+
+// 状态变化时广播给房间内的玩家和订阅的玩家
+func (this *Game) onStateChange(ctx context.Context, event *StateChangeEvent) {
+	log.Println("Game.onStateChange: ", event.DeviceName, event.From, "->", event.To, event.Reason)
+	this.broadcastGameStatus(ctx, event.To, event.PlayerId)
+}
+
+//////////////////////////////////////////////////////////
+// 重试窗口
+
+// 没抓中后为当前玩家保留设备, 并通知房间内的所有玩家
+func (this *Game) openRetryWindow(ctx context.Context) {
+	window := this.facade.config.playRetryWindow
+	this.retrySeq++
+	this.retryPlayerId = this.curPlayerId
+	this.retryTimer = this.protocol.castAfter(this.rh, window, Game_RetryTimeout, this.retrySeq)
+	this.changeState(ctx, StateReserved, "retry window")
+
+	data := make(map[string]interface{})
+	data["deviceName"] = this.deviceName
+	data["playerId"] = this.retryPlayerId
+	data["timeout"] = int(window / time.Second)
+	data["charged"] = this.facade.config.playRetryCharged
+	for _, playerRH := range this.players {
+		this.sendMessageToPlayer(playerRH, "retryWindow", data)
+	}
+}
+
+// 关闭重试窗口并通知房间内的所有玩家, 没有重试窗口时返回false
+func (this *Game) closeRetryWindow(reason string) bool {
+	if this.retryPlayerId == 0 {
+		return false
+	}
+	if this.retryTimer != nil {
+		this.retryTimer.Stop()
+		this.retryTimer = nil
+	}
+
+	data := make(map[string]interface{})
+	data["deviceName"] = this.deviceName
+	data["playerId"] = this.retryPlayerId
+	data["reason"] = reason
+	for _, playerRH := range this.players {
+		this.sendMessageToPlayer(playerRH, "retryWindowClosed", data)
+	}
+
+	this.retryPlayerId = 0
+	return true
+}
+
+// 玩家放弃重试, 通知设备结束游戏并把设备释放给排队的玩家
+func (this *Game) releaseRetry(ctx context.Context, reason string) {
+	if !this.closeRetryWindow(reason) {
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["controlType"] = "noretry"
+	this.forwardControl(ctx, 0, data, reason)
+	this.finishPlayRound(reason)
+
+	this.curPlayerId = 0
+	this.isLeave = false
+	this.startTime = 0
+	this.changeState(ctx, StateReady, reason)
+	this.offerNext()
+}
+
+func (this *Game) onRetryTimeout(ctx context.Context, params interface{}) (interface{}, error) {
+	if params.(int) != this.retrySeq {
+		return nil, nil
+	}
+	log.Println("Game.onRetryTimeout: ", this.deviceName, this.retryPlayerId)
+	this.retryTimer = nil
+	this.releaseRetry(ctx, "timeout")
+	return nil, nil
+}
+
+//////////////////////////////////////////////////////////
+// 维护
+
+// 进入或退出维护, 有进行中的回合时等回合结束后进入维护, 返回pending
+func (this *Game) onMaintenance(ctx context.Context, params interface{}) (interface{}, error) {
+	req := params.(*GameMaintenanceReq)
+	log.Println("Game.onMaintenance: ", this.deviceName, req.Enable, req.Operator, req.Reason)
+
+	if !req.Enable {
+		return this.exitMaintenance(ctx, req.Operator), nil
+	}
+
+	if this.maintenanceReason != "" {
+		return "already in maintenance", nil
+	}
+	reason := req.Reason
+	if reason == "" {
+		reason = "maintenance"
+	}
+	this.facade.audit.Record(&AuditEntry{
+		Action:     "maintenanceOn",
+		DeviceName: this.deviceName,
+		Operator:   req.Operator,
+		Detail:     reason,
+	})
+	this.maintenanceReason = reason
+	this.maintenancePending = true
+
+	// 取消排队, 放弃重试窗口, 设备空闲时立即进入维护
+	this.cancelQueue(reason)
+	this.releaseRetry(ctx, "maintenance")
+	if this.maintenancePending && this.curPlayerId == 0 {
+		this.enterMaintenance(ctx)
+	}
+
+	if this.maintenancePending {
+		return "pending", nil
+	}
+	return "ok", nil
+}
+
+// 进入维护状态, 状态机广播维护状态给房间内和订阅的玩家
+func (this *Game) enterMaintenance(ctx context.Context) {
+	if this.changeState(ctx, StateMaintenance, this.maintenanceReason) {
+		this.maintenancePending = false
+	}
+}
+
+// 退出维护, 结束员工的游戏, 房间内的玩家重新排队
+func (this *Game) exitMaintenance(ctx context.Context, operator string) string {
+	if this.maintenanceReason == "" {
+		return "not in maintenance"
+	}
+	this.facade.audit.Record(&AuditEntry{
+		Action:     "maintenanceOff",
+		DeviceName: this.deviceName,
+		Operator:   operator,
+	})
+
+	// 还没进入维护时当前回合照常进行
+	if !this.maintenancePending {
+		this.resetOperatorRound()
+	}
+	this.maintenanceReason = ""
+	this.maintenancePending = false
+	this.operatorPlayerId = 0
+
+	if this.state.State() == StateMaintenance {
+		this.changeState(ctx, StateReady, "maintenance end")
+	}
+	for _, playerId := range this.playerIds {
+		this.enqueue(playerId)
+	}
+	this.offerNext()
+	return "ok"
+}
+
+// 取消所有排队和邀请, 通知被取消的玩家
+func (this *Game) cancelQueue(reason string) {
+	playerIds := this.queue
+	if this.offerPlayerId != 0 {
+		playerIds = append([]int{this.offerPlayerId}, playerIds...)
+		this.cancelOffer()
+	}
+	this.queue = make([]int, 0)
+
+	data := make(map[string]interface{})
+	data["deviceName"] = this.deviceName
+	data["reason"] = reason
+	for _, playerId := range playerIds {
+		this.sendMessageToPlayer(this.players[playerId], "queueCancelled", data)
+	}
+}
+
+// 设置维护中操作设备的员工, 替换员工时结束上一个员工的游戏
+func (this *Game) onOperator(ctx context.Context, params interface{}) (interface{}, error) {
+	req := params.(*GameOperatorReq)
+	log.Println("Game.onOperator: ", this.deviceName, req.PlayerId, req.Operator)
+
+	if this.maintenanceReason == "" || this.maintenancePending {
+		return "not in maintenance", nil
+	}
+	if req.PlayerId == this.operatorPlayerId {
+		return "ok", nil
+	}
+
+	this.resetOperatorRound()
+	if this.operatorPlayerId != 0 {
+		this.facade.audit.Record(&AuditEntry{
+			Action:     "operatorOff",
+			DeviceName: this.deviceName,
+			PlayerId:   this.operatorPlayerId,
+			Operator:   req.Operator,
+		})
+		this.sendOperatorMode(this.operatorPlayerId, false)
+	}
+
+	this.operatorPlayerId = req.PlayerId
+	if this.operatorPlayerId != 0 {
+		this.facade.audit.Record(&AuditEntry{
+			Action:     "operatorOn",
+			DeviceName: this.deviceName,
+			PlayerId:   this.operatorPlayerId,
+			Operator:   req.Operator,
+		})
+		this.sendOperatorMode(this.operatorPlayerId, true)
+	}
+	return "ok", nil
+}
+
+// 员工操作设备, 开始游戏不经过中奖策略, 结果由员工指定
+func (this *Game) onOperatorControl(ctx context.Context, req *GameControlReq) (interface{}, error) {
+	data := make(map[string]interface{})
+	data["controlType"] = req.ControlType
+
+	switch req.ControlType {
+	case "start":
+		if this.curPlayerId != 0 {
+			return "busy", nil
+		}
+		this.curPlayerId = req.PlayerId
+		data["playerId"] = req.PlayerId
+		data["result"] = req.Result
+		data["test"] = true
+	case "catch", "stopmove", "up", "down", "left", "right", "reset":
+		if req.ControlType == "reset" {
+			this.curPlayerId = 0
+		}
+	default:
+		return "unknown control type", nil
+	}
+
+	this.sendMessage("control", data)
+	return "ok", nil
+}
+
+// 员工游戏的结果只发送给员工, 不结算也不开放重试
+func (this *Game) onOperatorResult(ctx context.Context, playResult string) {
+	log.Println("Game.onOperatorResult: ", this.deviceName, this.curPlayerId, playResult)
+
+	if playerRH := this.registry.Lookup(KindPlayer, this.curPlayerId); playerRH != nil {
+		this.sendMessageToPlayer(playerRH, "GameResult", playResult)
+	}
+
+	data := make(map[string]interface{})
+	data["controlType"] = "noretry"
+	this.sendMessage("control", data)
+	this.curPlayerId = 0
+}
+
+// 员工游戏中时重置设备
+func (this *Game) resetOperatorRound() {
+	if this.curPlayerId == 0 {
+		return
+	}
+	control := make(map[string]interface{})
+	control["controlType"] = "reset"
+	this.sendMessage("control", control)
+
+	this.curPlayerId = 0
+	this.isLeave = false
+	this.startTime = 0
+}
+
+// 通知员工进入或退出操作模式
+func (this *Game) sendOperatorMode(playerId int, enable bool) {
+	data := make(map[string]interface{})
+	data["deviceName"] = this.deviceName
+	data["enable"] = enable
+	this.sendMessageToPlayer(this.registry.Lookup(KindPlayer, playerId), "operatorMode", data)
+}
+
+//////////////////////////////////////////////////////////
+// 奖品库存
+
+// 跟踪库存的设备奖品已抓完
+func (this *Game) outOfStock() bool {
+	prize := this.facade.inventory.Get(this.deviceName)
+	return prize != nil && prize.Stock <= 0
+}
+
+// 进入缺货状态, 取消所有排队
+func (this *Game) enterOutOfStock(ctx context.Context) {
+	this.cancelQueue("out of stock")
+	this.changeState(ctx, StateOutOfStock, "out of stock")
+}
+
+// 管理员设置了奖品或补货, 设备空闲时按库存进入或退出缺货状态, 并广播新的奖品信息
+func (this *Game) onPrizeChanged(ctx context.Context, params interface{}) (interface{}, error) {
+	log.Println("Game.onPrizeChanged: ", this.deviceName)
+	if this.deviceName == "" {
+		return nil, nil
+	}
+
+	prev := this.state.State()
+	if this.outOfStock() {
+		if this.curPlayerId == 0 && (prev == StateReady || prev == StateReserved) {
+			this.enterOutOfStock(ctx)
+		}
+	} else if prev == StateOutOfStock {
+		this.changeState(ctx, StateReady, "restock")
+		for _, playerId := range this.playerIds {
+			this.enqueue(playerId)
+		}
+	}
+
+	// 状态没有变化时也要让大厅看到新的库存
+	if this.state.State() == prev {
+		this.broadcastGameStatus(ctx, prev, this.curPlayerId)
+	}
+	return nil, nil
 }
 
 // 给所有玩家广播自己的状态
-func (this *Game) broadcastGameStatus(deviceStatus string, curPlayer int) {
+func (this *Game) broadcastGameStatus(ctx context.Context, state DeviceState, curPlayer int) {
 	// 给房间内的玩家广播状态
-	for _, playerRH := range this.players {
-		if !playerRH.destroyed {
-			this.sendGameStatusToPlayer(playerRH, deviceStatus, curPlayer)
+	for playerId, playerRH := range this.players {
+		if !playerRH.Destroyed() {
+			this.sendGameStatusToPlayer(playerId, playerRH, state, curPlayer)
 		}
 	}
 
 	// 给订阅状态的玩家广播状态
-	resp := this.protocol.call(this.sessionRH, Session_GetGameSubs, this.deviceName)
-	if resp == nil {
+	resp, err := this.protocol.CallCtx(ctx, this.sessionRH, Session_GetGameSubs, this.deviceName)
+	if err != nil || resp == nil {
 		return
 	}
 	subPlayerIds, ok := resp.([]int)
@@ -473,16 +1535,12 @@ func (this *Game) broadcastGameStatus(deviceStatus string, curPlayer int) {
 			continue
 		}
 
-		resp := this.protocol.call(this.sessionRH, Session_GetPlayer, playerId)
-		if resp == nil {
-			continue
-		}
-		playerRH, ok := resp.(*RoutineHandle)
-		if !ok || playerRH.destroyed {
+		playerRH := this.registry.Lookup(KindPlayer, playerId)
+		if playerRH == nil {
 			continue
 		}
 
-		this.sendGameStatusToPlayer(playerRH, deviceStatus, curPlayer)
+		this.sendGameStatusToPlayer(playerId, playerRH, state, curPlayer)
 	}
 }
 
@@ -491,7 +1549,7 @@ func (this *Game) broadcastPlayerMessage(messageType string, message interface{}
 	log.Println("Game.broadcastPlayerMessage: ", messageType, ", ", message)
 
 	for _, playerRH := range this.players {
-		if !playerRH.destroyed {
+		if !playerRH.Destroyed() {
 			this.sendPlayerMessage(playerRH, messageType, message)
 		}
 	}
@@ -506,52 +1564,47 @@ func (this *Game) sendPlayerMessage(playerRH *RoutineHandle, messageType string,
 }
 
 // 给玩家发送game状态消息
-func (this *Game) sendGameStatusToPlayer(playerRH *RoutineHandle, deviceStatus string, curPlayer int) {
-	// ready/playing/error以外的状态只发送给当前游戏的玩家
-	if !(deviceStatus == "ready" || deviceStatus == "playing" || deviceStatus == "error" ||
-		this.curPlayerId == curPlayer) {
+func (this *Game) sendGameStatusToPlayer(playerId int, playerRH *RoutineHandle, state DeviceState, curPlayer int) {
+	// 回合内的状态只发送给当前游戏的玩家
+	if !state.Public() && playerId != curPlayer {
 		return
 	}
 
 	data := make(map[string]interface{})
 	data["deviceName"] = this.deviceName
-	data["deviceStatus"] = deviceStatus
+	data["deviceStatus"] = state.String()
 	data["curPlayer"] = curPlayer
+	if prize := this.facade.inventory.Get(this.deviceName); prize != nil {
+		data["prize"] = prize
+	}
 	this.sendMessageToPlayer(playerRH, "GameStatus", data)
 }
 
-// 给当前玩家发送游戏结果消息
-func (this *Game) sendGameResultToCurPlayer(result string) {
+// 给当前玩家发送游戏结果, 返回玩家进程, 玩家离线或离开房间时返回nil
+func (this *Game) sendGameResultToCurPlayer(ctx context.Context, result string) *RoutineHandle {
 	// 查询玩家是否在线
 	isOffline := false
-	response := this.protocol.call(this.sessionRH, Session_GetPlayer, this.curPlayerId)
-	if response == nil {
-		log.Println("Game.sendGameResultToCurPlayer: player offline1")
+	playerRH := this.registry.Lookup(KindPlayer, this.curPlayerId)
+	if playerRH == nil {
+		log.Println("Game.sendGameResultToCurPlayer: player offline")
 		isOffline = true
 	}
 
-	var playerRH *RoutineHandle
-	if !isOffline {
-		playerRH = response.(*RoutineHandle)
-		if playerRH == nil || playerRH.destroyed {
-			log.Println("Game.sendGameResultToCurPlayer: player offline2")
-			isOffline = true
-		}
-	}
-
 	if isOffline || this.isLeave {
 		// 玩家当前不再房间了, 直接通知game不需要重试了
 		data := make(map[string]interface{})
 		data["controlType"] = "noretry"
 		this.sendMessage("control", data)
-	} else {
-		this.sendMessageToPlayer(playerRH, "GameResult", result)
+		return nil
 	}
+
+	this.sendMessageToPlayer(playerRH, "GameResult", result)
+	return playerRH
 }
 
 // 给玩家发送消息
 func (this *Game) sendMessageToPlayer(playerRH *RoutineHandle, msgType string, data interface{}) {
-	if playerRH == nil || playerRH.destroyed {
+	if playerRH == nil || playerRH.Destroyed() {
 		log.Println("Game.sendMessageToPlayer: playerRH is nil or destroyed")
 		return
 	}
@@ -571,5 +1624,5 @@ func (this *Game) sendMessage(msgType string, data interface{}) {
 	msgObj["data"] = data
 	message, _ := json.Marshal(msgObj)
 
-	websocket.Message.Send(this.ws, string(message))
+	this.ws.Send(string(message))
 }
@@ -0,0 +1,788 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGameLogin(t *testing.T) {
+	h := NewHarness(t)
+	gameRH, conn := h.NewGame()
+
+	h.DeviceSend(gameRH, "login", "dev1:token")
+	login := conn.Last("login").(map[string]interface{})
+	if login["code"].(float64) != 0 {
+		t.Fatalf("login failed: %v", login)
+	}
+	if h.facade.registry.Lookup(KindGame, "dev1") != gameRH {
+		t.Fatal("game not registered")
+	}
+
+	// 同一设备重复登陆, 踢掉旧连接
+	newRH, _ := h.NewGame()
+	h.DeviceSend(newRH, "login", "dev1:token")
+	if !conn.Closed() {
+		t.Fatal("old connection not closed")
+	}
+	if h.facade.registry.Lookup(KindGame, "dev1") != newRH {
+		t.Fatal("new game not registered")
+	}
+}
+
+// 被新连接踢下线的进程不再操作设备, 登出时不广播离线
+func TestGameKickoutRound(t *testing.T) {
+	h := NewHarness(t)
+	oldRH, oldConn := h.NewGame()
+	h.DeviceSend(oldRH, "login", "dev1:token")
+	h.DeviceSend(oldRH, "status", map[string]interface{}{"deviceStatus": "ready", "curPlayer": 0})
+	playerRH, playerConn := h.NewPlayer()
+	h.LoginPlayer(playerRH, 7)
+	h.Call(oldRH, Game_Join, &GameJoinReq{7, playerRH})
+	h.Call(oldRH, Game_Control, &GameControlReq{"start", 7, 0})
+
+	newRH, _ := h.NewGame()
+	h.DeviceSend(newRH, "login", "dev1:token")
+	if !oldConn.Closed() {
+		t.Fatal("old connection not closed")
+	}
+
+	// 倒计时结束不再自动下爪
+	controls := len(oldConn.Messages("control"))
+	h.Advance(h.facade.config.playRoundTime + h.facade.config.playResultGrace)
+	if n := len(oldConn.Messages("control")) - controls; n != 0 {
+		t.Fatalf("controls after kickout = %v", oldConn.Messages("control")[controls:])
+	}
+
+	h.Call(oldRH, Game_Logout, nil)
+	if status := playerConn.Last("GameStatus").(map[string]interface{}); status["deviceStatus"] == "offline" {
+		t.Fatalf("GameStatus = %v", status)
+	}
+	if rounds := h.facade.rounds.Query("dev1", 7, 10); len(rounds) != 1 || rounds[0].EndReason != "kickout" {
+		t.Fatalf("rounds = %+v", rounds)
+	}
+}
+
+func TestGameLoginRejected(t *testing.T) {
+	h := NewHarness(t)
+	online, onlineConn := h.NewGame()
+	h.DeviceSend(online, "login", "dev1:token")
+
+	// 冒充已登陆的设备, 不能踢掉真正的设备
+	for _, token := range []string{"dev1:wrong", "dev9:token", "dev1:nonce:signature"} {
+		gameRH, conn := h.NewGame()
+		h.DeviceSend(gameRH, "login", token)
+		if login := conn.Last("login").(map[string]interface{}); login["code"].(float64) != 1 {
+			t.Fatalf("%s: login = %v", token, login)
+		}
+		if !conn.Closed() {
+			t.Fatalf("%s: connection not closed", token)
+		}
+	}
+	if onlineConn.Closed() || h.facade.registry.Lookup(KindGame, "dev1") != online {
+		t.Fatal("online device kicked out")
+	}
+
+	// 停用的设备
+	h.facade.devices.Set("dev2", &DeviceRecord{Secret: "token", Enabled: false})
+	gameRH, conn := h.NewGame()
+	h.DeviceSend(gameRH, "login", "dev2:token")
+	if login := conn.Last("login").(map[string]interface{}); login["message"] != ErrDeviceDisabled.Error() {
+		t.Fatalf("disabled login = %v", login)
+	}
+
+	entries := h.facade.audit.Recent(10)
+	if len(entries) != 4 || entries[0].Action != "deviceLoginRejected" || entries[1].DeviceName != "dev9" {
+		t.Fatalf("audit = %+v", entries)
+	}
+}
+
+func TestGameLoginChallenge(t *testing.T) {
+	h := NewHarness(t)
+	gameRH, conn := h.NewGame()
+
+	h.DeviceSend(gameRH, "login", "dev1")
+	challenge := conn.Last("login").(map[string]interface{})
+	nonce, _ := challenge["nonce"].(string)
+	if challenge["code"].(float64) != 2 || nonce == "" {
+		t.Fatalf("challenge = %v", challenge)
+	}
+
+	h.DeviceSend(gameRH, "login", "dev1:"+nonce+":"+SignDeviceChallenge("token", "dev1", nonce))
+	if login := conn.Last("login").(map[string]interface{}); login["code"].(float64) != 0 {
+		t.Fatalf("login = %v", login)
+	}
+	if h.facade.registry.Lookup(KindGame, "dev1") != gameRH {
+		t.Fatal("game not registered")
+	}
+
+	// 同一个挑战不能在其他连接上重放
+	replayRH, replayConn := h.NewGame()
+	h.DeviceSend(replayRH, "login", "dev1:"+nonce+":"+SignDeviceChallenge("token", "dev1", nonce))
+	if login := replayConn.Last("login").(map[string]interface{}); login["code"].(float64) != 1 {
+		t.Fatalf("replay login = %v", login)
+	}
+}
+
+// 升级期间没有登记的设备首次登陆时登记
+func TestGameLoginEnroll(t *testing.T) {
+	h := NewHarness(t)
+	h.facade.config.devicesEnroll = true
+	h.facade.devices.Set("dev2", &DeviceRecord{Secret: "token", Enabled: false})
+
+	gameRH, conn := h.NewGame()
+	h.DeviceSend(gameRH, "login", "dev5:legacy")
+	if login := conn.Last("login").(map[string]interface{}); login["code"].(float64) != 0 {
+		t.Fatalf("login = %v", login)
+	}
+	if record := h.facade.devices.Get("dev5"); record == nil || record.Secret != "legacy" || !record.Enabled {
+		t.Fatalf("record = %+v", record)
+	}
+
+	// 登记后按密钥校验, 停用的设备不能登陆
+	for _, token := range []string{"dev5:other", "dev2:token", "dev6:"} {
+		gameRH, conn := h.NewGame()
+		h.DeviceSend(gameRH, "login", token)
+		if login := conn.Last("login").(map[string]interface{}); login["code"].(float64) != 1 {
+			t.Fatalf("%s: login = %v", token, login)
+		}
+	}
+	if h.facade.devices.Get("dev6") != nil {
+		t.Fatal("device enrolled without secret")
+	}
+}
+
+// 设备发来格式错误的消息返回错误, 不能让进程崩溃
+func TestGameMalformedMessages(t *testing.T) {
+	h := NewHarness(t)
+	gameRH, conn := h.NewGame()
+	h.DeviceSend(gameRH, "login", "dev1:token")
+	h.DeviceSend(gameRH, "status", map[string]interface{}{"deviceStatus": "ready", "curPlayer": 0})
+
+	for _, message := range []string{`{"type": "login", "data": 1}`, `{"type": "status", "data": "ready"}`, `{"type": "result", "data": []}`} {
+		if _, err := h.facade.protocol.call(gameRH, Game_RecvMessage, message); !errors.Is(err, ErrBadParams) {
+			t.Fatalf("%s: err = %v", message, err)
+		}
+	}
+	if _, err := h.facade.protocol.call(gameRH, Game_RecvMessage, `{"type": "result", "data": {"playResult": 1, "curPlayer": "7"}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	h.DeviceSend(gameRH, "heartBeat", "ping")
+	if conn.Last("heartBeat") != "ping" {
+		t.Fatal("heartBeat not answered")
+	}
+	if info := h.Call(gameRH, Game_GetDeviceInfo, nil).(*DeviceInfo); info.DeviceStatus != "ready" {
+		t.Fatalf("device info = %+v", info)
+	}
+}
+
+func TestGameHeartBeat(t *testing.T) {
+	h := NewHarness(t)
+	gameRH, conn := h.NewGame()
+
+	h.DeviceSend(gameRH, "heartBeat", "ping")
+	if conn.Last("heartBeat") != "ping" {
+		t.Fatalf("heartBeat = %v", conn.Last("heartBeat"))
+	}
+}
+
+func TestGamePassTime(t *testing.T) {
+	h := NewHarness(t)
+	gameRH, conn := h.NewGame()
+	h.DeviceSend(gameRH, "login", "dev1:token")
+	h.DeviceSend(gameRH, "status", map[string]interface{}{"deviceStatus": "ready", "curPlayer": 0})
+
+	playerRH, playerConn := h.NewPlayer()
+	h.Call(gameRH, Game_Join, &GameJoinReq{7, playerRH})
+
+	if ret := h.Call(gameRH, Game_Control, &GameControlReq{"start", 7, 1}); ret != "ok" {
+		t.Fatalf("start = %v", ret)
+	}
+	control := conn.Last("control").(map[string]interface{})
+	if control["controlType"] != "start" || control["playerId"].(float64) != 7 {
+		t.Fatalf("control = %v", control)
+	}
+
+	// 其他玩家开始游戏返回busy
+	if ret := h.Call(gameRH, Game_Control, &GameControlReq{"start", 8, 1}); ret != "busy" {
+		t.Fatalf("start by other player = %v", ret)
+	}
+
+	// 当前玩家离开12秒后返回房间, 收到已经过去的时间
+	h.Call(gameRH, Game_Leave, 7)
+	h.Advance(12 * time.Second)
+	h.Call(gameRH, Game_Join, &GameJoinReq{7, playerRH})
+	h.Settle()
+
+	passTime := playerConn.Last("GamePassTime")
+	if passTime == nil || passTime.(float64) != 12 {
+		t.Fatalf("GamePassTime = %v", passTime)
+	}
+}
+
+func TestGamePlayQueue(t *testing.T) {
+	h := NewHarness(t)
+	gameRH, _ := h.NewGame()
+	h.DeviceSend(gameRH, "login", "dev1:token")
+	h.DeviceSend(gameRH, "status", map[string]interface{}{"deviceStatus": "ready", "curPlayer": 0})
+
+	player7, conn7 := h.NewPlayer()
+	player8, conn8 := h.NewPlayer()
+	h.Call(gameRH, Game_Join, &GameJoinReq{7, player7})
+	h.Call(gameRH, Game_Join, &GameJoinReq{8, player8})
+	h.Settle()
+
+	// 先加入的玩家被邀请, 后加入的玩家排在第1位
+	if conn7.Last("playOffer") == nil {
+		t.Fatal("player 7 not offered")
+	}
+	position := conn8.Last("queuePosition").(map[string]interface{})
+	if position["position"].(float64) != 1 || position["length"].(float64) != 1 {
+		t.Fatalf("queuePosition = %v", position)
+	}
+	if ret := h.Call(gameRH, Game_Control, &GameControlReq{"start", 8, 0}); ret != "busy" {
+		t.Fatalf("start before turn = %v", ret)
+	}
+
+	// 确认超时, 跳过玩家7邀请玩家8
+	h.Advance(h.facade.config.playConfirmTimeout)
+	if conn7.Last("playOfferExpired") == nil {
+		t.Fatal("player 7 offer not expired")
+	}
+	if conn8.Last("playOffer") == nil {
+		t.Fatal("player 8 not offered")
+	}
+	if ret := h.Call(gameRH, Game_Control, &GameControlReq{"start", 7, 0}); ret != "busy" {
+		t.Fatalf("start by skipped player = %v", ret)
+	}
+	if ret := h.Call(gameRH, Game_Control, &GameControlReq{"start", 8, 0}); ret != "ok" {
+		t.Fatalf("start by offered player = %v", ret)
+	}
+
+	// 接受邀请后超时不再生效
+	h.Advance(h.facade.config.playConfirmTimeout)
+	if conn8.Last("playOfferExpired") != nil {
+		t.Fatal("accepted offer expired")
+	}
+	info := h.Call(gameRH, Game_GetDeviceInfo, nil).(*DeviceInfo)
+	if info.CurPlayer != 8 || info.QueueLength != 0 {
+		t.Fatalf("device info = %+v", info)
+	}
+}
+
+func TestGameRoundTimer(t *testing.T) {
+	h := NewHarness(t)
+	config := h.facade.config
+	gameRH, conn := h.NewGame()
+	h.DeviceSend(gameRH, "login", "dev1:token")
+	h.DeviceSend(gameRH, "status", map[string]interface{}{"deviceStatus": "ready", "curPlayer": 0})
+
+	playerRH, playerConn := h.NewPlayer()
+	h.Call(gameRH, Game_Join, &GameJoinReq{7, playerRH})
+	h.Call(gameRH, Game_Control, &GameControlReq{"start", 7, 0})
+	h.Settle()
+
+	// 每秒推送剩余时间
+	countdown := playerConn.Last("countdown").(map[string]interface{})
+	if int(countdown["remaining"].(float64)) != int(config.playRoundTime/time.Second) {
+		t.Fatalf("countdown = %v", countdown)
+	}
+	h.Advance(time.Second)
+	countdown = playerConn.Last("countdown").(map[string]interface{})
+	if int(countdown["remaining"].(float64)) != int(config.playRoundTime/time.Second)-1 {
+		t.Fatalf("countdown = %v", countdown)
+	}
+
+	// 时间到自动下爪
+	for i := 1; i < int(config.playRoundTime/time.Second); i++ {
+		h.Advance(time.Second)
+	}
+	control := conn.Last("control").(map[string]interface{})
+	if control["controlType"] != "catch" {
+		t.Fatalf("control = %v", control)
+	}
+
+	// 宽限时间内没有结果, 强制重置并记录审计日志
+	h.Advance(config.playResultGrace)
+	control = conn.Last("control").(map[string]interface{})
+	if control["controlType"] != "reset" {
+		t.Fatalf("control = %v", control)
+	}
+	info := h.Call(gameRH, Game_GetDeviceInfo, nil).(*DeviceInfo)
+	if info.DeviceStatus != "ready" || info.CurPlayer != 0 {
+		t.Fatalf("device info = %+v", info)
+	}
+	entries := h.facade.audit.Recent(1)
+	if len(entries) != 1 || entries[0].Action != "forceReset" || entries[0].PlayerId != 7 {
+		t.Fatalf("audit = %+v", entries)
+	}
+}
+
+func TestGameRoundCatchByPlayer(t *testing.T) {
+	h := NewHarness(t)
+	gameRH, conn := h.NewGame()
+	h.DeviceSend(gameRH, "login", "dev1:token")
+	h.DeviceSend(gameRH, "status", map[string]interface{}{"deviceStatus": "ready", "curPlayer": 0})
+
+	playerRH, _ := h.NewPlayer()
+	h.Call(gameRH, Game_Join, &GameJoinReq{7, playerRH})
+	if ret := h.Call(gameRH, Game_Control, &GameControlReq{"start", 7, 0}); ret != "ok" {
+		t.Fatalf("start = %v", ret)
+	}
+	h.Advance(5 * time.Second)
+	h.Call(gameRH, Game_Control, &GameControlReq{"catch", 7, 0})
+
+	// 设备回到空闲状态后不再重置
+	h.DeviceSend(gameRH, "status", map[string]interface{}{"deviceStatus": "ready", "curPlayer": 0})
+	h.Advance(h.facade.config.playRoundTime + h.facade.config.playResultGrace)
+	if control := conn.Last("control").(map[string]interface{}); control["controlType"] != "catch" {
+		t.Fatalf("control = %v", control)
+	}
+	if len(h.facade.audit.Recent(1)) != 0 {
+		t.Fatal("unexpected force reset")
+	}
+}
+
+func TestGameDeviceState(t *testing.T) {
+	h := NewHarness(t)
+	gameRH, _ := h.NewGame()
+	h.DeviceSend(gameRH, "login", "dev1:token")
+
+	// 设备离线时不能开始游戏
+	if ret := h.Call(gameRH, Game_Control, &GameControlReq{"start", 7, 0}); ret != "device not ready" {
+		t.Fatalf("start = %v", ret)
+	}
+
+	player7, conn7 := h.NewPlayer()
+	player8, conn8 := h.NewPlayer()
+	h.Call(gameRH, Game_Join, &GameJoinReq{7, player7})
+	h.Call(gameRH, Game_Join, &GameJoinReq{8, player8})
+	h.DeviceSend(gameRH, "status", map[string]interface{}{"deviceStatus": "ready", "curPlayer": 0})
+	if status := conn8.Last("GameStatus").(map[string]interface{}); status["deviceStatus"] != "reserved" {
+		t.Fatalf("status = %v", status)
+	}
+
+	// 不允许的变化和未知状态被拒绝
+	h.DeviceSend(gameRH, "status", map[string]interface{}{"deviceStatus": "settling", "curPlayer": 7})
+	h.DeviceSend(gameRH, "status", map[string]interface{}{"deviceStatus": "flying", "curPlayer": 7})
+	info := h.Call(gameRH, Game_GetDeviceInfo, nil).(*DeviceInfo)
+	if info.DeviceStatus != "reserved" || info.CurPlayer != 0 {
+		t.Fatalf("device info = %+v", info)
+	}
+
+	// 回合内的状态只发送给当前玩家
+	h.Call(gameRH, Game_Control, &GameControlReq{"start", 7, 0})
+	h.Call(gameRH, Game_Control, &GameControlReq{"catch", 7, 0})
+	h.Settle()
+	if status := conn7.Last("GameStatus").(map[string]interface{}); status["deviceStatus"] != "catching" {
+		t.Fatalf("player 7 status = %v", status)
+	}
+	if status := conn8.Last("GameStatus").(map[string]interface{}); status["deviceStatus"] != "playing" {
+		t.Fatalf("player 8 status = %v", status)
+	}
+}
+
+// 登陆设备并开始一局游戏, 设备返回没抓中的结果
+func startLosingRound(h *Harness, players ...int) (*RoutineHandle, *FakeConn, map[int]*FakeConn) {
+	gameRH, conn := h.NewGame()
+	h.DeviceSend(gameRH, "login", "dev1:token")
+	h.DeviceSend(gameRH, "status", map[string]interface{}{"deviceStatus": "ready", "curPlayer": 0})
+
+	conns := make(map[int]*FakeConn)
+	for _, playerId := range players {
+		playerRH, playerConn := h.NewPlayer()
+		h.LoginPlayer(playerRH, playerId)
+		h.Call(gameRH, Game_Join, &GameJoinReq{playerId, playerRH})
+		conns[playerId] = playerConn
+	}
+
+	h.Call(gameRH, Game_Control, &GameControlReq{"start", players[0], 0})
+	h.Call(gameRH, Game_Control, &GameControlReq{"catch", players[0], 0})
+	h.DeviceSend(gameRH, "result", map[string]interface{}{"playResult": "0", "curPlayer": players[0]})
+	return gameRH, conn, conns
+}
+
+// 通过startPlay接口开始游戏, 没有加入房间的玩家也能收到结果和结算通知
+func TestGameResultWithoutJoin(t *testing.T) {
+	h := NewHarness(t)
+	gameRH, _ := h.NewGame()
+	h.DeviceSend(gameRH, "login", "dev1:token")
+	h.DeviceSend(gameRH, "status", map[string]interface{}{"deviceStatus": "ready", "curPlayer": 0})
+	_, conn := h.NewLoggedInPlayer(7)
+
+	h.Call(gameRH, Game_Control, &GameControlReq{"start", 7, 0})
+	h.Call(gameRH, Game_Control, &GameControlReq{"catch", 7, 0})
+	h.DeviceSend(gameRH, "result", map[string]interface{}{"playResult": "0", "curPlayer": 7})
+
+	if info := h.Call(gameRH, Game_GetDeviceInfo, nil).(*DeviceInfo); info.DeviceStatus != "reserved" {
+		t.Fatalf("device info = %+v", info)
+	}
+	if conn.Last("GameResult") != "0" {
+		t.Fatalf("GameResult = %v", conn.Last("GameResult"))
+	}
+	if settlements := conn.Messages("settlement"); len(settlements) == 0 || settlements[0].(map[string]interface{})["status"] != SettlementPending {
+		t.Fatalf("settlement = %v", settlements)
+	}
+}
+
+func TestGameRetryWindow(t *testing.T) {
+	h := NewHarness(t)
+	gameRH, conn, conns := startLosingRound(h, 7, 8)
+
+	// 没抓中, 给玩家7保留设备并通知房间
+	if calls := h.ApiCalls(); len(calls) != 1 || calls[0] != "/play/GetResult" {
+		t.Fatalf("api calls = %v", calls)
+	}
+	window := conns[8].Last("retryWindow").(map[string]interface{})
+	if window["playerId"].(float64) != 7 || window["charged"] != true {
+		t.Fatalf("retryWindow = %v", window)
+	}
+	if info := h.Call(gameRH, Game_GetDeviceInfo, nil).(*DeviceInfo); info.DeviceStatus != "reserved" {
+		t.Fatalf("device info = %+v", info)
+	}
+
+	// 窗口内其他玩家不能开始, 收费时不能直接重试
+	if ret := h.Call(gameRH, Game_Control, &GameControlReq{"start", 8, 0}); ret != "busy" {
+		t.Fatalf("start by other player = %v", ret)
+	}
+	if ret := h.Call(gameRH, Game_Control, &GameControlReq{"retry", 7, 0}); ret != "retry must start by startPlay" {
+		t.Fatalf("retry = %v", ret)
+	}
+
+	// 通过startPlay重试
+	if ret := h.Call(gameRH, Game_Control, &GameControlReq{"start", 7, 0}); ret != "ok" {
+		t.Fatalf("retry by start = %v", ret)
+	}
+	if control := conn.Last("control").(map[string]interface{}); control["controlType"] != "retry" {
+		t.Fatalf("control = %v", control)
+	}
+	if closed := conns[8].Last("retryWindowClosed").(map[string]interface{}); closed["reason"] != "retry" {
+		t.Fatalf("retryWindowClosed = %v", closed)
+	}
+}
+
+func TestGameRetryWindowTimeout(t *testing.T) {
+	h := NewHarness(t)
+	gameRH, conn, conns := startLosingRound(h, 7, 8)
+
+	// 超时后通知设备结束, 设备释放给排队的玩家8
+	h.Advance(h.facade.config.playRetryWindow)
+	if control := conn.Last("control").(map[string]interface{}); control["controlType"] != "noretry" {
+		t.Fatalf("control = %v", control)
+	}
+	if closed := conns[7].Last("retryWindowClosed").(map[string]interface{}); closed["reason"] != "timeout" {
+		t.Fatalf("retryWindowClosed = %v", closed)
+	}
+	if conns[8].Last("playOffer") == nil {
+		t.Fatal("player 8 not offered")
+	}
+	if ret := h.Call(gameRH, Game_Control, &GameControlReq{"start", 7, 0}); ret != "busy" {
+		t.Fatalf("start after timeout = %v", ret)
+	}
+}
+
+// 免费重试沿用开始游戏时php服务器计算的结果
+func TestGameFreeRetryResult(t *testing.T) {
+	h := NewHarness(t)
+	h.facade.config.playRetryCharged = false
+	gameRH, conn := h.NewGame()
+	h.DeviceSend(gameRH, "login", "dev1:token")
+	h.DeviceSend(gameRH, "status", map[string]interface{}{"deviceStatus": "ready", "curPlayer": 0})
+	playerRH, _ := h.NewPlayer()
+	h.LoginPlayer(playerRH, 7)
+	h.Call(gameRH, Game_Join, &GameJoinReq{7, playerRH})
+
+	h.Call(gameRH, Game_Control, &GameControlReq{"start", 7, 1})
+	h.Call(gameRH, Game_Control, &GameControlReq{"catch", 7, 0})
+	h.DeviceSend(gameRH, "result", map[string]interface{}{"playResult": "0", "curPlayer": 7})
+
+	if ret := h.Call(gameRH, Game_Control, &GameControlReq{"retry", 7, 0}); ret != "ok" {
+		t.Fatalf("retry = %v", ret)
+	}
+	control := conn.Last("control").(map[string]interface{})
+	if control["controlType"] != "retry" || control["playerId"].(float64) != 7 || control["result"].(float64) != 1 {
+		t.Fatalf("control = %v", control)
+	}
+}
+
+func TestGameFreeRetry(t *testing.T) {
+	h := NewHarness(t)
+	h.facade.config.playRetryCharged = false
+	gameRH, conn, _ := startLosingRound(h, 7)
+
+	if ret := h.Call(gameRH, Game_Control, &GameControlReq{"retry", 7, 0}); ret != "ok" {
+		t.Fatalf("retry = %v", ret)
+	}
+	if control := conn.Last("control").(map[string]interface{}); control["controlType"] != "retry" {
+		t.Fatalf("control = %v", control)
+	}
+
+	// 再次没抓中后放弃重试, 设备回到空闲
+	h.Call(gameRH, Game_Control, &GameControlReq{"catch", 7, 0})
+	h.DeviceSend(gameRH, "result", map[string]interface{}{"playResult": "0", "curPlayer": 7})
+	if ret := h.Call(gameRH, Game_Control, &GameControlReq{"noretry", 7, 0}); ret != "ok" {
+		t.Fatalf("noretry = %v", ret)
+	}
+	if info := h.Call(gameRH, Game_GetDeviceInfo, nil).(*DeviceInfo); info.DeviceStatus != "ready" || info.CurPlayer != 0 {
+		t.Fatalf("device info = %+v", info)
+	}
+}
+
+func TestGameMaintenance(t *testing.T) {
+	h := NewHarness(t)
+	gameRH, conn, conns := startLosingRound(h, 7, 8)
+
+	// 重试窗口被放弃, 排队被取消, 设备进入维护
+	if ret := h.Call(gameRH, Game_Maintenance, &GameMaintenanceReq{true, "staff1", "claw repair"}); ret != "ok" {
+		t.Fatalf("maintenance = %v", ret)
+	}
+	if control := conn.Last("control").(map[string]interface{}); control["controlType"] != "noretry" {
+		t.Fatalf("control = %v", control)
+	}
+	if cancelled := conns[8].Last("queueCancelled").(map[string]interface{}); cancelled["reason"] != "claw repair" {
+		t.Fatalf("queueCancelled = %v", cancelled)
+	}
+	if status := conns[8].Last("GameStatus").(map[string]interface{}); status["deviceStatus"] != "maintenance" {
+		t.Fatalf("status = %v", status)
+	}
+	if entries := h.facade.audit.Recent(1); entries[0].Action != "maintenanceOn" || entries[0].Operator != "staff1" {
+		t.Fatalf("audit = %+v", entries[0])
+	}
+
+	// 维护中不能开始游戏, 设备报告空闲也保持维护
+	if ret := h.Call(gameRH, Game_Control, &GameControlReq{"start", 8, 0}); ret != "device in maintenance" {
+		t.Fatalf("start = %v", ret)
+	}
+	h.DeviceSend(gameRH, "status", map[string]interface{}{"deviceStatus": "ready", "curPlayer": 0})
+	if info := h.Call(gameRH, Game_GetDeviceInfo, nil).(*DeviceInfo); info.DeviceStatus != "maintenance" || info.MaintenanceReason != "claw repair" {
+		t.Fatalf("device info = %+v", info)
+	}
+
+	// 维护结束后房间内的玩家重新排队
+	if ret := h.Call(gameRH, Game_Maintenance, &GameMaintenanceReq{false, "staff1", ""}); ret != "ok" {
+		t.Fatalf("end maintenance = %v", ret)
+	}
+	if conns[7].Last("playOffer") == nil {
+		t.Fatal("player 7 not offered")
+	}
+	if info := h.Call(gameRH, Game_GetDeviceInfo, nil).(*DeviceInfo); info.DeviceStatus != "reserved" || info.QueueLength != 1 {
+		t.Fatalf("device info = %+v", info)
+	}
+}
+
+func TestGameMaintenancePending(t *testing.T) {
+	h := NewHarness(t)
+	gameRH, conn := h.NewGame()
+	h.DeviceSend(gameRH, "login", "dev1:token")
+	h.DeviceSend(gameRH, "status", map[string]interface{}{"deviceStatus": "ready", "curPlayer": 0})
+	playerRH, _ := h.NewPlayer()
+	h.Call(gameRH, Game_Join, &GameJoinReq{7, playerRH})
+	h.Call(gameRH, Game_Control, &GameControlReq{"start", 7, 0})
+
+	// 游戏中的回合照常进行, 结束后进入维护
+	if ret := h.Call(gameRH, Game_Maintenance, &GameMaintenanceReq{true, "staff1", ""}); ret != "pending" {
+		t.Fatalf("maintenance = %v", ret)
+	}
+
+	// 其他玩家和重新开始被拒绝
+	for _, req := range []*GameControlReq{{"left", 8, 0}, {"start", 8, 0}, {"start", 7, 0}} {
+		if ret := h.Call(gameRH, Game_Control, req); ret != "device in maintenance" {
+			t.Fatalf("%+v = %v", req, ret)
+		}
+	}
+
+	// 当前玩家的移动和下爪照常转发给设备
+	controls := len(conn.Messages("control"))
+	for _, controlType := range []string{"left", "catch"} {
+		if ret := h.Call(gameRH, Game_Control, &GameControlReq{controlType, 7, 0}); ret != "ok" {
+			t.Fatalf("%s = %v", controlType, ret)
+		}
+	}
+	if n := len(conn.Messages("control")) - controls; n != 2 {
+		t.Fatalf("controls forwarded = %d", n)
+	}
+	if control := conn.Last("control").(map[string]interface{}); control["controlType"] != "catch" {
+		t.Fatalf("control = %v", control)
+	}
+	h.DeviceSend(gameRH, "status", map[string]interface{}{"deviceStatus": "ready", "curPlayer": 0})
+	if info := h.Call(gameRH, Game_GetDeviceInfo, nil).(*DeviceInfo); info.DeviceStatus != "maintenance" {
+		t.Fatalf("device info = %+v", info)
+	}
+}
+
+func TestGameOperatorControl(t *testing.T) {
+	h := NewHarness(t)
+	gameRH, conn := h.NewGame()
+	h.DeviceSend(gameRH, "login", "dev1:token")
+	h.DeviceSend(gameRH, "status", map[string]interface{}{"deviceStatus": "ready", "curPlayer": 0})
+	staffRH, staffConn := h.NewPlayer()
+	h.LoginPlayer(staffRH, 99)
+	h.Call(gameRH, Game_Join, &GameJoinReq{99, staffRH})
+
+	if ret := h.Call(gameRH, Game_Operator, &GameOperatorReq{99, "admin"}); ret != "not in maintenance" {
+		t.Fatalf("operator = %v", ret)
+	}
+	h.Call(gameRH, Game_Maintenance, &GameMaintenanceReq{true, "admin", "test"})
+	if ret := h.Call(gameRH, Game_Operator, &GameOperatorReq{99, "admin"}); ret != "ok" {
+		t.Fatalf("operator = %v", ret)
+	}
+	if mode := staffConn.Last("operatorMode").(map[string]interface{}); mode["enable"] != true {
+		t.Fatalf("operatorMode = %v", mode)
+	}
+
+	// 员工开始游戏不经过中奖策略, 结果不结算也不开放重试
+	h.facade.payout = newTestPayoutEngine(t, h.clock, map[string]map[string]float64{"dev1": {"guaranteeAfter": 1}}, "")
+	if ret := h.Call(gameRH, Game_Control, &GameControlReq{"start", 99, 0}); ret != "ok" {
+		t.Fatalf("start = %v", ret)
+	}
+	control := conn.Last("control").(map[string]interface{})
+	if control["result"].(float64) != 0 || control["test"] != true {
+		t.Fatalf("control = %v", control)
+	}
+	h.Call(gameRH, Game_Control, &GameControlReq{"catch", 99, 0})
+	h.DeviceSend(gameRH, "result", map[string]interface{}{"playResult": "0", "curPlayer": 99})
+
+	if staffConn.Last("GameResult") != "0" {
+		t.Fatalf("GameResult = %v", staffConn.Last("GameResult"))
+	}
+	if staffConn.Last("retryWindow") != nil || len(h.ApiCalls()) != 0 {
+		t.Fatalf("operator result settled, api calls = %v", h.ApiCalls())
+	}
+	if decisions, _ := h.facade.payout.Recent("dev1", 10); len(decisions) != 0 {
+		t.Fatalf("payout decisions = %v", decisions)
+	}
+	if info := h.Call(gameRH, Game_GetDeviceInfo, nil).(*DeviceInfo); info.DeviceStatus != "maintenance" || info.CurPlayer != 0 {
+		t.Fatalf("device info = %+v", info)
+	}
+}
+
+func TestGamePrizeStock(t *testing.T) {
+	h := NewHarness(t)
+	h.facade.inventory.Set("dev1", &Prize{Sku: "bear", Name: "Bear", Stock: 1})
+	gameRH, _ := h.NewGame()
+	h.DeviceSend(gameRH, "login", "dev1:token")
+	h.DeviceSend(gameRH, "status", map[string]interface{}{"deviceStatus": "ready", "curPlayer": 0})
+
+	player7, conn7 := h.NewPlayer()
+	player8, conn8 := h.NewPlayer()
+	h.LoginPlayer(player7, 7)
+	h.Call(gameRH, Game_Join, &GameJoinReq{7, player7})
+	h.Call(gameRH, Game_Join, &GameJoinReq{8, player8})
+
+	// 抓中扣减库存, 回合结束后进入缺货状态并取消排队
+	h.Call(gameRH, Game_Control, &GameControlReq{"start", 7, 1})
+	h.Call(gameRH, Game_Control, &GameControlReq{"catch", 7, 0})
+	h.DeviceSend(gameRH, "result", map[string]interface{}{"playResult": "1", "curPlayer": 7})
+	h.DeviceSend(gameRH, "status", map[string]interface{}{"deviceStatus": "ready", "curPlayer": 0})
+
+	status := conn7.Last("GameStatus").(map[string]interface{})
+	prize := status["prize"].(map[string]interface{})
+	if status["deviceStatus"] != "outOfStock" || prize["sku"] != "bear" || prize["stock"].(float64) != 0 {
+		t.Fatalf("status = %v", status)
+	}
+	if cancelled := conn8.Last("queueCancelled").(map[string]interface{}); cancelled["reason"] != "out of stock" {
+		t.Fatalf("queueCancelled = %v", cancelled)
+	}
+	if ret := h.Call(gameRH, Game_Control, &GameControlReq{"start", 8, 0}); ret != "out of stock" {
+		t.Fatalf("start = %v", ret)
+	}
+
+	// 补货后恢复空闲, 房间内的玩家重新排队
+	h.facade.inventory.Set("dev1", &Prize{Sku: "bear", Name: "Bear", Stock: 5})
+	h.Call(gameRH, Game_PrizeChanged, nil)
+	info := h.Call(gameRH, Game_GetDeviceInfo, nil).(*DeviceInfo)
+	if info.DeviceStatus != "reserved" || info.Prize == nil || info.Prize.Stock != 5 {
+		t.Fatalf("device info = %+v", info)
+	}
+	if conn7.Last("playOffer") == nil {
+		t.Fatal("player 7 not offered")
+	}
+}
+
+func TestGamePlayRoundRecord(t *testing.T) {
+	h := NewHarness(t)
+	gameRH, _, _ := startLosingRound(h, 7)
+
+	// 重试属于同一回合, 放弃重试后回合结束
+	h.Call(gameRH, Game_Control, &GameControlReq{"start", 7, 0})
+	h.Call(gameRH, Game_Control, &GameControlReq{"left", 7, 0})
+	h.Advance(h.facade.config.playRoundTime)
+	h.DeviceSend(gameRH, "result", map[string]interface{}{"playResult": "0", "curPlayer": 7})
+	if rounds := h.facade.rounds.Query("dev1", 7, 10); len(rounds) != 0 {
+		t.Fatalf("round finished in retry window: %+v", rounds[0])
+	}
+	h.Call(gameRH, Game_Control, &GameControlReq{"noretry", 7, 0})
+
+	rounds := h.facade.rounds.Query("dev1", 7, 10)
+	if len(rounds) != 1 {
+		t.Fatalf("rounds = %v", rounds)
+	}
+	round := rounds[0]
+	controls := make([]string, 0)
+	for _, control := range round.Controls {
+		controls = append(controls, control.Control+":"+control.Value)
+	}
+	want := "[start: catch: result:0 retry: left: catch:auto result:0 noretry:noretry]"
+	if got := fmt.Sprint(controls); got != want {
+		t.Fatalf("controls = %s, want %s", got, want)
+	}
+	if round.Retries != 1 || round.Result != "0" || round.EndReason != "noretry" || round.SettlementKey == "" {
+		t.Fatalf("round = %+v", round)
+	}
+	if round.EndTime.Sub(round.StartTime) != h.facade.config.playRoundTime {
+		t.Fatalf("round time = %v", round.EndTime.Sub(round.StartTime))
+	}
+}
+
+func TestGameRoundTimeline(t *testing.T) {
+	h := NewHarness(t)
+	gameRH, _ := h.NewGame()
+	h.DeviceSend(gameRH, "login", "dev1:token")
+	h.DeviceSend(gameRH, "status", map[string]interface{}{"deviceStatus": "ready", "curPlayer": 0})
+	playerRH, _ := h.NewPlayer()
+	h.Call(gameRH, Game_Join, &GameJoinReq{7, playerRH})
+	h.Call(gameRH, Game_Control, &GameControlReq{"start", 7, 0})
+
+	// 玩家按下爪1秒前服务器收到, 设备2秒后仍然报告游戏中
+	received := h.clock.Now()
+	h.Advance(time.Second)
+	ctx := WithReceiveTime(context.Background(), received)
+	if _, err := h.facade.protocol.CallCtx(ctx, gameRH, Game_Control, &GameControlReq{"catch", 7, 0}); err != nil {
+		t.Fatal(err)
+	}
+	h.Advance(2 * time.Second)
+	h.DeviceSend(gameRH, "status", map[string]interface{}{"deviceStatus": "playing", "curPlayer": 7})
+	h.DeviceSend(gameRH, "result", map[string]interface{}{"playResult": "1", "curPlayer": 7})
+
+	round := h.facade.rounds.Query("dev1", 7, 1)[0]
+	catch := round.Controls[1]
+	if catch.Control != "catch" || catch.PlayerId != 7 || catch.ForwardTime.Sub(catch.Time) != time.Second {
+		t.Fatalf("catch = %+v", catch)
+	}
+	if catch.DeviceStatus != "playing" || catch.DeviceTime.Sub(*catch.ForwardTime) != 2*time.Second {
+		t.Fatalf("catch device status = %+v", catch)
+	}
+
+	lines := make([]string, 0)
+	for _, event := range round.Timeline() {
+		lines = append(lines, event.String())
+	}
+	want := []string{
+		"   +0.000s server round " + round.Id + " start, player 7",
+		"   +0.000s player player 7 sent start",
+		"   +0.000s server start forwarded to device, delay 0s",
+		"   +0.000s player player 7 sent catch",
+		"   +1.000s server catch forwarded to device, delay 1s",
+		"   +3.000s device status playing after start, delay 3s",
+		"   +3.000s device status playing after catch, delay 2s",
+		"   +3.000s device result(1)",
+		"   +3.000s server round end: result, result \"1\", retries 0",
+	}
+	if fmt.Sprint(lines) != fmt.Sprint(want) {
+		t.Fatalf("timeline:\n%s\nwant:\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+}